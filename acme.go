@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ACMEConfig sets up automatic certificates from an ACME CA such as Let's Encrypt
+type ACMEConfig struct {
+	// DirectoryURL is the CA directory, e.g. https://acme-v02.api.letsencrypt.org/directory
+	DirectoryURL string
+	// Email is the account contact, it may be empty
+	Email string
+	// Domains are the host names certificates are obtained for, handshakes
+	// for other names are left to the other configured certificates
+	Domains []string
+	// CacheDir keeps the account key and certificates across restarts,
+	// nothing is stored when it is empty
+	CacheDir string
+	// Challenge is "http-01", the default, or "tls-alpn-01"
+	Challenge string
+	// RenewBefore renews certificates this long before they expire, 30 days by default
+	RenewBefore time.Duration
+	// HTTPClient talks to the CA, http.DefaultClient when nil
+	HTTPClient *http.Client
+}
+
+const (
+	acmeHTTPChallenge    = "http-01"
+	acmeTLSALPNChallenge = "tls-alpn-01"
+	acmeTLSALPNProto     = "acme-tls/1"
+	acmeChallengePath    = "/.well-known/acme-challenge/"
+	acmeAccountKeyFile   = "acme_account.key"
+	// acmeRenewCheckInterval is how often certificates are checked for renewal
+	acmeRenewCheckInterval = 12 * time.Hour
+	acmeObtainTimeout      = 2 * time.Minute
+)
+
+// idPeAcmeIdentifier is the certificate extension holding the
+// tls-alpn-01 key authorization digest, RFC 8737
+var idPeAcmeIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// acmeManager obtains, caches and renews the certificates of an ACMEConfig
+// and answers the challenges of the CA
+type acmeManager struct {
+	config ACMEConfig
+	debug  bool
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+	// obtaining holds a channel closed when the running order for a domain ends
+	obtaining map[string]chan struct{}
+	// tokens maps http-01 tokens to key authorizations
+	tokens map[string]string
+	// alpnCerts are the tls-alpn-01 challenge certificates by domain
+	alpnCerts map[string]*tls.Certificate
+
+	// orderMu serializes orders, client is created with the first one
+	orderMu sync.Mutex
+	client  *acmeClient
+}
+
+// EnableACME makes the server obtain and renew certificates for the
+// configured domains and enables TLS. The http-01 challenge is answered
+// on the plain HTTP listener of SetHTTPRedirect, which Listen requires for
+// it, and on the TLS listeners ahead of the middleware added with Use and
+// the Host check, so neither can turn the CA away. tls-alpn-01 is answered
+// on the TLS listeners.
+func (server *Server) EnableACME(config ACMEConfig) error {
+	if config.DirectoryURL == "" {
+		return errors.New("acme: missing directory URL")
+	}
+	if len(config.Domains) == 0 {
+		return errors.New("acme: no domains configured")
+	}
+	// The domains are normalized in a copy, the caller keeps its slice
+	config.Domains = slices.Clone(config.Domains)
+	for i, domain := range config.Domains {
+		if domain == "" || strings.ContainsAny(domain, `/\`) || strings.Contains(domain, "..") {
+			return fmt.Errorf("acme: invalid domain %q", domain)
+		}
+		config.Domains[i] = strings.ToLower(domain)
+	}
+	switch config.Challenge {
+	case "":
+		config.Challenge = acmeHTTPChallenge
+	case acmeHTTPChallenge, acmeTLSALPNChallenge:
+	default:
+		return fmt.Errorf("acme: unsupported challenge %s", config.Challenge)
+	}
+	if config.RenewBefore <= 0 {
+		config.RenewBefore = 30 * 24 * time.Hour
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	if config.CacheDir != "" {
+		if err := os.MkdirAll(config.CacheDir, 0700); err != nil {
+			return err
+		}
+	}
+
+	manager := &acmeManager{
+		config:    config,
+		debug:     server.debug,
+		certs:     make(map[string]*tls.Certificate),
+		obtaining: make(map[string]chan struct{}),
+		tokens:    make(map[string]string),
+		alpnCerts: make(map[string]*tls.Certificate),
+	}
+	manager.loadCache()
+
+	server.ensureTLSConfig()
+	server.acme = manager
+	server.router.mu.Lock()
+	server.router.chained = nil
+	server.router.mu.Unlock()
+	return nil
+}
+
+// serveHTTPChallenge answers http-01 validation requests
+func (manager *acmeManager) serveHTTPChallenge(w ResponseWriter, req *Request) {
+	manager.mu.Lock()
+	keyAuth, ok := manager.tokens[req.Param("token")]
+	manager.mu.Unlock()
+	if !ok {
+		sendStatus(w, HTTP_NOT_FOUND)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Length", fmt.Sprint(len(keyAuth)))
+	w.Write([]byte(keyAuth))
+}
+
+// httpChallengeHandler serves http-01 challenges in front of next, the
+// server's middleware and routes or the handler of a listener such as
+// the HTTPS redirect
+func (manager *acmeManager) httpChallengeHandler(next Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		token, ok := strings.CutPrefix(req.Path, acmeChallengePath)
+		if !ok || req.Method != "GET" || strings.Contains(token, "/") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		req.params = []routeParam{{"token", token}}
+		manager.serveHTTPChallenge(w, req)
+	})
+}
+
+// getCertificate serves tls-alpn-01 challenge handshakes and the managed
+// certificates, obtaining one first when it is missing. Other names go to next.
+func (manager *acmeManager) getCertificate(next func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+		if slices.Contains(hello.SupportedProtos, acmeTLSALPNProto) {
+			manager.mu.Lock()
+			cert := manager.alpnCerts[name]
+			manager.mu.Unlock()
+			if cert == nil {
+				return nil, fmt.Errorf("acme: no tls-alpn-01 challenge for %q", name)
+			}
+			return cert, nil
+		}
+
+		if !slices.Contains(manager.config.Domains, name) {
+			if next != nil {
+				return next(hello)
+			}
+			return nil, nil
+		}
+		if cert := manager.cached(name); cert != nil {
+			return cert, nil
+		}
+		ctx, cancel := context.WithTimeout(hello.Context(), acmeObtainTimeout)
+		defer cancel()
+		return manager.obtain(ctx, name)
+	}
+}
+
+// cached returns the certificate for domain while it hasn't expired
+func (manager *acmeManager) cached(domain string) *tls.Certificate {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	cert := manager.certs[domain]
+	if cert == nil || time.Now().After(cert.Leaf.NotAfter) {
+		return nil
+	}
+	return cert
+}
+
+// needsRenewal reports whether domain has no certificate or it expires soon
+func (manager *acmeManager) needsRenewal(domain string) bool {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	cert := manager.certs[domain]
+	return cert == nil || time.Until(cert.Leaf.NotAfter) < manager.config.RenewBefore
+}
+
+// renewLoop obtains missing and expiring certificates right away and then
+// every acmeRenewCheckInterval until done is closed
+func (manager *acmeManager) renewLoop(done chan struct{}) {
+	stopped, stop := context.WithCancel(context.Background())
+	defer stop()
+	go func() {
+		<-done
+		stop()
+	}()
+
+	ticker := time.NewTicker(acmeRenewCheckInterval)
+	defer ticker.Stop()
+	for {
+		for _, domain := range manager.config.Domains {
+			if !manager.needsRenewal(domain) {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(stopped, acmeObtainTimeout)
+			if _, err := manager.obtain(ctx, domain); err != nil {
+				fmt.Printf("Failed to obtain certificate for %s: %s\n", domain, err)
+			}
+			cancel()
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// obtain orders a certificate for domain. Concurrent calls for the same
+// domain wait for the running order instead of starting another one.
+func (manager *acmeManager) obtain(ctx context.Context, domain string) (*tls.Certificate, error) {
+	manager.mu.Lock()
+	if wait, ok := manager.obtaining[domain]; ok {
+		manager.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if cert := manager.cached(domain); cert != nil {
+			return cert, nil
+		}
+		return nil, fmt.Errorf("acme: no certificate for %s", domain)
+	}
+	done := make(chan struct{})
+	manager.obtaining[domain] = done
+	manager.mu.Unlock()
+
+	defer func() {
+		manager.mu.Lock()
+		delete(manager.obtaining, domain)
+		manager.mu.Unlock()
+		close(done)
+	}()
+
+	cert, err := manager.order(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+	manager.mu.Lock()
+	manager.certs[domain] = cert
+	manager.mu.Unlock()
+	manager.storeCert(domain, cert)
+	if manager.debug {
+		fmt.Println("Obtained certificate for", domain)
+	}
+	return cert, nil
+}
+
+// order runs the ACME order for domain with a new certificate key
+func (manager *acmeManager) order(ctx context.Context, domain string) (*tls.Certificate, error) {
+	manager.orderMu.Lock()
+	defer manager.orderMu.Unlock()
+
+	if manager.client == nil {
+		key, err := manager.accountKey()
+		if err != nil {
+			return nil, err
+		}
+		client := &acmeClient{httpClient: manager.config.HTTPClient, directoryURL: manager.config.DirectoryURL, key: key}
+		if err := client.discover(ctx); err != nil {
+			return nil, err
+		}
+		if err := client.register(ctx, manager.config.Email); err != nil {
+			return nil, err
+		}
+		manager.client = client
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := manager.client.obtain(ctx, domain, manager.config.Challenge, certKey, func(token string, keyAuth string) (func(), error) {
+		return manager.present(domain, token, keyAuth)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: chain, PrivateKey: certKey, Leaf: leaf}, nil
+}
+
+// present publishes the response to a challenge until the returned function is called
+func (manager *acmeManager) present(domain string, token string, keyAuth string) (func(), error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if manager.config.Challenge == acmeHTTPChallenge {
+		manager.tokens[token] = keyAuth
+		return func() {
+			manager.mu.Lock()
+			delete(manager.tokens, token)
+			manager.mu.Unlock()
+		}, nil
+	}
+
+	cert, err := tlsALPNCert(domain, keyAuth)
+	if err != nil {
+		return nil, err
+	}
+	manager.alpnCerts[domain] = cert
+	return func() {
+		manager.mu.Lock()
+		delete(manager.alpnCerts, domain)
+		manager.mu.Unlock()
+	}, nil
+}
+
+// tlsALPNCert creates the self-signed tls-alpn-01 certificate for domain
+// carrying the SHA-256 digest of the key authorization
+func tlsALPNCert(domain string, keyAuth string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(keyAuth))
+	value, err := asn1.Marshal(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: domain},
+		DNSNames:        []string{domain},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(24 * time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: idPeAcmeIdentifier, Critical: true, Value: value}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// accountKey loads the account key from the cache or creates one
+func (manager *acmeManager) accountKey() (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(manager.config.CacheDir, acmeAccountKeyFile)
+	if manager.config.CacheDir != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			block, _ := pem.Decode(data)
+			if block == nil {
+				return nil, fmt.Errorf("acme: no key in %s", path)
+			}
+			return x509.ParseECPrivateKey(block.Bytes)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if manager.config.CacheDir != "" {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// loadCache reads the cached certificates of the configured domains,
+// files that can't be used are ignored and obtained again
+func (manager *acmeManager) loadCache() {
+	if manager.config.CacheDir == "" {
+		return
+	}
+	for _, domain := range manager.config.Domains {
+		data, err := os.ReadFile(filepath.Join(manager.config.CacheDir, domain+".pem"))
+		if err != nil {
+			continue
+		}
+		cert, err := tls.X509KeyPair(data, data)
+		if err != nil {
+			fmt.Printf("Ignoring cached certificate for %s: %s\n", domain, err)
+			continue
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			continue
+		}
+		manager.certs[domain] = &cert
+	}
+}
+
+// storeCert writes the chain and key of domain to one PEM file in the cache
+func (manager *acmeManager) storeCert(domain string, cert *tls.Certificate) {
+	if manager.config.CacheDir == "" {
+		return
+	}
+	var data []byte
+	for _, der := range cert.Certificate {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return
+	}
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})...)
+
+	// Written next to the old file and renamed so a crash never leaves half a certificate
+	path := filepath.Join(manager.config.CacheDir, domain+".pem")
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		fmt.Printf("Failed to cache certificate for %s: %s\n", domain, err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		fmt.Printf("Failed to cache certificate for %s: %s\n", domain, err)
+	}
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acmeStandIn is a small ACME CA in the spirit of Pebble. It checks the
+// JWS signatures and nonces of every request and validates challenges
+// against the address returned by validationAddr.
+type acmeStandIn struct {
+	t              *testing.T
+	server         *httptest.Server
+	ca             *testCA
+	validationAddr func(challengeType string) string
+
+	mu sync.Mutex
+	// rejectNonce answers the next signed request with badNonce
+	rejectNonce bool
+	nonces      map[string]bool
+	accounts    map[string]string // kid to key thumbprint
+	keys        map[string]*ecdsa.PublicKey
+	orders      map[string]*standInOrder
+	next        int
+	issued      int
+}
+
+type standInOrder struct {
+	domain     string
+	status     string
+	authzValid bool
+	token      string
+	account    string
+	cert       []byte
+}
+
+func newACMEStandIn(t *testing.T, validationAddr func(challengeType string) string) *acmeStandIn {
+	standIn := &acmeStandIn{
+		t:              t,
+		ca:             newTestCA(t, t.TempDir(), "standin-ca"),
+		validationAddr: validationAddr,
+		rejectNonce:    true,
+		nonces:         make(map[string]bool),
+		accounts:       make(map[string]string),
+		keys:           make(map[string]*ecdsa.PublicKey),
+		orders:         make(map[string]*standInOrder),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /dir", func(w http.ResponseWriter, r *http.Request) {
+		base := standIn.server.URL
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   base + "/nonce",
+			"newAccount": base + "/account",
+			"newOrder":   base + "/order",
+		})
+	})
+	mux.HandleFunc("HEAD /nonce", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", standIn.newNonce())
+	})
+	mux.HandleFunc("POST /account", standIn.handleAccount)
+	mux.HandleFunc("POST /order", standIn.handleNewOrder)
+	mux.HandleFunc("POST /order/{id}", standIn.handleOrder)
+	mux.HandleFunc("POST /authz/{id}", standIn.handleAuthz)
+	mux.HandleFunc("POST /chal/{id}/{type}", standIn.handleChallenge)
+	mux.HandleFunc("POST /finalize/{id}", standIn.handleFinalize)
+	mux.HandleFunc("POST /cert/{id}", standIn.handleCert)
+	standIn.server = httptest.NewTLSServer(mux)
+	t.Cleanup(standIn.server.Close)
+	return standIn
+}
+
+func (standIn *acmeStandIn) config(domains ...string) ACMEConfig {
+	return ACMEConfig{
+		DirectoryURL: standIn.server.URL + "/dir",
+		Email:        "admin@a.test",
+		Domains:      domains,
+		HTTPClient:   standIn.server.Client(),
+	}
+}
+
+func (standIn *acmeStandIn) issuedCount() int {
+	standIn.mu.Lock()
+	defer standIn.mu.Unlock()
+	return standIn.issued
+}
+
+func (standIn *acmeStandIn) newNonce() string {
+	standIn.mu.Lock()
+	defer standIn.mu.Unlock()
+	standIn.next++
+	nonce := fmt.Sprintf("nonce-%d", standIn.next)
+	standIn.nonces[nonce] = true
+	return nonce
+}
+
+func (standIn *acmeStandIn) problem(w http.ResponseWriter, code int, problemType string, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"type": "urn:ietf:params:acme:error:" + problemType, "detail": detail})
+}
+
+// verify checks the JWS of r and returns its payload and the account URL,
+// or the key thumbprint and key for requests that carry their JWK
+func (standIn *acmeStandIn) verify(w http.ResponseWriter, r *http.Request) ([]byte, string, *ecdsa.PublicKey, bool) {
+	w.Header().Set("Replay-Nonce", standIn.newNonce())
+
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		standIn.t.Errorf(`Stand-in got malformed JWS %s`, err)
+		standIn.problem(w, 400, "malformed", err.Error())
+		return nil, "", nil, false
+	}
+	headerJSON, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var header struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  *struct{ Crv, Kty, X, Y string }
+	}
+	json.Unmarshal(headerJSON, &header)
+
+	standIn.mu.Lock()
+	validNonce := standIn.nonces[header.Nonce] && !standIn.rejectNonce
+	delete(standIn.nonces, header.Nonce)
+	standIn.rejectNonce = false
+	standIn.mu.Unlock()
+	if !validNonce {
+		standIn.problem(w, 400, "badNonce", "nonce "+header.Nonce)
+		return nil, "", nil, false
+	}
+	if header.Alg != "ES256" || header.URL != standIn.server.URL+r.URL.Path {
+		standIn.t.Errorf(`Stand-in got wrong JWS header %s`, headerJSON)
+		standIn.problem(w, 400, "malformed", "header")
+		return nil, "", nil, false
+	}
+
+	var key *ecdsa.PublicKey
+	account := header.Kid
+	if header.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(header.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(header.JWK.Y)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		jwk := fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`, header.JWK.X, header.JWK.Y)
+		digest := sha256.Sum256([]byte(jwk))
+		account = base64.RawURLEncoding.EncodeToString(digest[:])
+	} else {
+		standIn.mu.Lock()
+		key = standIn.keys[header.Kid]
+		standIn.mu.Unlock()
+	}
+	if key == nil {
+		standIn.t.Errorf(`Stand-in got JWS for unknown account %s`, header.Kid)
+		standIn.problem(w, 401, "accountDoesNotExist", header.Kid)
+		return nil, "", nil, false
+	}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if len(signature) != 64 || !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		standIn.t.Errorf(`Stand-in got a bad JWS signature`)
+		standIn.problem(w, 401, "unauthorized", "signature")
+		return nil, "", nil, false
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+	return payload, account, key, true
+}
+
+func (standIn *acmeStandIn) handleAccount(w http.ResponseWriter, r *http.Request) {
+	payload, thumbprint, key, ok := standIn.verify(w, r)
+	if !ok {
+		return
+	}
+	var account struct {
+		TermsOfServiceAgreed bool
+		Contact              []string
+	}
+	json.Unmarshal(payload, &account)
+	if !account.TermsOfServiceAgreed {
+		standIn.problem(w, 403, "userActionRequired", "terms of service")
+		return
+	}
+
+	kid := standIn.server.URL + "/acct/" + thumbprint[:8]
+	standIn.mu.Lock()
+	standIn.accounts[kid] = thumbprint
+	standIn.keys[kid] = key
+	standIn.mu.Unlock()
+	w.Header().Set("Location", kid)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+}
+
+func (standIn *acmeStandIn) orderJSON(id string, order *standInOrder) map[string]any {
+	base := standIn.server.URL
+	result := map[string]any{
+		"status":         order.status,
+		"identifiers":    []map[string]string{{"type": "dns", "value": order.domain}},
+		"authorizations": []string{base + "/authz/" + id},
+		"finalize":       base + "/finalize/" + id,
+	}
+	if order.cert != nil {
+		result["certificate"] = base + "/cert/" + id
+	}
+	return result
+}
+
+// order looks up the order of the id path value owned by account
+func (standIn *acmeStandIn) order(w http.ResponseWriter, r *http.Request, account string) (string, *standInOrder) {
+	id := r.PathValue("id")
+	standIn.mu.Lock()
+	order := standIn.orders[id]
+	standIn.mu.Unlock()
+	if order == nil || order.account != account {
+		standIn.problem(w, 404, "malformed", "no order "+id)
+		return "", nil
+	}
+	return id, order
+}
+
+func (standIn *acmeStandIn) handleNewOrder(w http.ResponseWriter, r *http.Request) {
+	payload, account, _, ok := standIn.verify(w, r)
+	if !ok {
+		return
+	}
+	var request struct {
+		Identifiers []struct{ Type, Value string }
+	}
+	json.Unmarshal(payload, &request)
+	if len(request.Identifiers) != 1 || request.Identifiers[0].Type != "dns" {
+		standIn.problem(w, 400, "rejectedIdentifier", string(payload))
+		return
+	}
+
+	standIn.mu.Lock()
+	standIn.next++
+	id := fmt.Sprint(standIn.next)
+	order := &standInOrder{domain: request.Identifiers[0].Value, status: "pending", token: "token-" + id, account: account}
+	standIn.orders[id] = order
+	standIn.mu.Unlock()
+
+	w.Header().Set("Location", standIn.server.URL+"/order/"+id)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(standIn.orderJSON(id, order))
+}
+
+func (standIn *acmeStandIn) handleOrder(w http.ResponseWriter, r *http.Request) {
+	_, account, _, ok := standIn.verify(w, r)
+	if !ok {
+		return
+	}
+	if id, order := standIn.order(w, r, account); order != nil {
+		standIn.mu.Lock()
+		defer standIn.mu.Unlock()
+		json.NewEncoder(w).Encode(standIn.orderJSON(id, order))
+	}
+}
+
+func (standIn *acmeStandIn) handleAuthz(w http.ResponseWriter, r *http.Request) {
+	_, account, _, ok := standIn.verify(w, r)
+	if !ok {
+		return
+	}
+	id, order := standIn.order(w, r, account)
+	if order == nil {
+		return
+	}
+	standIn.mu.Lock()
+	defer standIn.mu.Unlock()
+	status := "pending"
+	if order.authzValid {
+		status = "valid"
+	}
+	var challenges []map[string]string
+	for _, challengeType := range []string{"http-01", "tls-alpn-01"} {
+		challenges = append(challenges, map[string]string{
+			"type":   challengeType,
+			"url":    standIn.server.URL + "/chal/" + id + "/" + challengeType,
+			"token":  order.token,
+			"status": status,
+		})
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":     status,
+		"identifier": map[string]string{"type": "dns", "value": order.domain},
+		"challenges": challenges,
+	})
+}
+
+// handleChallenge validates the challenge right away, so the next poll
+// of the authorization sees the result
+func (standIn *acmeStandIn) handleChallenge(w http.ResponseWriter, r *http.Request) {
+	_, account, _, ok := standIn.verify(w, r)
+	if !ok {
+		return
+	}
+	_, order := standIn.order(w, r, account)
+	if order == nil {
+		return
+	}
+	standIn.mu.Lock()
+	keyAuth := order.token + "." + standIn.accounts[account]
+	standIn.mu.Unlock()
+
+	challengeType := r.PathValue("type")
+	var err error
+	switch challengeType {
+	case "http-01":
+		err = standIn.validateHTTP(order.domain, order.token, keyAuth)
+	case "tls-alpn-01":
+		err = standIn.validateTLSALPN(order.domain, keyAuth)
+	}
+	if err != nil {
+		standIn.t.Errorf(`Stand-in failed to validate %s for %s: %s`, challengeType, order.domain, err)
+		standIn.problem(w, 403, "unauthorized", err.Error())
+		return
+	}
+
+	standIn.mu.Lock()
+	order.authzValid = true
+	order.status = "ready"
+	standIn.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]string{"type": challengeType, "status": "valid", "token": order.token})
+}
+
+func (standIn *acmeStandIn) validateHTTP(domain string, token string, keyAuth string) error {
+	req, _ := http.NewRequest("GET", "http://"+standIn.validationAddr("http-01")+acmeChallengePath+token, nil)
+	req.Host = domain
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	content, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(content) != keyAuth {
+		return fmt.Errorf("got %d %q", res.StatusCode, content)
+	}
+	return nil
+}
+
+func (standIn *acmeStandIn) validateTLSALPN(domain string, keyAuth string) error {
+	conn, err := tls.Dial("tcp", standIn.validationAddr("tls-alpn-01"), &tls.Config{
+		ServerName:         domain,
+		NextProtos:         []string{acmeTLSALPNProto},
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != acmeTLSALPNProto {
+		return fmt.Errorf("negotiated %q", state.NegotiatedProtocol)
+	}
+	digest := sha256.Sum256([]byte(keyAuth))
+	for _, extension := range state.PeerCertificates[0].Extensions {
+		var value []byte
+		if extension.Id.Equal(idPeAcmeIdentifier) && extension.Critical {
+			if _, err := asn1.Unmarshal(extension.Value, &value); err == nil && string(value) == string(digest[:]) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no matching acmeIdentifier extension")
+}
+
+func (standIn *acmeStandIn) handleFinalize(w http.ResponseWriter, r *http.Request) {
+	payload, account, _, ok := standIn.verify(w, r)
+	if !ok {
+		return
+	}
+	id, order := standIn.order(w, r, account)
+	if order == nil {
+		return
+	}
+	var request struct{ CSR string }
+	json.Unmarshal(payload, &request)
+	der, _ := base64.RawURLEncoding.DecodeString(request.CSR)
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil || csr.CheckSignature() != nil || len(csr.DNSNames) != 1 || csr.DNSNames[0] != order.domain {
+		standIn.t.Errorf(`Stand-in got a bad CSR %v`, err)
+		standIn.problem(w, 400, "badCSR", "csr")
+		return
+	}
+
+	standIn.mu.Lock()
+	defer standIn.mu.Unlock()
+	if !order.authzValid {
+		standIn.problem(w, 403, "orderNotReady", "not authorized")
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: order.domain},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, standIn.ca.cert, csr.PublicKey, standIn.ca.key)
+	if err != nil {
+		standIn.t.Errorf(`Stand-in failed to issue %s`, err)
+		return
+	}
+	order.cert = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: standIn.ca.cert.Raw})...)
+	order.status = "valid"
+	standIn.issued++
+	json.NewEncoder(w).Encode(standIn.orderJSON(id, order))
+}
+
+func (standIn *acmeStandIn) handleCert(w http.ResponseWriter, r *http.Request) {
+	_, account, _, ok := standIn.verify(w, r)
+	if !ok {
+		return
+	}
+	if _, order := standIn.order(w, r, account); order != nil {
+		standIn.mu.Lock()
+		defer standIn.mu.Unlock()
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(order.cert)
+	}
+}
+
+// dialACMEServer connects with SNI domain and checks the certificate against the stand-in CA
+func dialACMEServer(t *testing.T, standIn *acmeStandIn, addr string, domain string) *x509.Certificate {
+	pool := x509.NewCertPool()
+	pool.AddCert(standIn.ca.cert)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: domain, RootCAs: pool})
+	if err != nil {
+		t.Fatalf(`Failed TLS handshake for %s %s`, domain, err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestACMEHTTPChallenge(t *testing.T) {
+	cacheDir := t.TempDir()
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	standIn := newACMEStandIn(t, func(string) string {
+		return server.Addrs()[1].String()
+	})
+
+	config := standIn.config("a.test")
+	config.CacheDir = cacheDir
+	if err := server.EnableACME(config); err != nil {
+		t.Fatalf(`Failed to enable ACME %s`, err)
+	}
+	server.SetListenAddrs("127.0.0.1:0")
+	server.SetHTTPRedirect("127.0.0.1:0")
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	if cert := dialACMEServer(t, standIn, addr, "a.test"); cert.Subject.CommonName != "a.test" {
+		t.Fatalf(`Wrong certificate got: %s`, cert.Subject.CommonName)
+	}
+	if issued := standIn.issuedCount(); issued != 1 {
+		t.Fatalf(`Expected a single certificate to be issued got: %d`, issued)
+	}
+	for _, name := range []string{"a.test.pem", acmeAccountKeyFile} {
+		if _, err := os.Stat(filepath.Join(cacheDir, name)); err != nil {
+			t.Fatalf(`Expected %s in the cache %s`, name, err)
+		}
+	}
+
+	redirectAddr := server.Addrs()[1].String()
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", acmeChallengePath+"unknown")
+	rt += fmt.Sprintf("Host: %v\r\n", "a.test")
+	rt += fmt.Sprintf("\r\n")
+	if res, _ := sendRequestTo(t, redirectAddr, rt); res.StatusCode != HTTP_NOT_FOUND {
+		t.Fatalf(`Expected unknown token to be 404 got: %d`, res.StatusCode)
+	}
+	rt = fmt.Sprintf("GET %v HTTP/1.1\r\n", "/")
+	rt += fmt.Sprintf("Host: %v\r\n", "a.test")
+	rt += fmt.Sprintf("\r\n")
+	if res, _ := sendRequestTo(t, redirectAddr, rt); res.StatusCode != HTTP_PERMANENT_REDIRECT {
+		t.Fatalf(`Expected other paths to redirect got: %d`, res.StatusCode)
+	}
+}
+
+func TestACMETLSALPNChallenge(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	standIn := newACMEStandIn(t, func(string) string {
+		return server.Addrs()[0].String()
+	})
+
+	config := standIn.config("a.test", "b.test")
+	config.Challenge = acmeTLSALPNChallenge
+	if err := server.EnableACME(config); err != nil {
+		t.Fatalf(`Failed to enable ACME %s`, err)
+	}
+	server.SetListenAddrs("127.0.0.1:0")
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	for _, domain := range []string{"a.test", "b.test"} {
+		if cert := dialACMEServer(t, standIn, addr, domain); cert.Subject.CommonName != domain {
+			t.Fatalf(`Wrong certificate for %s got: %s`, domain, cert.Subject.CommonName)
+		}
+	}
+	if _, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "c.test", InsecureSkipVerify: true}); err == nil {
+		t.Fatalf(`Expected handshake for an unmanaged name to fail`)
+	}
+}
+
+func TestACMEUsesCachedCertificate(t *testing.T) {
+	cacheDir := t.TempDir()
+	var addrs func() string
+	standIn := newACMEStandIn(t, func(string) string {
+		return addrs()
+	})
+
+	for i := range 2 {
+		server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+		addrs = func() string { return server.Addrs()[0].String() }
+		config := standIn.config("a.test")
+		config.CacheDir = cacheDir
+		config.Challenge = acmeTLSALPNChallenge
+		if err := server.EnableACME(config); err != nil {
+			t.Fatalf(`Failed to enable ACME %s`, err)
+		}
+		server.SetListenAddrs("127.0.0.1:0")
+		runServer(t, &server)
+		dialACMEServer(t, standIn, server.Addrs()[0].String(), "a.test")
+		cleanup()
+
+		if issued := standIn.issuedCount(); issued != 1 {
+			t.Fatalf(`Run %d: expected the cached certificate to be reused got %d issued`, i, issued)
+		}
+	}
+}
+
+func TestACMERenewsExpiringCertificate(t *testing.T) {
+	cacheDir := t.TempDir()
+	// A cached certificate expiring within the hour
+	certFile, keyFile := writeTestCertificate(t, t.TempDir(), "a.test")
+	certPEM, _ := os.ReadFile(certFile)
+	keyPEM, _ := os.ReadFile(keyFile)
+	os.WriteFile(filepath.Join(cacheDir, "a.test.pem"), append(certPEM, keyPEM...), 0600)
+
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	standIn := newACMEStandIn(t, func(string) string {
+		return server.Addrs()[0].String()
+	})
+	config := standIn.config("a.test")
+	config.CacheDir = cacheDir
+	config.Challenge = acmeTLSALPNChallenge
+	if err := server.EnableACME(config); err != nil {
+		t.Fatalf(`Failed to enable ACME %s`, err)
+	}
+	server.SetListenAddrs("127.0.0.1:0")
+	runServer(t, &server)
+
+	// The old certificate stays in service until the new one arrives
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := tls.Dial("tcp", server.Addrs()[0].String(), &tls.Config{ServerName: "a.test", InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf(`Failed TLS handshake %s`, err)
+		}
+		issuer := conn.ConnectionState().PeerCertificates[0].Issuer.CommonName
+		conn.Close()
+		if issuer == "standin-ca" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf(`Expiring certificate was not renewed`)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dialACMEServer(t, standIn, server.Addrs()[0].String(), "a.test")
+}
+
+func TestEnableACMEValidatesConfig(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	for _, config := range []ACMEConfig{
+		{Domains: []string{"a.test"}},
+		{DirectoryURL: "https://ca.test/dir"},
+		{DirectoryURL: "https://ca.test/dir", Domains: []string{"../a.test"}},
+		{DirectoryURL: "https://ca.test/dir", Domains: []string{"a.test"}, Challenge: "dns-01"},
+	} {
+		if err := server.EnableACME(config); err == nil {
+			t.Fatalf(`Expected config %+v to be rejected`, config)
+		}
+	}
+}
+
+func TestACMEHTTPChallengeBypassesMiddleware(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	domains := []string{"A.test"}
+	if err := server.EnableACME(ACMEConfig{DirectoryURL: "https://ca.test/dir", Domains: domains}); err != nil {
+		t.Fatalf(`Failed to enable ACME %s`, err)
+	}
+	if domains[0] != "A.test" {
+		t.Fatalf(`EnableACME changed the caller's domains to %v`, domains)
+	}
+	server.acme.tokens["token"] = "token.thumbprint"
+	// Middleware refusing everything must not block the CA
+	server.Use(func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *Request) {
+			sendStatus(w, HTTP_FORBIDDEN)
+		})
+	})
+
+	recorder := httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "http://a.test"+acmeChallengePath+"token", nil))
+	if recorder.Code != HTTP_OK || recorder.Body.String() != "token.thumbprint" {
+		t.Fatalf(`Wrong challenge response got: %d %q`, recorder.Code, recorder.Body.String())
+	}
+	recorder = httptest.NewRecorder()
+	server.HTTPHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "http://a.test/", nil))
+	if recorder.Code != HTTP_FORBIDDEN {
+		t.Fatalf(`Expected other paths to go through the middleware got: %d`, recorder.Code)
+	}
+}
+
+func TestACMEHTTPChallengeNeedsPlainListener(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	if err := server.EnableACME(ACMEConfig{DirectoryURL: "https://ca.test/dir", Domains: []string{"a.test"}}); err != nil {
+		t.Fatalf(`Failed to enable ACME %s`, err)
+	}
+	server.SetListenAddrs("127.0.0.1:0")
+	// Without SetHTTPRedirect the CA could never reach the http-01 challenge
+	if err := server.Listen(); err == nil || !strings.Contains(err.Error(), "SetHTTPRedirect") {
+		t.Fatalf(`Expected Listen to fail without a plain HTTP listener got: %v`, err)
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// acmeClient speaks the ACME protocol of RFC 8555 to a CA directory.
+// Requests are JWS signed with the ES256 account key and carry a fresh
+// nonce from the previous response.
+type acmeClient struct {
+	httpClient   *http.Client
+	directoryURL string
+	key          *ecdsa.PrivateKey
+	directory    acmeDirectory
+	// kid is the account URL, empty until the account is registered
+	kid   string
+	nonce string
+}
+
+type acmeDirectory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type acmeOrder struct {
+	Status         string       `json:"status"`
+	Authorizations []string     `json:"authorizations"`
+	Finalize       string       `json:"finalize"`
+	Certificate    string       `json:"certificate"`
+	Error          *acmeProblem `json:"error"`
+}
+
+type acmeAuthorization struct {
+	Status     string `json:"status"`
+	Identifier struct {
+		Value string `json:"value"`
+	} `json:"identifier"`
+	Challenges []acmeChallenge `json:"challenges"`
+}
+
+type acmeChallenge struct {
+	Type   string       `json:"type"`
+	URL    string       `json:"url"`
+	Token  string       `json:"token"`
+	Status string       `json:"status"`
+	Error  *acmeProblem `json:"error"`
+}
+
+// acmeProblem is the problem document CAs answer errors with
+type acmeProblem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+}
+
+func (problem *acmeProblem) Error() string {
+	return fmt.Sprintf("acme: %s %s", problem.Type, problem.Detail)
+}
+
+const acmeBadNonce = "urn:ietf:params:acme:error:badNonce"
+
+// discover fetches the directory naming the CA endpoints
+func (client *acmeClient) discover(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", client.directoryURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("acme: directory returned %s", res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(&client.directory)
+}
+
+// register creates the account for the key or finds the existing one
+func (client *acmeClient) register(ctx context.Context, email string) error {
+	account := map[string]any{"termsOfServiceAgreed": true}
+	if email != "" {
+		account["contact"] = []string{"mailto:" + email}
+	}
+	res, _, err := client.post(ctx, client.directory.NewAccount, account)
+	if err != nil {
+		return err
+	}
+	client.kid = res.Header.Get("Location")
+	if client.kid == "" {
+		return errors.New("acme: account response without Location")
+	}
+	return nil
+}
+
+// obtain orders a certificate for domain signed for certKey. present
+// publishes the challenge response of the chosen type and returns a
+// function removing it again.
+func (client *acmeClient) obtain(ctx context.Context, domain string, challengeType string, certKey crypto.Signer, present func(token string, keyAuth string) (func(), error)) ([][]byte, error) {
+	request := map[string]any{"identifiers": []map[string]string{{"type": "dns", "value": domain}}}
+	res, body, err := client.post(ctx, client.directory.NewOrder, request)
+	if err != nil {
+		return nil, err
+	}
+	orderURL := res.Header.Get("Location")
+	var order acmeOrder
+	if err := json.Unmarshal(body, &order); err != nil {
+		return nil, err
+	}
+
+	for _, authzURL := range order.Authorizations {
+		if err := client.authorize(ctx, authzURL, challengeType, present); err != nil {
+			return nil, err
+		}
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, certKey)
+	if err != nil {
+		return nil, err
+	}
+	if res, body, err = client.post(ctx, order.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)}); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, &order); err != nil {
+		return nil, err
+	}
+	for order.Status != "valid" {
+		if order.Status == "invalid" {
+			return nil, fmt.Errorf("acme: order for %s became invalid: %v", domain, order.Error)
+		}
+		if err := sleepContext(ctx, pollDelay(res)); err != nil {
+			return nil, err
+		}
+		if res, body, err = client.post(ctx, orderURL, nil); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(body, &order); err != nil {
+			return nil, err
+		}
+	}
+
+	_, body, err = client.post(ctx, order.Certificate, nil)
+	if err != nil {
+		return nil, err
+	}
+	var chain [][]byte
+	for block, rest := pem.Decode(body); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("acme: no certificate in the response")
+	}
+	return chain, nil
+}
+
+// authorize answers the challenge of challengeType for one authorization
+// and waits until the CA validated it
+func (client *acmeClient) authorize(ctx context.Context, authzURL string, challengeType string, present func(token string, keyAuth string) (func(), error)) error {
+	var authz acmeAuthorization
+	_, body, err := client.post(ctx, authzURL, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	var challenge *acmeChallenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == challengeType {
+			challenge = &authz.Challenges[i]
+		}
+	}
+	if challenge == nil {
+		return fmt.Errorf("acme: no %s challenge offered for %s", challengeType, authz.Identifier.Value)
+	}
+
+	cleanup, err := present(challenge.Token, challenge.Token+"."+client.thumbprint())
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if _, _, err := client.post(ctx, challenge.URL, map[string]any{}); err != nil {
+		return err
+	}
+	for {
+		res, body, err := client.post(ctx, authzURL, nil)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(body, &authz); err != nil {
+			return err
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+		default:
+			for _, challenge := range authz.Challenges {
+				if challenge.Error != nil {
+					return challenge.Error
+				}
+			}
+			return fmt.Errorf("acme: authorization for %s is %s", authz.Identifier.Value, authz.Status)
+		}
+		if err := sleepContext(ctx, pollDelay(res)); err != nil {
+			return err
+		}
+	}
+}
+
+// post sends a JWS signed request with payload, a nil payload makes it a
+// POST-as-GET. A rejected nonce is retried once with the fresh one.
+func (client *acmeClient) post(ctx context.Context, url string, payload any) (*http.Response, []byte, error) {
+	var encoded []byte
+	if payload != nil {
+		var err error
+		if encoded, err = json.Marshal(payload); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		res, body, err := client.send(ctx, url, encoded)
+		if err == nil {
+			return res, body, nil
+		}
+		var problem *acmeProblem
+		if attempt > 0 || !errors.As(err, &problem) || problem.Type != acmeBadNonce {
+			return nil, nil, err
+		}
+	}
+}
+
+func (client *acmeClient) send(ctx context.Context, url string, payload []byte) (*http.Response, []byte, error) {
+	nonce, err := client.takeNonce(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	jws, err := client.sign(url, nonce, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(jws))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	res, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	client.nonce = res.Header.Get("Replay-Nonce")
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.StatusCode >= 400 {
+		problem := &acmeProblem{}
+		if json.Unmarshal(body, problem) != nil || problem.Type == "" {
+			problem.Type, problem.Detail = "unknown", res.Status
+		}
+		return nil, nil, problem
+	}
+	return res, body, nil
+}
+
+// takeNonce returns the nonce of the last response or fetches a new one
+func (client *acmeClient) takeNonce(ctx context.Context) (string, error) {
+	if nonce := client.nonce; nonce != "" {
+		client.nonce = ""
+		return nonce, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "HEAD", client.directory.NewNonce, nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := client.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	nonce := res.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("acme: no nonce in the newNonce response")
+	}
+	return nonce, nil
+}
+
+// sign wraps payload in a flattened JWS. The account key goes in the
+// header until the account URL is known, after that its URL does.
+func (client *acmeClient) sign(url string, nonce string, payload []byte) ([]byte, error) {
+	protected := map[string]any{"alg": "ES256", "nonce": nonce, "url": url}
+	if client.kid == "" {
+		protected["jwk"] = json.RawMessage(client.jwk())
+	} else {
+		protected["kid"] = client.kid
+	}
+	header, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedHeader := base64.RawURLEncoding.EncodeToString(header)
+	encodedPayload := base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(encodedHeader + "." + encodedPayload))
+	r, s, err := ecdsa.Sign(rand.Reader, client.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": encodedHeader,
+		"payload":   encodedPayload,
+		"signature": base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+// jwk is the public account key with its members in the order RFC 7638
+// requires for the thumbprint
+func (client *acmeClient) jwk() string {
+	public, err := client.key.PublicKey.ECDH()
+	if err != nil {
+		panic(err)
+	}
+	point := public.Bytes()
+	return fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		base64.RawURLEncoding.EncodeToString(point[1:33]),
+		base64.RawURLEncoding.EncodeToString(point[33:]))
+}
+
+func (client *acmeClient) thumbprint() string {
+	digest := sha256.Sum256([]byte(client.jwk()))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// pollDelay is how long to wait before checking a pending object again,
+// the Retry-After seconds of res or one second
+func pollDelay(res *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(strings.TrimSpace(res.Header.Get("Retry-After")))
+	if err != nil || seconds <= 0 {
+		return time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
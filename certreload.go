@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certStore holds certificates that are reloaded from disk while the
+// server runs. Handshakes read the current certificate through an atomic
+// pointer, so a reload never blocks them and a failed one keeps the old
+// certificate in service.
+type certStore struct {
+	mu       sync.Mutex
+	certs    []*reloadableCert
+	interval time.Duration
+	reloads  atomic.Int64
+	failures atomic.Int64
+}
+
+type reloadableCert struct {
+	certFile, keyFile string
+	current           atomic.Pointer[tls.Certificate]
+	// certMod and keyMod are the modification times of the last load attempt
+	certMod, keyMod time.Time
+}
+
+// AddReloadableCertificate enables TLS with a certificate that is loaded
+// again whenever its files change on disk or ReloadCertificates is called.
+// SNI selection works as for AddCertificate.
+func (server *Server) AddReloadableCertificate(certFile string, keyFile string) error {
+	cert := &reloadableCert{certFile: certFile, keyFile: keyFile}
+	if err := cert.load(); err != nil {
+		return err
+	}
+	server.ensureTLSConfig()
+
+	server.certs.mu.Lock()
+	defer server.certs.mu.Unlock()
+	server.certs.certs = append(server.certs.certs, cert)
+	return nil
+}
+
+// SetCertificatePollInterval sets how often certificate files are checked
+// for changes, 0 turns polling off and leaves reloading to ReloadCertificates
+func (server *Server) SetCertificatePollInterval(interval time.Duration) {
+	server.certs.interval = interval
+}
+
+// ReloadCertificates loads every reloadable certificate again, as done
+// on SIGHUP. Certificates that fail to load keep serving the old version.
+func (server *Server) ReloadCertificates() error {
+	return server.certs.reload(true, server.debug)
+}
+
+// CertificateReloadStats returns how many certificate reloads succeeded and failed
+func (server *Server) CertificateReloadStats() (int64, int64) {
+	return server.certs.reloads.Load(), server.certs.failures.Load()
+}
+
+func (cert *reloadableCert) load() error {
+	certInfo, err := os.Stat(cert.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(cert.keyFile)
+	if err != nil {
+		return err
+	}
+	cert.certMod, cert.keyMod = certInfo.ModTime(), keyInfo.ModTime()
+
+	loaded, err := tls.LoadX509KeyPair(cert.certFile, cert.keyFile)
+	if err != nil {
+		return err
+	}
+	cert.current.Store(&loaded)
+	return nil
+}
+
+// changed reports whether either file was modified since the last load attempt
+func (cert *reloadableCert) changed() bool {
+	certInfo, certErr := os.Stat(cert.certFile)
+	keyInfo, keyErr := os.Stat(cert.keyFile)
+	if certErr != nil || keyErr != nil {
+		// Missing files are reported by the load attempt
+		return true
+	}
+	return !certInfo.ModTime().Equal(cert.certMod) || !keyInfo.ModTime().Equal(cert.keyMod)
+}
+
+// reload loads the certificates again, all of them when force is set and
+// otherwise only those whose files changed
+func (store *certStore) reload(force bool, debug bool) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var errs []error
+	for _, cert := range store.certs {
+		if !force && !cert.changed() {
+			continue
+		}
+		if err := cert.load(); err != nil {
+			store.failures.Add(1)
+			fmt.Printf("Failed to reload certificate %s, keeping the old one: %s\n", cert.certFile, err)
+			errs = append(errs, err)
+			continue
+		}
+		store.reloads.Add(1)
+		if debug {
+			fmt.Println("Reloaded certificate", cert.certFile)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// poll checks the certificate files every interval until done is closed
+func (store *certStore) poll(done chan struct{}, debug bool) {
+	if store.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(store.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			store.reload(false, debug)
+		}
+	}
+}
+
+func (store *certStore) isEmpty() bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return len(store.certs) == 0
+}
+
+// current returns the certificates in service
+func (store *certStore) current() []*tls.Certificate {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	certs := make([]*tls.Certificate, 0, len(store.certs))
+	for _, cert := range store.certs {
+		certs = append(certs, cert.current.Load())
+	}
+	return certs
+}
+
+// getCertificate picks the reloadable certificate supporting the client
+// hello. Without a match it returns nil so the static certificates are
+// tried, or the first reloadable one when fallback is set.
+func (store *certStore) getCertificate(fallback bool, next func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		store.mu.Lock()
+		certs := append([]*reloadableCert(nil), store.certs...)
+		store.mu.Unlock()
+
+		for _, cert := range certs {
+			current := cert.current.Load()
+			if hello.SupportsCertificate(current) == nil {
+				return current, nil
+			}
+		}
+		if next != nil {
+			if cert, err := next(hello); cert != nil || err != nil {
+				return cert, err
+			}
+		}
+		if fallback && len(certs) > 0 {
+			return certs[0].current.Load(), nil
+		}
+		return nil, nil
+	}
+}
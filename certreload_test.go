@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"os"
+	"testing"
+	"time"
+)
+
+// peerCommonName returns the common name of the certificate served to serverName
+func peerCommonName(t *testing.T, addr string, serverName string) string {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf(`Failed TLS handshake %s`, err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+// replaceCertificate moves the certificate files at src over dst and bumps their mtime
+func replaceCertificate(t *testing.T, src [2]string, dst [2]string) {
+	later := time.Now().Add(time.Minute)
+	for i := range dst {
+		if err := os.Rename(src[i], dst[i]); err != nil {
+			t.Fatalf(`Failed to replace certificate %s`, err)
+		}
+		os.Chtimes(dst[i], later, later)
+	}
+}
+
+func TestReloadCertificateOnChange(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "old.test")
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	server.SetCertificatePollInterval(10 * time.Millisecond)
+	if err := server.AddReloadableCertificate(certFile, keyFile); err != nil {
+		t.Fatalf(`Failed to add certificate %s`, err)
+	}
+	addr := runTLSServer(t, &server)
+
+	if name := peerCommonName(t, addr, "old.test"); name != "old.test" {
+		t.Fatalf(`Wrong initial certificate got: %s`, name)
+	}
+
+	newCert, newKey := writeTestCertificate(t, t.TempDir(), "new.test")
+	replaceCertificate(t, [2]string{newCert, newKey}, [2]string{certFile, keyFile})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for peerCommonName(t, addr, "new.test") != "new.test" {
+		if time.Now().After(deadline) {
+			t.Fatalf(`Certificate was not reloaded`)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reloads, failures := server.CertificateReloadStats(); reloads != 1 || failures != 0 {
+		t.Fatalf(`Wrong reload stats got: %d %d`, reloads, failures)
+	}
+}
+
+func TestFailedReloadKeepsCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "old.test")
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	server.SetCertificatePollInterval(0)
+	if err := server.AddReloadableCertificate(certFile, keyFile); err != nil {
+		t.Fatalf(`Failed to add certificate %s`, err)
+	}
+	addr := runTLSServer(t, &server)
+
+	// A certificate half way through rotation no longer matches its key
+	_, otherKey := writeTestCertificate(t, t.TempDir(), "other.test")
+	if err := os.Rename(otherKey, keyFile); err != nil {
+		t.Fatalf(`Failed to replace key %s`, err)
+	}
+	if err := server.ReloadCertificates(); err == nil {
+		t.Fatalf(`Expected mismatched key to fail reloading`)
+	}
+	if name := peerCommonName(t, addr, "old.test"); name != "old.test" {
+		t.Fatalf(`Expected old certificate to stay in service got: %s`, name)
+	}
+	if reloads, failures := server.CertificateReloadStats(); reloads != 0 || failures != 1 {
+		t.Fatalf(`Wrong reload stats got: %d %d`, reloads, failures)
+	}
+}
+
+func TestReloadableAndStaticCertificates(t *testing.T) {
+	dir := t.TempDir()
+	staticCert, staticKey := writeTestCertificate(t, dir, "static.test")
+	reloadCert, reloadKey := writeTestCertificate(t, dir, "reload.test")
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	if err := server.AddReloadableCertificate(reloadCert, reloadKey); err != nil {
+		t.Fatalf(`Failed to add certificate %s`, err)
+	}
+	addr := runTLSServer(t, &server, [2]string{staticCert, staticKey})
+
+	if name := peerCommonName(t, addr, "reload.test"); name != "reload.test" {
+		t.Fatalf(`Wrong certificate for reload.test got: %s`, name)
+	}
+	if name := peerCommonName(t, addr, "static.test"); name != "static.test" {
+		t.Fatalf(`Wrong certificate for static.test got: %s`, name)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+var (
+	errMalformedChunk = &requestError{HTTP_BAD_REQUEST, "malformed chunked encoding"}
+)
+
+// chunkedReader decodes a chunked request body, the trailer section
+// is merged into trailer once the last chunk has been read.
+type chunkedReader struct {
+	br        *bufio.Reader
+	limits    requestLimits
+	trailer   Header
+	remaining int64 // bytes left in the current chunk
+	total     int64
+	err       error
+}
+
+func newChunkedReader(br *bufio.Reader, limits requestLimits, trailer Header) *chunkedReader {
+	return &chunkedReader{br: br, limits: limits, trailer: trailer}
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+
+	if cr.remaining == 0 {
+		size, err := cr.readChunkSize()
+		if err != nil {
+			cr.err = err
+			return 0, err
+		}
+		if size == 0 {
+			cr.err = readHeader(cr.br, cr.trailer, cr.limits)
+			if cr.err == nil {
+				cr.err = io.EOF
+			}
+			return 0, cr.err
+		}
+		cr.total += size
+		if cr.total > cr.limits.maxBodyBytes {
+			cr.err = errBodyTooLarge
+			return 0, cr.err
+		}
+		cr.remaining = size
+	}
+
+	if int64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+	n, err := cr.br.Read(p)
+	cr.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && cr.remaining == 0 {
+		err = cr.readChunkEnd()
+	}
+	if err != nil {
+		cr.err = err
+	}
+	return n, err
+}
+
+// readChunkSize parses "size[;extensions]", extensions are ignored
+func (cr *chunkedReader) readChunkSize() (int64, error) {
+	line, _, err := readLine(cr.br, 4096, errMalformedChunk)
+	if err != nil {
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+
+	size := int64(0)
+	digits := 0
+	for _, c := range line {
+		var value byte
+		switch {
+		case c >= '0' && c <= '9':
+			value = c - '0'
+		case c >= 'a' && c <= 'f':
+			value = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			value = c - 'A' + 10
+		case c == ';' || c == ' ' || c == '\t':
+			if digits == 0 {
+				return 0, errMalformedChunk
+			}
+			return size, nil
+		default:
+			return 0, errMalformedChunk
+		}
+		digits++
+		if digits > 15 {
+			return 0, errMalformedChunk
+		}
+		size = size<<4 | int64(value)
+	}
+	if digits == 0 {
+		return 0, errMalformedChunk
+	}
+	return size, nil
+}
+
+// readChunkEnd consumes the CRLF following the chunk data
+func (cr *chunkedReader) readChunkEnd() error {
+	line, _, err := readLine(cr.br, 2, errMalformedChunk)
+	if err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if len(line) != 0 {
+		return errMalformedChunk
+	}
+	return nil
+}
+
+// chunkedWriter encodes everything written to it as chunks.
+// Close writes the last chunk and the optional trailer section.
+type chunkedWriter struct {
+	w io.Writer
+}
+
+func (cw *chunkedWriter) Write(p []byte) (int, error) {
+	// An empty chunk would terminate the body
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := fmt.Fprintf(cw.w, "%x\r\n", len(p)); err != nil {
+		return 0, err
+	}
+	n, err := cw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	_, err = io.WriteString(cw.w, "\r\n")
+	return n, err
+}
+
+func (cw *chunkedWriter) Close(trailer Header) error {
+	if _, err := io.WriteString(cw.w, "0\r\n"); err != nil {
+		return err
+	}
+	writeHeaderFields(cw.w, trailer)
+	_, err := io.WriteString(cw.w, "\r\n")
+	return err
+}
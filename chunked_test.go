@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestChunkedRequestBody(t *testing.T) {
+	raw := "POST /post HTTP/1.1\r\n"
+	raw += "Host: 127.0.0.1:1337\r\n"
+	raw += "Transfer-Encoding: chunked\r\n"
+	raw += "\r\n"
+	raw += "5;name=value\r\nhello\r\n"
+	raw += "6\r\n world\r\n"
+	raw += "0\r\n"
+	raw += "X-Checksum: abc\r\n"
+	raw += "\r\n"
+
+	req, err := parseRequestString(raw)
+	if err != nil {
+		t.Fatalf(`Failed to parse chunked request %s`, err)
+	}
+	if req.ContentLength != -1 {
+		t.Fatalf(`Expected unknown content length got: %d`, req.ContentLength)
+	}
+	content, err := io.ReadAll(req.Body)
+	if err != nil || string(content) != "hello world" {
+		t.Fatalf(`Wrong chunked body got: %q error: %v`, content, err)
+	}
+	if req.Trailer.Get("X-Checksum") != "abc" {
+		t.Fatalf(`Wrong trailer got: %q`, req.Trailer)
+	}
+}
+
+func TestMalformedChunkedBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks string
+		err    error
+	}{
+		{"bad size", "zz\r\nhello\r\n0\r\n\r\n", errMalformedChunk},
+		{"missing size", ";ext\r\nhello\r\n0\r\n\r\n", errMalformedChunk},
+		{"missing crlf", "5\r\nhelloX\r\n0\r\n\r\n", errMalformedChunk},
+		{"truncated", "5\r\nhel", io.ErrUnexpectedEOF},
+		{"too large", "ffffff\r\n", errBodyTooLarge},
+	}
+
+	for _, test := range tests {
+		raw := "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n" + test.chunks
+		req, err := parseRequestString(raw)
+		if err != nil {
+			t.Fatalf(`%s: failed to parse request %s`, test.name, err)
+		}
+		if _, err := io.ReadAll(req.Body); !errors.Is(err, test.err) {
+			t.Fatalf(`%s: expected %v got: %v`, test.name, test.err, err)
+		}
+	}
+}
+
+func TestRejectAmbiguousFraming(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		code int
+	}{
+		{"both lengths", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nContent-Length: 5\r\n\r\n", HTTP_BAD_REQUEST},
+		{"http 1.0", "POST / HTTP/1.0\r\nTransfer-Encoding: chunked\r\n\r\n", HTTP_BAD_REQUEST},
+		{"chunked not last", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked, gzip\r\n\r\n", HTTP_BAD_REQUEST},
+		{"chunked twice", "POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked\r\n\r\n", HTTP_BAD_REQUEST},
+		{"unknown coding", "POST / HTTP/1.1\r\nTransfer-Encoding: gzip, chunked\r\n\r\n", HTTP_NOT_IMPLEMENTED},
+	}
+
+	for _, test := range tests {
+		_, err := parseRequestString(test.raw)
+		var reqErr *requestError
+		if !errors.As(err, &reqErr) || reqErr.code != test.code {
+			t.Fatalf(`%s: expected code %d got: %v`, test.name, test.code, err)
+		}
+	}
+}
+
+func TestChunkedWriterRoundTrip(t *testing.T) {
+	var buff bytes.Buffer
+	writer := &chunkedWriter{w: &buff}
+	writer.Write([]byte("hello"))
+	writer.Write([]byte{})
+	writer.Write([]byte(" world"))
+	trailer := make(Header)
+	trailer.Set("X-Checksum", "abc")
+	writer.Close(trailer)
+
+	expected := "5\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abc\r\n\r\n"
+	if buff.String() != expected {
+		t.Fatalf(`Wrong chunked encoding got: %q expected: %q`, buff.String(), expected)
+	}
+
+	decodedTrailer := make(Header)
+	reader := newChunkedReader(bufio.NewReader(strings.NewReader(buff.String())), defaultRequestLimits(), decodedTrailer)
+	content, err := io.ReadAll(reader)
+	if err != nil || string(content) != "hello world" || decodedTrailer.Get("X-Checksum") != "abc" {
+		t.Fatalf(`Failed to decode own encoding got: %q error: %v`, content, err)
+	}
+}
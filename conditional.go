@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// etagCache remembers the entity tags of files without a modification
+// time, as hashing them again would read the whole file for every request
+// and their content, as in an embed.FS, doesn't change
+type etagCache struct {
+	mu   sync.Mutex
+	tags map[string]string
+}
+
+func newETagCache() *etagCache {
+	return &etagCache{tags: make(map[string]string)}
+}
+
+// fileETag returns a strong entity tag for the file name of fsys built
+// from its modification time and size. Files without a modification time
+// are tagged with a hash of their content instead, which cache keeps.
+func fileETag(fsys fs.FS, cache *etagCache, name string, info fs.FileInfo) (string, error) {
+	if !info.ModTime().IsZero() {
+		return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()), nil
+	}
+	key := fmt.Sprintf("%s:%d", name, info.Size())
+	cache.mu.Lock()
+	etag, ok := cache.tags[key]
+	cache.mu.Unlock()
+	if ok {
+		return etag, nil
+	}
+
+	content, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return "", err
+	}
+	etag = contentETag(content, false)
+	cache.mu.Lock()
+	cache.tags[key] = etag
+	cache.mu.Unlock()
+	return etag, nil
+}
+
+// contentETag returns an entity tag hashing content. Weak tags only
+// promise an equivalent representation, so ranges can't be built on them.
+func contentETag(content []byte, weak bool) string {
+	hash := fnv.New64a()
+	hash.Write(content)
+	if weak {
+		return fmt.Sprintf(`W/"%x"`, hash.Sum64())
+	}
+	return fmt.Sprintf(`"%x"`, hash.Sum64())
+}
+
+// checkPreconditions evaluates the conditional header fields of req against
+// the validators of the selected representation in the order of RFC 9110
+// section 13.2.2. It returns HTTP_NOT_MODIFIED or HTTP_PRECONDITION_FAILED
+// when the request must not be answered normally, 0 otherwise. A zero
+// modified time means there is no Last-Modified and dates are ignored.
+func checkPreconditions(req *Request, etag string, modified time.Time) int {
+	header := req.Header
+	modified = modified.Truncate(time.Second)
+	if header.Has("If-Match") {
+		if !etagListMatches(strings.Join(header.Values("If-Match"), ","), etag, false) {
+			return HTTP_PRECONDITION_FAILED
+		}
+	} else if since, ok := parseHTTPDate(header.Get("If-Unmodified-Since")); ok && !modified.IsZero() && modified.After(since) {
+		return HTTP_PRECONDITION_FAILED
+	}
+
+	safe := req.Method == "GET" || req.Method == "HEAD"
+	if header.Has("If-None-Match") {
+		if etagListMatches(strings.Join(header.Values("If-None-Match"), ","), etag, true) {
+			if safe {
+				return HTTP_NOT_MODIFIED
+			}
+			return HTTP_PRECONDITION_FAILED
+		}
+	} else if since, ok := parseHTTPDate(header.Get("If-Modified-Since")); ok && safe && !modified.IsZero() && !modified.After(since) {
+		return HTTP_NOT_MODIFIED
+	}
+	return 0
+}
+
+// etagListMatches reports whether a list of entity tags or "*" contains
+// etag. Weak comparison ignores the W/ prefix, strong comparison only
+// matches tags that are both strong. Malformed lists match nothing.
+func etagListMatches(list string, etag string, weak bool) bool {
+	list = trimOWS(list)
+	if list == "*" {
+		return etag != ""
+	}
+	for list != "" {
+		tag, rest, ok := scanETag(list)
+		if !ok {
+			return false
+		}
+		if weak && strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+		if !weak && tag == etag && !strings.HasPrefix(tag, "W/") {
+			return true
+		}
+		list = trimOWS(rest)
+		if list != "" {
+			after, found := strings.CutPrefix(list, ",")
+			if !found {
+				return false
+			}
+			list = trimOWS(after)
+		}
+	}
+	return false
+}
+
+// scanETag splits the entity tag at the start of s from the rest
+func scanETag(s string) (tag string, rest string, ok bool) {
+	opaque := strings.TrimPrefix(s, "W/")
+	if len(opaque) < 2 || opaque[0] != '"' {
+		return "", "", false
+	}
+	end := strings.IndexByte(opaque[1:], '"')
+	if end < 0 {
+		return "", "", false
+	}
+	n := len(s) - len(opaque) + end + 2
+	return s[:n], s[n:], true
+}
+
+func parseHTTPDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	date, err := http.ParseTime(value)
+	return date, err == nil
+}
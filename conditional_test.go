@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestETagListMatches(t *testing.T) {
+	cases := []struct {
+		list  string
+		etag  string
+		weak  bool
+		match bool
+	}{
+		{`"a"`, `"a"`, false, true},
+		{`"b", "a"`, `"a"`, false, true},
+		{`W/"a"`, `"a"`, false, false},
+		{`W/"a"`, `"a"`, true, true},
+		{`"a"`, `W/"a"`, true, true},
+		{`"a,b"`, `"a,b"`, false, true},
+		{`*`, `"a"`, false, true},
+		{`"b"`, `"a"`, true, false},
+		{`a`, `"a"`, true, false},
+		{`"b" "a"`, `"a"`, true, false},
+	}
+	for _, c := range cases {
+		if etagListMatches(c.list, c.etag, c.weak) != c.match {
+			t.Fatalf(`Wrong match of %s in %s weak %v`, c.etag, c.list, c.weak)
+		}
+	}
+}
+
+func TestServeFileConditionalRequests(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	server.ServeFS("/files", fstest.MapFS{
+		"hello.txt":    {Data: []byte("hello world"), ModTime: modified},
+		"embedded.txt": {Data: []byte("no time")},
+	})
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	get := func(target string, headers string) *http.Response {
+		res, _ := sendRequestTo(t, addr, fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", target, addr, headers))
+		return res
+	}
+
+	res := get("/files/hello.txt", "")
+	etag := res.Header.Get("ETag")
+	if res.StatusCode != HTTP_OK || etag == "" || res.Header.Get("Last-Modified") != "Wed, 01 May 2024 12:00:00 GMT" {
+		t.Fatalf(`Wrong validators got: %d %q %q`, res.StatusCode, etag, res.Header.Get("Last-Modified"))
+	}
+
+	cases := []struct {
+		headers string
+		status  int
+	}{
+		{"If-None-Match: " + etag + "\r\n", HTTP_NOT_MODIFIED},
+		{"If-None-Match: W/" + etag + "\r\n", HTTP_NOT_MODIFIED},
+		{"If-None-Match: \"other\", " + etag + "\r\n", HTTP_NOT_MODIFIED},
+		{"If-None-Match: *\r\n", HTTP_NOT_MODIFIED},
+		{"If-None-Match: \"other\"\r\n", HTTP_OK},
+		{"If-Modified-Since: Wed, 01 May 2024 12:00:00 GMT\r\n", HTTP_NOT_MODIFIED},
+		{"If-Modified-Since: Tue, 30 Apr 2024 12:00:00 GMT\r\n", HTTP_OK},
+		{"If-Modified-Since: not a date\r\n", HTTP_OK},
+		// If-None-Match takes precedence over If-Modified-Since
+		{"If-None-Match: \"other\"\r\nIf-Modified-Since: Wed, 01 May 2024 12:00:00 GMT\r\n", HTTP_OK},
+		{"If-Match: " + etag + "\r\n", HTTP_OK},
+		{"If-Match: *\r\n", HTTP_OK},
+		{"If-Match: W/" + etag + "\r\n", HTTP_PRECONDITION_FAILED},
+		{"If-Match: \"other\"\r\n", HTTP_PRECONDITION_FAILED},
+		{"If-Unmodified-Since: Wed, 01 May 2024 12:00:00 GMT\r\n", HTTP_OK},
+		{"If-Unmodified-Since: Tue, 30 Apr 2024 12:00:00 GMT\r\n", HTTP_PRECONDITION_FAILED},
+		// If-Match takes precedence over If-Unmodified-Since
+		{"If-Match: " + etag + "\r\nIf-Unmodified-Since: Tue, 30 Apr 2024 12:00:00 GMT\r\n", HTTP_OK},
+		{"If-Range: " + etag + "\r\nRange: bytes=0-4\r\n", HTTP_PARTIAL_CONTENT},
+		{"If-Range: W/" + etag + "\r\nRange: bytes=0-4\r\n", HTTP_OK},
+		{"If-Range: Wed, 01 May 2024 12:00:00 GMT\r\nRange: bytes=0-4\r\n", HTTP_PARTIAL_CONTENT},
+	}
+	for _, c := range cases {
+		res := get("/files/hello.txt", c.headers)
+		if res.StatusCode != c.status {
+			t.Fatalf(`Wrong status for %q got: %d`, c.headers, res.StatusCode)
+		}
+		if c.status == HTTP_NOT_MODIFIED && (res.Header.Get("ETag") != etag || res.Header.Get("Content-Type") != "") {
+			t.Fatalf(`Wrong 304 header got: %v`, res.Header)
+		}
+	}
+
+	// Files without a modification time are tagged by content only
+	res = get("/files/embedded.txt", "")
+	embeddedETag := res.Header.Get("ETag")
+	if res.StatusCode != HTTP_OK || embeddedETag == "" || res.Header.Get("Last-Modified") != "" {
+		t.Fatalf(`Wrong validators without a modification time got: %q %q`, embeddedETag, res.Header.Get("Last-Modified"))
+	}
+	if res := get("/files/embedded.txt", "If-None-Match: "+embeddedETag+"\r\n"); res.StatusCode != HTTP_NOT_MODIFIED {
+		t.Fatalf(`Wrong status for a matching content tag got: %d`, res.StatusCode)
+	}
+	if res := get("/files/embedded.txt", "If-Modified-Since: Wed, 01 May 2024 12:00:00 GMT\r\n"); res.StatusCode != HTTP_OK {
+		t.Fatalf(`Dates were compared without a modification time got: %d`, res.StatusCode)
+	}
+}
+
+func TestRenderedPageConditionalRequests(t *testing.T) {
+	templatesPath := writeTemplates(t, map[string]string{"page.html": `Page at {{.Path}}`})
+	server, cleanup := CreateServer("127.0.0.1", "0", templatesPath, nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	if err := server.AddPath("/page", "GET", "page.html"); err != nil {
+		t.Fatalf(`Failed to add path %s`, err)
+	}
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	get := func(headers string) (*http.Response, string) {
+		return sendRequestTo(t, addr, fmt.Sprintf("GET /page HTTP/1.1\r\nHost: %s\r\n%s\r\n", addr, headers))
+	}
+
+	res, content := get("")
+	etag := res.Header.Get("ETag")
+	if res.StatusCode != HTTP_OK || content != "Page at /page" || !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf(`Wrong rendered page got: %d %q %q`, res.StatusCode, etag, content)
+	}
+	if res, content := get("If-None-Match: " + etag + "\r\n"); res.StatusCode != HTTP_NOT_MODIFIED || content != "" || res.Header.Get("ETag") != etag {
+		t.Fatalf(`Wrong response to a matching If-None-Match got: %d %q`, res.StatusCode, content)
+	}
+	if res, _ := get("If-None-Match: W/\"other\"\r\n"); res.StatusCode != HTTP_OK {
+		t.Fatalf(`Wrong response to a stale If-None-Match got: %d`, res.StatusCode)
+	}
+	// Weak tags never pass the strong comparison of If-Match
+	if res, _ := get("If-Match: " + etag + "\r\n"); res.StatusCode != HTTP_PRECONDITION_FAILED {
+		t.Fatalf(`Wrong response to If-Match with a weak tag got: %d`, res.StatusCode)
+	}
+}
+
+// countingFS counts the whole file reads of a MapFS
+type countingFS struct {
+	fstest.MapFS
+	reads *atomic.Int32
+}
+
+func (fsys countingFS) ReadFile(name string) ([]byte, error) {
+	fsys.reads.Add(1)
+	return fsys.MapFS.ReadFile(name)
+}
+
+func TestContentETagIsCached(t *testing.T) {
+	var reads atomic.Int32
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	server.ServeFS("/files", countingFS{fstest.MapFS{"big.bin": {Data: make([]byte, 1<<16)}}, &reads})
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	for range 3 {
+		res, content := sendRequestTo(t, addr, fmt.Sprintf("GET /files/big.bin HTTP/1.1\r\nHost: %s\r\nRange: bytes=0-0\r\n\r\n", addr))
+		if res.StatusCode != HTTP_PARTIAL_CONTENT || len(content) != 1 {
+			t.Fatalf(`Wrong range response got: %d %d bytes`, res.StatusCode, len(content))
+		}
+	}
+	if reads.Load() != 1 {
+		t.Fatalf(`File was read %d times to tag it, expected once`, reads.Load())
+	}
+}
+
+func TestTemplateFileETagIsCached(t *testing.T) {
+	var reads atomic.Int32
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	server.SetTemplateFS(countingFS{fstest.MapFS{"big.bin": {Data: make([]byte, 1<<16)}}, &reads})
+	if err := server.AddPath("/big.bin", "GET", "big.bin"); err != nil {
+		t.Fatalf(`Failed to add path %s`, err)
+	}
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	for range 3 {
+		res, content := sendRequestTo(t, addr, fmt.Sprintf("GET /big.bin HTTP/1.1\r\nHost: %s\r\nRange: bytes=0-0\r\n\r\n", addr))
+		if res.StatusCode != HTTP_PARTIAL_CONTENT || len(content) != 1 {
+			t.Fatalf(`Wrong range response got: %d %d bytes`, res.StatusCode, len(content))
+		}
+	}
+	if reads.Load() != 1 {
+		t.Fatalf(`File was read %d times to tag it, expected once`, reads.Load())
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"net"
+)
+
+// ResponseWriter is what a Handler uses to build its response.
+// Header fields have to be set before WriteHeader or the first Write,
+// which sends the status line with HTTP_OK.
+type ResponseWriter interface {
+	Header() Header
+	Write([]byte) (int, error)
+	WriteHeader(code int)
+}
+
+// Flusher is implemented by writers able to send buffered data right away
+type Flusher interface {
+	Flush() error
+}
+
+// Hijacker is implemented by writers that can hand the connection over
+// to the handler, as protocol upgrades need. br holds data the client
+// already sent past the request.
+type Hijacker interface {
+	Hijack() (conn net.Conn, br *bufio.Reader, err error)
+}
+
+// CloseNotifier is implemented by writers that can tell when the client
+// went away or the server is shutting down, so long running responses
+// can stop early. Calling CloseNotify consumes the rest of the request,
+// so the request body has to be read first.
+type CloseNotifier interface {
+	CloseNotify() <-chan struct{}
+}
+
+// Handler responds to a single request
+type Handler interface {
+	ServeHTTP(w ResponseWriter, req *Request)
+}
+
+// HandlerFunc lets an ordinary function be used as a Handler
+type HandlerFunc func(w ResponseWriter, req *Request)
+
+func (f HandlerFunc) ServeHTTP(w ResponseWriter, req *Request) {
+	f(w, req)
+}
+
+// route is a handler registered for one method of a path pattern
+type route struct {
+	path    Path
+	handler Handler
+}
+
+// sendStatus writes a response consisting of only the status line and header
+func sendStatus(w ResponseWriter, code int) {
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(code)
+}
+
+// FileHandler serves name from the template fs with the content type of
+// its extension or content. Its handlers share the entity tags of the
+// template fs, so building one per request costs no extra reads.
+func (server *Server) FileHandler(name string) Handler {
+	templates := server.templates
+	debug := server.debug
+
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		info, err := fs.Stat(templates.fsys, name)
+		if err != nil {
+			if debug {
+				fmt.Println("Failed to read file:", err)
+			}
+			sendStatus(w, HTTP_INTERNAL_SERVER_ERROR)
+			return
+		}
+		server.serveFile(w, req, templates.fsys, templates.etags, name, info)
+	})
+}
+
+// Handle registers handler for method requests matching the url pattern.
+// middlewares wrap only this route, inside the ones added with Use.
+func (server *Server) Handle(method string, url string, handler Handler, middlewares ...Middleware) error {
+	if _, ok := methods[method]; !ok {
+		return fmt.Errorf("unknown method %s", method)
+	}
+	if handler == nil {
+		return fmt.Errorf("nil handler for %s %s", method, url)
+	}
+	path := Path{url, method, ""}
+	if err := server.router.add(path, chain(handler, middlewares)); err != nil {
+		return err
+	}
+	server.paths[url] = append(server.paths[url], path)
+	return nil
+}
+
+func (server *Server) HandleFunc(method string, url string, handler func(w ResponseWriter, req *Request), middlewares ...Middleware) error {
+	return server.Handle(method, url, HandlerFunc(handler), middlewares...)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestHandlerRoutes(t *testing.T) {
+	server, cleanup := CreateDefaultServer()
+	defer cleanup()
+
+	server.HandleFunc("GET", "/users/:id", func(w ResponseWriter, req *Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "user %s", req.Param("id"))
+	})
+	server.HandleFunc("POST", "/echo", func(w ResponseWriter, req *Request) {
+		w.WriteHeader(HTTP_ACCEPTED)
+		io.Copy(w, req.Body)
+	})
+	server.HandleFunc("GET", "/panic", func(w ResponseWriter, req *Request) {
+		panic("handler failure")
+	})
+	runServer(t, &server)
+
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", "/users/42")
+	rt += fmt.Sprintf("Host: %v\r\n", "127.0.0.1:1337")
+	rt += fmt.Sprintf("\r\n")
+	res, content := sendRequest(t, rt)
+	if res.StatusCode != HTTP_OK || content != "user 42" || res.Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf(`Wrong handler response got: %d %q`, res.StatusCode, content)
+	}
+
+	rt = fmt.Sprintf("POST %v HTTP/1.1\r\n", "/echo")
+	rt += fmt.Sprintf("Host: %v\r\n", "127.0.0.1:1337")
+	rt += fmt.Sprintf("Content-Length: %d\r\n", 5)
+	rt += fmt.Sprintf("\r\n")
+	rt += "hello"
+	res, content = sendRequest(t, rt)
+	if res.StatusCode != HTTP_ACCEPTED || content != "hello" || res.TransferEncoding[0] != "chunked" {
+		t.Fatalf(`Wrong echo response got: %d %q %v`, res.StatusCode, content, res.TransferEncoding)
+	}
+
+	rt = fmt.Sprintf("GET %v HTTP/1.1\r\n", "/panic")
+	rt += fmt.Sprintf("Host: %v\r\n", "127.0.0.1:1337")
+	rt += fmt.Sprintf("\r\n")
+	res, _ = sendRequest(t, rt)
+	if res.StatusCode != HTTP_INTERNAL_SERVER_ERROR {
+		t.Fatalf(`Expected 500 for panicking handler got: %d`, res.StatusCode)
+	}
+}
+
+func TestHandleRegistrationErrors(t *testing.T) {
+	server, cleanup := CreateDefaultServer()
+	defer cleanup()
+
+	if err := server.HandleFunc("FETCH", "/", func(w ResponseWriter, req *Request) {}); err == nil {
+		t.Fatalf(`Expected error for unknown method`)
+	}
+	if err := server.Handle("GET", "/nil", nil); err == nil {
+		t.Fatalf(`Expected error for nil handler`)
+	}
+	if err := server.AddPath("/missing", "GET", "missing.html"); err == nil {
+		t.Fatalf(`Expected error for missing template file`)
+	}
+	if err := server.AddPath("/form", "GET", "form.html"); err != nil {
+		t.Fatalf(`Failed to add path %s`, err)
+	}
+	if len(server.paths["/form"]) != 1 || server.paths["/form"][0].value != "form.html" {
+		t.Fatalf(`AddPath did not record the file name got: %v`, server.paths["/form"])
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/textproto"
+	"strings"
+)
+
+// Header maps canonical header field names to their values.
+// Field names are case-insensitive so every method canonicalizes its key.
+type Header map[string][]string
+
+func (header Header) Add(key string, value string) {
+	key = textproto.CanonicalMIMEHeaderKey(key)
+	header[key] = append(header[key], value)
+}
+
+func (header Header) Set(key string, value string) {
+	header[textproto.CanonicalMIMEHeaderKey(key)] = []string{value}
+}
+
+// Get returns the first value for key or "" when the field is absent
+func (header Header) Get(key string) string {
+	values := header[textproto.CanonicalMIMEHeaderKey(key)]
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (header Header) Values(key string) []string {
+	return header[textproto.CanonicalMIMEHeaderKey(key)]
+}
+
+func (header Header) Del(key string) {
+	delete(header, textproto.CanonicalMIMEHeaderKey(key))
+}
+
+func (header Header) Has(key string) bool {
+	_, ok := header[textproto.CanonicalMIMEHeaderKey(key)]
+	return ok
+}
+
+// hasToken reports whether the comma separated lists in values contain token,
+// compared case-insensitively as for Connection or Transfer-Encoding
+func hasToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, member := range strings.Split(value, ",") {
+			if strings.EqualFold(trimOWS(member), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+)
+
+// headerField is a single decoded HPACK header field.
+// sensitive fields were sent never-indexed and must stay that way.
+type headerField struct {
+	name, value string
+	sensitive   bool
+}
+
+// size is the size of the field in a dynamic table, RFC 7541 section 4.1
+func (field headerField) size() int {
+	return len(field.name) + len(field.value) + 32
+}
+
+var (
+	errHPACKIndex     = errors.New("hpack: invalid table index")
+	errHPACKInteger   = errors.New("hpack: invalid integer")
+	errHPACKTruncated = errors.New("hpack: truncated header block")
+	errHPACKTableSize = errors.New("hpack: invalid dynamic table size update")
+	errHPACKTooLarge  = errors.New("hpack: header field too large")
+)
+
+// staticTable holds the entries of RFC 7541 Appendix A, index 1 is staticTable[0]
+var staticTable = []headerField{
+	{name: ":authority", value: ""},
+	{name: ":method", value: "GET"},
+	{name: ":method", value: "POST"},
+	{name: ":path", value: "/"},
+	{name: ":path", value: "/index.html"},
+	{name: ":scheme", value: "http"},
+	{name: ":scheme", value: "https"},
+	{name: ":status", value: "200"},
+	{name: ":status", value: "204"},
+	{name: ":status", value: "206"},
+	{name: ":status", value: "304"},
+	{name: ":status", value: "400"},
+	{name: ":status", value: "404"},
+	{name: ":status", value: "500"},
+	{name: "accept-charset", value: ""},
+	{name: "accept-encoding", value: "gzip, deflate"},
+	{name: "accept-language", value: ""},
+	{name: "accept-ranges", value: ""},
+	{name: "accept", value: ""},
+	{name: "access-control-allow-origin", value: ""},
+	{name: "age", value: ""},
+	{name: "allow", value: ""},
+	{name: "authorization", value: ""},
+	{name: "cache-control", value: ""},
+	{name: "content-disposition", value: ""},
+	{name: "content-encoding", value: ""},
+	{name: "content-language", value: ""},
+	{name: "content-length", value: ""},
+	{name: "content-location", value: ""},
+	{name: "content-range", value: ""},
+	{name: "content-type", value: ""},
+	{name: "cookie", value: ""},
+	{name: "date", value: ""},
+	{name: "etag", value: ""},
+	{name: "expect", value: ""},
+	{name: "expires", value: ""},
+	{name: "from", value: ""},
+	{name: "host", value: ""},
+	{name: "if-match", value: ""},
+	{name: "if-modified-since", value: ""},
+	{name: "if-none-match", value: ""},
+	{name: "if-range", value: ""},
+	{name: "if-unmodified-since", value: ""},
+	{name: "last-modified", value: ""},
+	{name: "link", value: ""},
+	{name: "location", value: ""},
+	{name: "max-forwards", value: ""},
+	{name: "proxy-authenticate", value: ""},
+	{name: "proxy-authorization", value: ""},
+	{name: "range", value: ""},
+	{name: "referer", value: ""},
+	{name: "refresh", value: ""},
+	{name: "retry-after", value: ""},
+	{name: "server", value: ""},
+	{name: "set-cookie", value: ""},
+	{name: "strict-transport-security", value: ""},
+	{name: "transfer-encoding", value: ""},
+	{name: "user-agent", value: ""},
+	{name: "vary", value: ""},
+	{name: "via", value: ""},
+	{name: "www-authenticate", value: ""},
+}
+
+var (
+	staticExact = make(map[headerField]int)
+	staticNames = make(map[string]int)
+)
+
+func init() {
+	for i, field := range staticTable {
+		if _, ok := staticExact[field]; !ok {
+			staticExact[field] = i + 1
+		}
+		if _, ok := staticNames[field.name]; !ok {
+			staticNames[field.name] = i + 1
+		}
+	}
+}
+
+// dynamicTable is the HPACK dynamic table, new entries are appended and
+// the oldest are evicted first whenever the size limit is exceeded
+type dynamicTable struct {
+	entries []headerField
+	size    int
+	maxSize int
+}
+
+func (table *dynamicTable) add(field headerField) {
+	table.entries = append(table.entries, field)
+	table.size += field.size()
+	table.evict()
+}
+
+func (table *dynamicTable) setMaxSize(maxSize int) {
+	table.maxSize = maxSize
+	table.evict()
+}
+
+func (table *dynamicTable) evict() {
+	n := 0
+	for table.size > table.maxSize && n < len(table.entries) {
+		table.size -= table.entries[n].size()
+		n++
+	}
+	table.entries = table.entries[n:]
+}
+
+// field returns the entry at index in the combined static and dynamic index space
+func (table *dynamicTable) field(index uint64) (headerField, error) {
+	if index == 0 {
+		return headerField{}, errHPACKIndex
+	}
+	if index <= uint64(len(staticTable)) {
+		return staticTable[index-1], nil
+	}
+	dynamicIndex := index - uint64(len(staticTable))
+	if dynamicIndex > uint64(len(table.entries)) {
+		return headerField{}, errHPACKIndex
+	}
+	return table.entries[uint64(len(table.entries))-dynamicIndex], nil
+}
+
+// hpackDecoder decodes the header blocks of one connection
+type hpackDecoder struct {
+	table dynamicTable
+	// maxTableSize is the table size announced in our SETTINGS
+	maxTableSize int
+	// maxStringLen limits single names and values
+	maxStringLen int
+}
+
+func newHPACKDecoder(maxTableSize int, maxStringLen int) *hpackDecoder {
+	return &hpackDecoder{
+		table:        dynamicTable{maxSize: maxTableSize},
+		maxTableSize: maxTableSize,
+		maxStringLen: maxStringLen,
+	}
+}
+
+// decode decodes a complete header block
+func (decoder *hpackDecoder) decode(block []byte) ([]headerField, error) {
+	var fields []headerField
+	for len(block) > 0 {
+		b := block[0]
+		var err error
+		switch {
+		case b&0x80 != 0:
+			// Indexed header field
+			var index uint64
+			if index, block, err = readHPACKInt(block, 7); err != nil {
+				return nil, err
+			}
+			field, err := decoder.table.field(index)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+
+		case b&0xc0 == 0x40:
+			// Literal header field with incremental indexing
+			var field headerField
+			if field, block, err = decoder.readLiteral(block, 6); err != nil {
+				return nil, err
+			}
+			decoder.table.add(field)
+			fields = append(fields, field)
+
+		case b&0xe0 == 0x20:
+			// Dynamic table size updates may only start a block
+			var size uint64
+			if size, block, err = readHPACKInt(block, 5); err != nil {
+				return nil, err
+			}
+			if len(fields) > 0 || size > uint64(decoder.maxTableSize) {
+				return nil, errHPACKTableSize
+			}
+			decoder.table.setMaxSize(int(size))
+
+		default:
+			// Literal header field without indexing or never indexed
+			var field headerField
+			if field, block, err = decoder.readLiteral(block, 4); err != nil {
+				return nil, err
+			}
+			field.sensitive = b&0x10 != 0
+			fields = append(fields, field)
+		}
+	}
+	return fields, nil
+}
+
+// readLiteral reads a literal field whose name index has prefixBits bits
+func (decoder *hpackDecoder) readLiteral(block []byte, prefixBits uint) (headerField, []byte, error) {
+	index, block, err := readHPACKInt(block, prefixBits)
+	if err != nil {
+		return headerField{}, nil, err
+	}
+
+	var field headerField
+	if index > 0 {
+		named, err := decoder.table.field(index)
+		if err != nil {
+			return headerField{}, nil, err
+		}
+		field.name = named.name
+	} else if field.name, block, err = readHPACKString(block, decoder.maxStringLen); err != nil {
+		return headerField{}, nil, err
+	}
+	if field.value, block, err = readHPACKString(block, decoder.maxStringLen); err != nil {
+		return headerField{}, nil, err
+	}
+	return field, block, nil
+}
+
+// readHPACKInt reads an integer with an n bit prefix, RFC 7541 section 5.1
+func readHPACKInt(block []byte, n uint) (uint64, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, errHPACKTruncated
+	}
+	mask := uint64(1)<<n - 1
+	value := uint64(block[0]) & mask
+	block = block[1:]
+	if value < mask {
+		return value, block, nil
+	}
+
+	for shift := uint(0); len(block) > 0; shift += 7 {
+		if shift > 28 {
+			return 0, nil, errHPACKInteger
+		}
+		b := block[0]
+		block = block[1:]
+		value += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, block, nil
+		}
+	}
+	return 0, nil, errHPACKTruncated
+}
+
+// readHPACKString reads a string literal, Huffman encoded or not
+func readHPACKString(block []byte, maxLen int) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, errHPACKTruncated
+	}
+	huffman := block[0]&0x80 != 0
+	length, block, err := readHPACKInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(block)) {
+		return "", nil, errHPACKTruncated
+	}
+	data := block[:length]
+	block = block[length:]
+
+	if !huffman {
+		if len(data) > maxLen {
+			return "", nil, errHPACKTooLarge
+		}
+		return string(data), block, nil
+	}
+	s, err := huffmanDecode(data, maxLen)
+	if err != nil {
+		return "", nil, err
+	}
+	return s, block, nil
+}
+
+// appendHPACKField encodes a header field without touching the dynamic
+// table, so the encoder never has to track the peer's table size.
+// Fields of the static table are sent as an index, otherwise the name is
+// indexed when possible and the value sent as a literal.
+func appendHPACKField(dst []byte, name string, value string) []byte {
+	if index, ok := staticExact[headerField{name: name, value: value}]; ok {
+		return appendHPACKInt(dst, 7, 0x80, uint64(index))
+	}
+	if index, ok := staticNames[name]; ok {
+		dst = appendHPACKInt(dst, 4, 0x00, uint64(index))
+	} else {
+		dst = append(dst, 0x00)
+		dst = appendHPACKString(dst, name)
+	}
+	return appendHPACKString(dst, value)
+}
+
+// appendHPACKInt encodes value with an n bit prefix, flags fills the bits above it
+func appendHPACKInt(dst []byte, n uint, flags byte, value uint64) []byte {
+	mask := uint64(1)<<n - 1
+	if value < mask {
+		return append(dst, flags|byte(value))
+	}
+	dst = append(dst, flags|byte(mask))
+	value -= mask
+	for value >= 0x80 {
+		dst = append(dst, byte(value&0x7f)|0x80)
+		value >>= 7
+	}
+	return append(dst, byte(value))
+}
+
+// appendHPACKString encodes s, with Huffman coding when that is shorter
+func appendHPACKString(dst []byte, s string) []byte {
+	if encodedLen := huffmanEncodedLen(s); encodedLen < len(s) {
+		dst = appendHPACKInt(dst, 7, 0x80, uint64(encodedLen))
+		return huffmanEncode(dst, s)
+	}
+	dst = appendHPACKInt(dst, 7, 0x00, uint64(len(s)))
+	return append(dst, s...)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// The request examples of RFC 7541 appendix C.3 and C.4, each block is
+// decoded with the dynamic table left behind by the previous one
+func TestHPACKDecodeRFCExamples(t *testing.T) {
+	requests := []struct {
+		fields []headerField
+		size   int
+	}{
+		{[]headerField{{name: ":method", value: "GET"}, {name: ":scheme", value: "http"}, {name: ":path", value: "/"}, {name: ":authority", value: "www.example.com"}}, 57},
+		{[]headerField{{name: ":method", value: "GET"}, {name: ":scheme", value: "http"}, {name: ":path", value: "/"}, {name: ":authority", value: "www.example.com"}, {name: "cache-control", value: "no-cache"}}, 110},
+		{[]headerField{{name: ":method", value: "GET"}, {name: ":scheme", value: "https"}, {name: ":path", value: "/index.html"}, {name: ":authority", value: "www.example.com"}, {name: "custom-key", value: "custom-value"}}, 164},
+	}
+	examples := map[string][]string{
+		"plain": {
+			"828684410f7777772e6578616d706c652e636f6d",
+			"828684be58086e6f2d6361636865",
+			"828785bf400a637573746f6d2d6b65790c637573746f6d2d76616c7565",
+		},
+		"huffman": {
+			"828684418cf1e3c2e5f23a6ba0ab90f4ff",
+			"828684be5886a8eb10649cbf",
+			"828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf",
+		},
+	}
+
+	for name, blocks := range examples {
+		decoder := newHPACKDecoder(4096, 1024)
+		for i, block := range blocks {
+			raw, _ := hex.DecodeString(block)
+			fields, err := decoder.decode(raw)
+			if err != nil {
+				t.Fatalf(`Failed to decode %s request %d %s`, name, i+1, err)
+			}
+			if len(fields) != len(requests[i].fields) {
+				t.Fatalf(`Wrong %s request %d got: %v`, name, i+1, fields)
+			}
+			for j, field := range fields {
+				if field != requests[i].fields[j] {
+					t.Fatalf(`Wrong %s request %d field %d got: %v`, name, i+1, j, field)
+				}
+			}
+			if decoder.table.size != requests[i].size {
+				t.Fatalf(`Wrong %s table size after request %d got: %d`, name, i+1, decoder.table.size)
+			}
+		}
+	}
+}
+
+func TestHPACKDecodeErrors(t *testing.T) {
+	blocks := map[string]string{
+		"index zero":             "80",
+		"index out of range":     "be",
+		"truncated string":       "0003666f",
+		"late table size update": "823e",
+		"table size above limit": "3fe21f",
+		"huffman EOS padding":    "0081ff00",
+	}
+	for name, block := range blocks {
+		raw, _ := hex.DecodeString(block)
+		if _, err := newHPACKDecoder(4096, 1024).decode(raw); err == nil {
+			t.Fatalf(`Expected %s to fail`, name)
+		}
+	}
+
+	long := appendHPACKField(nil, "x-long", strings.Repeat("a", 2048))
+	if _, err := newHPACKDecoder(4096, 1024).decode(long); err == nil {
+		t.Fatalf(`Expected value over the string limit to fail`)
+	}
+}
+
+func TestHPACKEncodeRoundTrip(t *testing.T) {
+	fields := []headerField{
+		{name: ":status", value: "200"},
+		{name: ":status", value: "418"},
+		{name: "content-type", value: "text/html; charset=utf-8"},
+		{name: "x-binary", value: "\x00\x7f\xff"},
+		{name: "x-empty", value: ""},
+		{name: "set-cookie", value: strings.Repeat("session=abc; ", 20)},
+	}
+	var block []byte
+	for _, field := range fields {
+		block = appendHPACKField(block, field.name, field.value)
+	}
+
+	decoder := newHPACKDecoder(4096, 1024)
+	decoded, err := decoder.decode(block)
+	if err != nil {
+		t.Fatalf(`Failed to decode encoded block %s`, err)
+	}
+	if len(decoded) != len(fields) {
+		t.Fatalf(`Wrong field count got: %d`, len(decoded))
+	}
+	for i := range fields {
+		if decoded[i] != fields[i] {
+			t.Fatalf(`Wrong field %d got: %v`, i, decoded[i])
+		}
+	}
+	// The encoder never indexes, so the peer's table stays empty
+	if len(decoder.table.entries) != 0 {
+		t.Fatalf(`Encoder added %d dynamic table entries`, len(decoder.table.entries))
+	}
+	// :status 200 is in the static table and takes one byte
+	if block[0] != 0x88 {
+		t.Fatalf(`Expected indexed :status 200 got: %x`, block[0])
+	}
+}
+
+func TestHuffmanRoundTrip(t *testing.T) {
+	var all strings.Builder
+	for i := range 256 {
+		all.WriteByte(byte(i))
+	}
+	for _, s := range []string{"", "www.example.com", "no-cache", all.String()} {
+		encoded := huffmanEncode(nil, s)
+		if len(encoded) != huffmanEncodedLen(s) {
+			t.Fatalf(`Wrong encoded length for %q got: %d`, s, len(encoded))
+		}
+		decoded, err := huffmanDecode(encoded, 1024)
+		if err != nil || decoded != s {
+			t.Fatalf(`Huffman round trip failed for %q got: %q %v`, s, decoded, err)
+		}
+	}
+}
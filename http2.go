@@ -0,0 +1,1124 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// http2MaxStreams is the SETTINGS_MAX_CONCURRENT_STREAMS we announce
+	http2MaxStreams = 250
+	// http2Window is the receive window of every stream and of the connection
+	http2Window = 1 << 20
+	// http2TableSize is the HPACK dynamic table size we allow the client
+	http2TableSize = 4096
+)
+
+var errStreamClosed = errors.New("http2: stream closed")
+
+// SetHTTP2 turns HTTP/2 on or off. It is on by default: over HTTPS it is
+// offered with ALPN, over plain HTTP clients start it with prior knowledge
+// or an h2c upgrade.
+func (server *Server) SetHTTP2(enabled bool) {
+	server.http2 = enabled
+}
+
+// hasHTTP2Preface reports if the client opened the connection with the
+// HTTP/2 preface instead of an HTTP/1 request line
+func hasHTTP2Preface(br *bufio.Reader) bool {
+	// No request line starts with PRI, so HTTP/1 clients never wait for
+	// the 24 bytes of the preface
+	if start, err := br.Peek(4); err != nil || string(start) != http2Preface[:4] {
+		return false
+	}
+	preface, err := br.Peek(len(http2Preface))
+	return err == nil && string(preface) == http2Preface
+}
+
+// h2cUpgradeSettings returns the decoded HTTP2-Settings of a request
+// asking to upgrade to HTTP/2, RFC 7540 section 3.2. Requests with a
+// body are served over HTTP/1.1.
+func h2cUpgradeSettings(req *Request) ([]byte, bool) {
+	if req.ProtoMinor != 1 || req.ContentLength != 0 {
+		return nil, false
+	}
+	connection := req.Header.Values("Connection")
+	if !hasToken(req.Header.Values("Upgrade"), "h2c") || !hasToken(connection, "upgrade") || !hasToken(connection, "http2-settings") {
+		return nil, false
+	}
+	values := req.Header.Values("HTTP2-Settings")
+	if len(values) != 1 {
+		return nil, false
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(values[0], "="))
+	if err != nil || len(settings)%6 != 0 {
+		return nil, false
+	}
+	return settings, true
+}
+
+// upgradeHTTP2 switches to HTTP/2 and answers req on stream 1
+func (server *Server) upgradeHTTP2(conn net.Conn, br *bufio.Reader, req *Request, settings []byte) {
+	for _, key := range []string{"Upgrade", "Connection", "HTTP2-Settings"} {
+		req.Header.Del(key)
+	}
+	req.RemoteAddr = conn.RemoteAddr().String()
+	req.conn = conn
+	if server.debug {
+		fmt.Println("Upgrading connection to h2c")
+	}
+	response := fmt.Sprintf("HTTP/1.1 %d %s\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n",
+		HTTP_SWITCHING_PROTOCOLS, statusText(HTTP_SWITCHING_PROTOCOLS))
+	if _, err := io.WriteString(conn, response); err != nil {
+		return
+	}
+	server.serveHTTP2(conn, br, req, settings)
+}
+
+// http2Conn serves one HTTP/2 connection. The calling goroutine reads
+// frames, every stream runs its handler in its own goroutine. Frames are
+// written under wmu, the state below mu is shared with the handlers.
+type http2Conn struct {
+	server *Server
+	conn   net.Conn
+	br     *bufio.Reader
+
+	wmu sync.Mutex
+	bw  *bufio.Writer
+
+	mu sync.Mutex
+	// cond is signalled when send windows grow or streams go away
+	cond    *sync.Cond
+	streams map[uint32]*http2Stream
+	// lastStreamID is the highest stream the client opened
+	lastStreamID uint32
+	// sendWindow is the connection window the client granted us
+	sendWindow        int64
+	peerInitialWindow int64
+	peerMaxFrameSize  uint32
+	// recvWindow is what the client may still send, unacked was read by
+	// handlers but not yet returned in a WINDOW_UPDATE
+	recvWindow int64
+	unacked    int64
+	goingAway  bool
+	closed     bool
+
+	decoder  *hpackDecoder
+	handlers sync.WaitGroup
+}
+
+type http2Stream struct {
+	id   uint32
+	conn *http2Conn
+	// sendWindow and recvWindow are guarded by conn.mu like the connection ones
+	sendWindow int64
+	recvWindow int64
+	unacked    int64
+	body       *http2Body
+	// remoteClosed is set once the client ended its side of the stream
+	remoteClosed bool
+	// reset is set when either side sent RST_STREAM
+	reset bool
+	// closed is closed once the stream ends early or the server shuts down
+	closed    chan struct{}
+	closeOnce sync.Once
+	// contentLength is the declared request length, -1 when unknown
+	contentLength int64
+	received      int64
+	trailer       Header
+}
+
+// serveHTTP2 runs an HTTP/2 connection until it fails or the client
+// leaves. upgrade is the HTTP/1.1 request that asked for h2c, it becomes
+// stream 1 together with the settings the client sent along.
+func (server *Server) serveHTTP2(conn net.Conn, br *bufio.Reader, upgrade *Request, upgradeSettings []byte) {
+	h2 := &http2Conn{
+		server:            server,
+		conn:              conn,
+		br:                br,
+		bw:                bufio.NewWriterSize(conn, 16<<10),
+		streams:           make(map[uint32]*http2Stream),
+		sendWindow:        http2DefaultWindow,
+		peerInitialWindow: http2DefaultWindow,
+		peerMaxFrameSize:  http2DefaultFrameLen,
+		recvWindow:        http2Window,
+		decoder:           newHPACKDecoder(http2TableSize, server.limits.maxHeaderBytes),
+	}
+	h2.cond = sync.NewCond(&h2.mu)
+
+	err := h2.serve(upgrade, upgradeSettings)
+	var h2Err *http2Error
+	if errors.As(err, &h2Err) && h2Err.streamID == 0 {
+		if server.debug {
+			fmt.Println("HTTP/2 connection error:", h2Err)
+		}
+		h2.goAway(h2Err.code)
+	}
+
+	h2.mu.Lock()
+	h2.closed = true
+	for _, stream := range h2.streams {
+		stream.reset = true
+		stream.body.closeWithError(errStreamClosed)
+		stream.notifyClosed()
+	}
+	h2.cond.Broadcast()
+	h2.mu.Unlock()
+	conn.Close()
+	h2.handlers.Wait()
+}
+
+func (h2 *http2Conn) serve(upgrade *Request, upgradeSettings []byte) error {
+	server := h2.server
+	settings := []http2Setting{
+		{http2SettingMaxConcurrentStreams, http2MaxStreams},
+		{http2SettingInitialWindowSize, http2Window},
+		{http2SettingMaxHeaderListSize, uint32(server.limits.maxHeaderBytes)},
+		{http2SettingHeaderTableSize, http2TableSize},
+	}
+	h2.writeFrame(http2FrameSettings, 0, 0, encodeHTTP2Settings(settings))
+	h2.writeWindowUpdate(0, http2Window-http2DefaultWindow)
+
+	if upgrade != nil {
+		if err := h2.applySettings(upgradeSettings); err != nil {
+			return err
+		}
+		h2.startUpgradeStream(upgrade)
+	}
+
+	h2.conn.SetReadDeadline(time.Now().Add(server.readTimeout))
+	preface := make([]byte, len(http2Preface))
+	if _, err := io.ReadFull(h2.br, preface); err != nil || string(preface) != http2Preface {
+		return http2ConnError(http2ProtocolError, "invalid preface")
+	}
+
+	if !server.tracker.setShutdownHook(h2.conn, func() { go h2.shutdown() }) {
+		go h2.shutdown()
+	}
+
+	for first := true; ; first = false {
+		h2.mu.Lock()
+		idle := len(h2.streams) == 0
+		h2.mu.Unlock()
+		if idle {
+			h2.conn.SetReadDeadline(time.Now().Add(server.idleTimeout))
+		} else {
+			h2.conn.SetReadDeadline(time.Time{})
+		}
+
+		frame, err := readHTTP2Frame(h2.br, http2DefaultFrameLen)
+		if err != nil {
+			return err
+		}
+		if first && frame.typ != http2FrameSettings {
+			return http2ConnError(http2ProtocolError, "first frame is not SETTINGS")
+		}
+		if err := h2.processFrame(frame); err != nil {
+			var h2Err *http2Error
+			if errors.As(err, &h2Err) && h2Err.streamID != 0 {
+				h2.resetStream(h2Err.streamID, h2Err.code)
+				continue
+			}
+			return err
+		}
+	}
+}
+
+func (h2 *http2Conn) processFrame(frame http2Frame) error {
+	switch frame.typ {
+	case http2FrameData:
+		return h2.processData(frame)
+	case http2FrameHeaders:
+		return h2.processHeaders(frame)
+	case http2FramePriority:
+		if frame.streamID == 0 {
+			return http2ConnError(http2ProtocolError, "PRIORITY on stream 0")
+		}
+		if len(frame.payload) != 5 {
+			return http2StreamError(frame.streamID, http2FrameSizeError, "PRIORITY length")
+		}
+		return nil
+	case http2FrameRSTStream:
+		return h2.processRSTStream(frame)
+	case http2FrameSettings:
+		return h2.processSettings(frame)
+	case http2FramePushPromise:
+		return http2ConnError(http2ProtocolError, "PUSH_PROMISE from client")
+	case http2FramePing:
+		if frame.streamID != 0 {
+			return http2ConnError(http2ProtocolError, "PING on a stream")
+		}
+		if len(frame.payload) != 8 {
+			return http2ConnError(http2FrameSizeError, "PING length")
+		}
+		if frame.flags&http2FlagAck == 0 {
+			h2.writeFrame(http2FramePing, http2FlagAck, 0, frame.payload)
+		}
+		return nil
+	case http2FrameGoAway:
+		if frame.streamID != 0 {
+			return http2ConnError(http2ProtocolError, "GOAWAY on a stream")
+		}
+		h2.mu.Lock()
+		h2.goingAway = true
+		h2.mu.Unlock()
+		return nil
+	case http2FrameWindowUpdate:
+		return h2.processWindowUpdate(frame)
+	case http2FrameContinuation:
+		return http2ConnError(http2ProtocolError, "CONTINUATION without HEADERS")
+	}
+	// Unknown frame types are ignored
+	return nil
+}
+
+func (h2 *http2Conn) processSettings(frame http2Frame) error {
+	if frame.streamID != 0 {
+		return http2ConnError(http2ProtocolError, "SETTINGS on a stream")
+	}
+	if frame.flags&http2FlagAck != 0 {
+		if len(frame.payload) != 0 {
+			return http2ConnError(http2FrameSizeError, "SETTINGS ACK with payload")
+		}
+		return nil
+	}
+	if err := h2.applySettings(frame.payload); err != nil {
+		return err
+	}
+	h2.writeFrame(http2FrameSettings, http2FlagAck, 0, nil)
+	return nil
+}
+
+func (h2 *http2Conn) applySettings(payload []byte) error {
+	settings, err := decodeHTTP2Settings(payload)
+	if err != nil {
+		return err
+	}
+
+	h2.mu.Lock()
+	defer h2.mu.Unlock()
+	for _, setting := range settings {
+		switch setting.id {
+		case http2SettingEnablePush:
+			if setting.value > 1 {
+				return http2ConnError(http2ProtocolError, "invalid ENABLE_PUSH")
+			}
+		case http2SettingInitialWindowSize:
+			if setting.value > http2MaxWindow {
+				return http2ConnError(http2FlowControlError, "INITIAL_WINDOW_SIZE too large")
+			}
+			// The change applies to the windows of all open streams
+			delta := int64(setting.value) - h2.peerInitialWindow
+			h2.peerInitialWindow = int64(setting.value)
+			for _, stream := range h2.streams {
+				stream.sendWindow += delta
+				if stream.sendWindow > http2MaxWindow {
+					return http2ConnError(http2FlowControlError, "stream window overflow")
+				}
+			}
+		case http2SettingMaxFrameSize:
+			if setting.value < http2DefaultFrameLen || setting.value > http2MaxFrameLen {
+				return http2ConnError(http2ProtocolError, "invalid MAX_FRAME_SIZE")
+			}
+			h2.peerMaxFrameSize = setting.value
+		}
+	}
+	h2.cond.Broadcast()
+	return nil
+}
+
+func (h2 *http2Conn) processWindowUpdate(frame http2Frame) error {
+	if len(frame.payload) != 4 {
+		return http2ConnError(http2FrameSizeError, "WINDOW_UPDATE length")
+	}
+	increment := int64(binary.BigEndian.Uint32(frame.payload) & (1<<31 - 1))
+
+	h2.mu.Lock()
+	defer h2.mu.Unlock()
+	if frame.streamID == 0 {
+		if increment == 0 {
+			return http2ConnError(http2ProtocolError, "WINDOW_UPDATE of 0")
+		}
+		h2.sendWindow += increment
+		if h2.sendWindow > http2MaxWindow {
+			return http2ConnError(http2FlowControlError, "connection window overflow")
+		}
+	} else {
+		if frame.streamID > h2.lastStreamID {
+			return http2ConnError(http2ProtocolError, "WINDOW_UPDATE on idle stream")
+		}
+		stream := h2.streams[frame.streamID]
+		if stream == nil {
+			// Updates can cross with the end of the stream
+			return nil
+		}
+		if increment == 0 {
+			return http2StreamError(frame.streamID, http2ProtocolError, "WINDOW_UPDATE of 0")
+		}
+		stream.sendWindow += increment
+		if stream.sendWindow > http2MaxWindow {
+			return http2StreamError(frame.streamID, http2FlowControlError, "stream window overflow")
+		}
+	}
+	h2.cond.Broadcast()
+	return nil
+}
+
+func (h2 *http2Conn) processRSTStream(frame http2Frame) error {
+	if frame.streamID == 0 {
+		return http2ConnError(http2ProtocolError, "RST_STREAM on stream 0")
+	}
+	if len(frame.payload) != 4 {
+		return http2ConnError(http2FrameSizeError, "RST_STREAM length")
+	}
+
+	h2.mu.Lock()
+	defer h2.mu.Unlock()
+	if frame.streamID > h2.lastStreamID {
+		return http2ConnError(http2ProtocolError, "RST_STREAM on idle stream")
+	}
+	if stream := h2.streams[frame.streamID]; stream != nil {
+		stream.reset = true
+		stream.remoteClosed = true
+		stream.body.closeWithError(errStreamClosed)
+		stream.notifyClosed()
+		h2.cond.Broadcast()
+	}
+	return nil
+}
+
+func (h2 *http2Conn) processData(frame http2Frame) error {
+	if frame.streamID == 0 {
+		return http2ConnError(http2ProtocolError, "DATA on stream 0")
+	}
+	// The whole frame counts against flow control, padding included
+	length := int64(len(frame.payload))
+	if err := frame.stripPadding(); err != nil {
+		return err
+	}
+
+	h2.mu.Lock()
+	if length > h2.recvWindow {
+		h2.mu.Unlock()
+		return http2ConnError(http2FlowControlError, "connection window exceeded")
+	}
+	h2.recvWindow -= length
+	if frame.streamID > h2.lastStreamID {
+		h2.mu.Unlock()
+		return http2ConnError(http2ProtocolError, "DATA on idle stream")
+	}
+	stream := h2.streams[frame.streamID]
+	if stream == nil || stream.remoteClosed {
+		h2.mu.Unlock()
+		// The data is dropped, so the client gets its window back right away
+		h2.returnWindow(nil, length)
+		return http2StreamError(frame.streamID, http2StreamClosed, "DATA on closed stream")
+	}
+	if length > stream.recvWindow {
+		h2.mu.Unlock()
+		return http2StreamError(frame.streamID, http2FlowControlError, "stream window exceeded")
+	}
+	stream.recvWindow -= length
+	stream.received += int64(len(frame.payload))
+	padding := length - int64(len(frame.payload))
+	endStream := frame.flags&http2FlagEndStream != 0
+	if endStream {
+		stream.remoteClosed = true
+	}
+	tooLong := stream.contentLength >= 0 && stream.received > stream.contentLength
+	short := endStream && stream.contentLength >= 0 && stream.received != stream.contentLength
+	h2.mu.Unlock()
+
+	if tooLong || short {
+		stream.body.closeWithError(errMalformedRequest)
+		return http2StreamError(frame.streamID, http2ProtocolError, "body length differs from content-length")
+	}
+	stream.body.write(frame.payload)
+	if endStream {
+		stream.body.closeWithError(io.EOF)
+	}
+	if padding > 0 {
+		h2.returnWindow(stream, padding)
+	}
+	return nil
+}
+
+// processHeaders handles a header block opening a stream or carrying its
+// trailers, CONTINUATION frames are read right here
+func (h2 *http2Conn) processHeaders(frame http2Frame) error {
+	if frame.streamID == 0 {
+		return http2ConnError(http2ProtocolError, "HEADERS on stream 0")
+	}
+	if frame.streamID%2 == 0 {
+		return http2ConnError(http2ProtocolError, "HEADERS on an even stream")
+	}
+	if err := frame.stripPadding(); err != nil {
+		return err
+	}
+	if frame.flags&http2FlagPriority != 0 {
+		if len(frame.payload) < 5 {
+			return http2ConnError(http2FrameSizeError, "HEADERS priority")
+		}
+		frame.payload = frame.payload[5:]
+	}
+
+	block := frame.payload
+	for frame.flags&http2FlagEndHeaders == 0 {
+		next, err := readHTTP2Frame(h2.br, http2DefaultFrameLen)
+		if err != nil {
+			return err
+		}
+		if next.typ != http2FrameContinuation || next.streamID != frame.streamID {
+			return http2ConnError(http2ProtocolError, "expected CONTINUATION")
+		}
+		block = append(block, next.payload...)
+		if len(block) > 2*h2.server.limits.maxHeaderBytes {
+			return http2ConnError(http2EnhanceYourCalm, "header block too large")
+		}
+		frame.flags |= next.flags & http2FlagEndHeaders
+	}
+
+	// The block is decoded even for refused streams to keep HPACK in sync
+	fields, err := h2.decoder.decode(block)
+	if err != nil {
+		return http2ConnError(http2CompressionError, err.Error())
+	}
+	endStream := frame.flags&http2FlagEndStream != 0
+
+	h2.mu.Lock()
+	if frame.streamID <= h2.lastStreamID {
+		stream := h2.streams[frame.streamID]
+		if stream == nil || stream.remoteClosed {
+			h2.mu.Unlock()
+			return http2StreamError(frame.streamID, http2StreamClosed, "HEADERS on closed stream")
+		}
+		h2.mu.Unlock()
+		return h2.processTrailers(stream, fields, endStream)
+	}
+	h2.lastStreamID = frame.streamID
+	refuse := h2.goingAway || len(h2.streams) >= http2MaxStreams
+	h2.mu.Unlock()
+
+	if refuse {
+		return http2StreamError(frame.streamID, http2RefusedStream, "refused")
+	}
+	req, code, err := h2.newRequest(fields, endStream)
+	if err != nil {
+		return http2StreamError(frame.streamID, http2ProtocolError, err.Error())
+	}
+	h2.startStream(frame.streamID, req, endStream, code)
+	return nil
+}
+
+func (h2 *http2Conn) processTrailers(stream *http2Stream, fields []headerField, endStream bool) error {
+	if !endStream {
+		return http2StreamError(stream.id, http2ProtocolError, "trailers without END_STREAM")
+	}
+	for _, field := range fields {
+		if strings.HasPrefix(field.name, ":") {
+			return http2StreamError(stream.id, http2ProtocolError, "pseudo header in trailers")
+		}
+		stream.trailer.Add(field.name, field.value)
+	}
+
+	h2.mu.Lock()
+	stream.remoteClosed = true
+	short := stream.contentLength >= 0 && stream.received != stream.contentLength
+	h2.mu.Unlock()
+	if short {
+		stream.body.closeWithError(errMalformedRequest)
+		return http2StreamError(stream.id, http2ProtocolError, "body shorter than content-length")
+	}
+	stream.body.closeWithError(io.EOF)
+	return nil
+}
+
+var errMalformedRequest = errors.New("http2: malformed request")
+
+// http2ConnectionHeaders are HTTP/1 connection fields that HTTP/2 forbids
+var http2ConnectionHeaders = []string{"connection", "keep-alive", "proxy-connection", "transfer-encoding", "upgrade"}
+
+// newRequest builds the request of a header block. Malformed blocks are
+// an error resetting the stream, requests that get a plain error answer
+// come back with its status code instead.
+func (h2 *http2Conn) newRequest(fields []headerField, endStream bool) (*Request, int, error) {
+	req := &Request{
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     make(Header),
+		Trailer:    make(Header),
+		RemoteAddr: h2.conn.RemoteAddr().String(),
+		conn:       h2.conn,
+	}
+	if tlsConn, ok := h2.conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		req.TLS = &state
+	}
+
+	var scheme string
+	var cookies []string
+	listSize := 0
+	regular := false
+	for _, field := range fields {
+		listSize += field.size()
+		if strings.HasPrefix(field.name, ":") {
+			if regular {
+				return nil, 0, errors.New("pseudo header after regular header")
+			}
+			var target *string
+			switch field.name {
+			case ":method":
+				target = &req.Method
+			case ":scheme":
+				target = &scheme
+			case ":authority":
+				target = &req.Host
+			case ":path":
+				target = &req.Target
+			default:
+				return nil, 0, fmt.Errorf("unknown pseudo header %s", field.name)
+			}
+			if *target != "" {
+				return nil, 0, fmt.Errorf("duplicate %s", field.name)
+			}
+			*target = field.value
+			continue
+		}
+
+		regular = true
+		if !isToken(field.name) || strings.ToLower(field.name) != field.name {
+			return nil, 0, fmt.Errorf("invalid header name %q", field.name)
+		}
+		if !isValidFieldValue(field.value) {
+			return nil, 0, fmt.Errorf("invalid value for %s", field.name)
+		}
+		for _, name := range http2ConnectionHeaders {
+			if field.name == name {
+				return nil, 0, fmt.Errorf("connection header %s", name)
+			}
+		}
+		if field.name == "te" && field.value != "trailers" {
+			return nil, 0, errors.New("te other than trailers")
+		}
+		if field.name == "cookie" {
+			// Cookies may be split into several fields, RFC 9113 section 8.2.3
+			cookies = append(cookies, field.value)
+			continue
+		}
+		req.Header.Add(field.name, field.value)
+	}
+	if len(cookies) > 0 {
+		req.Header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+	if req.Method == "" || scheme == "" || req.Target == "" {
+		return nil, 0, errors.New("missing pseudo header")
+	}
+	if req.Host == "" {
+		req.Host = req.Header.Get("Host")
+	}
+
+	if listSize > h2.server.limits.maxHeaderBytes {
+		return req, HTTP_REQUEST_HEADER_FIELDS_TOO_LARGE, nil
+	}
+	if _, ok := methods[req.Method]; !ok {
+		return req, HTTP_BAD_REQUEST, nil
+	}
+	if err := parseTarget(req, req.Target); err != nil {
+		return nil, 0, err
+	}
+
+	req.ContentLength = -1
+	if values := req.Header.Values("Content-Length"); len(values) > 0 {
+		length, err := parseContentLength(values)
+		if err != nil {
+			return nil, 0, err
+		}
+		if length > h2.server.limits.maxBodyBytes {
+			return req, HTTP_CONTENT_TOO_LARGE, nil
+		}
+		req.ContentLength = length
+	}
+	if endStream {
+		if req.ContentLength > 0 {
+			return nil, 0, errors.New("content-length without body")
+		}
+		req.ContentLength = 0
+	}
+	return req, 0, nil
+}
+
+// startStream registers the stream and runs its handler. A non zero code
+// is answered right away without calling the handler.
+func (h2 *http2Conn) startStream(id uint32, req *Request, endStream bool, code int) {
+	stream := &http2Stream{
+		id:            id,
+		conn:          h2,
+		closed:        make(chan struct{}),
+		recvWindow:    http2Window,
+		remoteClosed:  endStream,
+		contentLength: req.ContentLength,
+		trailer:       req.Trailer,
+	}
+	stream.body = newHTTP2Body(stream, h2.server.limits.maxBodyBytes)
+	if endStream {
+		stream.body.closeWithError(io.EOF)
+		req.Body = noBody{}
+	} else {
+		req.Body = stream.body
+	}
+
+	h2.mu.Lock()
+	stream.sendWindow = h2.peerInitialWindow
+	h2.streams[id] = stream
+	if len(h2.streams) == 1 {
+		h2.server.tracker.setActive(h2.conn, true)
+	}
+	h2.mu.Unlock()
+
+	h2.handlers.Add(1)
+	go func() {
+		defer h2.handlers.Done()
+		defer h2.closeStream(stream)
+		h2.runHandler(stream, req, code)
+	}()
+}
+
+// startUpgradeStream serves the request that upgraded the connection on
+// stream 1, the client already sent all of it
+func (h2 *http2Conn) startUpgradeStream(req *Request) {
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2.0", 2, 0
+	h2.lastStreamID = 1
+	h2.startStream(1, req, true, 0)
+}
+
+func (h2 *http2Conn) runHandler(stream *http2Stream, req *Request, code int) {
+	res := newHTTP2ResponseWriter(stream, req)
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Printf("Handler for %s %s panicked: %v\n", req.Method, req.Path, err)
+			if res.wroteHeader {
+				h2.resetStream(stream.id, http2InternalError)
+				return
+			}
+			res.header = make(Header)
+			sendStatus(res, HTTP_INTERNAL_SERVER_ERROR)
+			res.finish()
+		}
+	}()
+
+	if h2.server.debug {
+		fmt.Printf("Got request: %s %s %s\n", req.Method, req.Target, req.Proto)
+	}
+	if code != 0 {
+		sendStatus(res, code)
+	} else {
+		h2.server.ServeHTTP(res, req)
+	}
+	if err := res.finish(); err != nil && h2.server.debug {
+		fmt.Println("Error writing response:", err)
+	}
+}
+
+// closeStream forgets a stream whose handler returned. When the client
+// is still sending the request body it is told to stop.
+func (h2 *http2Conn) closeStream(stream *http2Stream) {
+	h2.mu.Lock()
+	delete(h2.streams, stream.id)
+	stopBody := !stream.remoteClosed && !stream.reset
+	stream.reset = true
+	remaining := len(h2.streams)
+	goingAway := h2.goingAway
+	h2.cond.Broadcast()
+	h2.mu.Unlock()
+
+	if stopBody {
+		h2.resetStream(stream.id, http2NoError)
+	}
+	// Unread body data no longer counts against the connection window
+	if unread := stream.body.discard(); unread > 0 {
+		h2.returnWindow(nil, unread)
+	}
+	if remaining == 0 {
+		h2.server.tracker.setActive(h2.conn, false)
+		if goingAway {
+			h2.conn.Close()
+		}
+	}
+}
+
+func (stream *http2Stream) notifyClosed() {
+	stream.closeOnce.Do(func() { close(stream.closed) })
+}
+
+// shutdown sends GOAWAY so the client opens no more streams, the
+// connection closes once the running ones are done
+func (h2 *http2Conn) shutdown() {
+	h2.mu.Lock()
+	h2.goingAway = true
+	idle := len(h2.streams) == 0
+	for _, stream := range h2.streams {
+		stream.notifyClosed()
+	}
+	h2.mu.Unlock()
+
+	h2.goAway(http2NoError)
+	if idle {
+		h2.conn.Close()
+	}
+}
+
+func (h2 *http2Conn) goAway(code uint32) {
+	h2.mu.Lock()
+	lastStreamID := h2.lastStreamID
+	h2.mu.Unlock()
+	payload := binary.BigEndian.AppendUint32(nil, lastStreamID)
+	payload = binary.BigEndian.AppendUint32(payload, code)
+	h2.writeFrame(http2FrameGoAway, 0, 0, payload)
+}
+
+func (h2 *http2Conn) resetStream(id uint32, code uint32) {
+	h2.mu.Lock()
+	if stream := h2.streams[id]; stream != nil {
+		stream.reset = true
+		stream.body.closeWithError(errStreamClosed)
+		stream.notifyClosed()
+		h2.cond.Broadcast()
+	}
+	h2.mu.Unlock()
+	h2.writeFrame(http2FrameRSTStream, 0, id, binary.BigEndian.AppendUint32(nil, code))
+}
+
+// returnWindow gives n consumed bytes back to the client. Updates are
+// batched until half a window was consumed to save frames.
+func (h2 *http2Conn) returnWindow(stream *http2Stream, n int64) {
+	var connIncrement, streamIncrement int64
+	h2.mu.Lock()
+	h2.unacked += n
+	if h2.unacked >= http2Window/2 {
+		connIncrement = h2.unacked
+		h2.recvWindow += h2.unacked
+		h2.unacked = 0
+	}
+	if stream != nil && !stream.remoteClosed {
+		stream.unacked += n
+		if stream.unacked >= http2Window/2 {
+			streamIncrement = stream.unacked
+			stream.recvWindow += stream.unacked
+			stream.unacked = 0
+		}
+	}
+	h2.mu.Unlock()
+
+	if connIncrement > 0 {
+		h2.writeWindowUpdate(0, connIncrement)
+	}
+	if streamIncrement > 0 {
+		h2.writeWindowUpdate(stream.id, streamIncrement)
+	}
+}
+
+func (h2 *http2Conn) writeWindowUpdate(id uint32, increment int64) {
+	h2.writeFrame(http2FrameWindowUpdate, 0, id, binary.BigEndian.AppendUint32(nil, uint32(increment)))
+}
+
+func (h2 *http2Conn) writeFrame(typ byte, flags byte, id uint32, payload []byte) error {
+	h2.wmu.Lock()
+	defer h2.wmu.Unlock()
+	if err := writeHTTP2Frame(h2.bw, typ, flags, id, payload); err != nil {
+		return err
+	}
+	return h2.bw.Flush()
+}
+
+// writeHeaders sends a header block split into HEADERS and CONTINUATION
+// frames, all of them written at once so no other frame gets in between
+func (h2 *http2Conn) writeHeaders(id uint32, block []byte, endStream bool) error {
+	h2.mu.Lock()
+	maxLen := int(h2.peerMaxFrameSize)
+	h2.mu.Unlock()
+
+	h2.wmu.Lock()
+	defer h2.wmu.Unlock()
+	typ := byte(http2FrameHeaders)
+	flags := byte(0)
+	if endStream {
+		flags |= http2FlagEndStream
+	}
+	for {
+		chunk := block
+		if len(chunk) > maxLen {
+			chunk = chunk[:maxLen]
+		}
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= http2FlagEndHeaders
+		}
+		if err := writeHTTP2Frame(h2.bw, typ, flags, id, chunk); err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			return h2.bw.Flush()
+		}
+		typ, flags = http2FrameContinuation, 0
+	}
+}
+
+// writeData sends p as DATA frames, waiting for the client to open its
+// flow control windows whenever they are used up
+func (h2 *http2Conn) writeData(stream *http2Stream, p []byte, endStream bool) error {
+	for {
+		h2.mu.Lock()
+		for !stream.reset && !h2.closed && len(p) > 0 && (h2.sendWindow <= 0 || stream.sendWindow <= 0) {
+			h2.cond.Wait()
+		}
+		if stream.reset || h2.closed {
+			h2.mu.Unlock()
+			return errStreamClosed
+		}
+		// An empty frame ending the stream needs no window, which a lowered
+		// INITIAL_WINDOW_SIZE may have left negative
+		n := int64(len(p))
+		n = max(min(n, h2.sendWindow, stream.sendWindow, int64(h2.peerMaxFrameSize)), 0)
+		h2.sendWindow -= n
+		stream.sendWindow -= n
+		h2.mu.Unlock()
+
+		chunk := p[:n]
+		p = p[n:]
+		flags := byte(0)
+		if endStream && len(p) == 0 {
+			flags = http2FlagEndStream
+		}
+		if err := h2.writeFrame(http2FrameData, flags, stream.id, chunk); err != nil {
+			return err
+		}
+		if len(p) == 0 {
+			return nil
+		}
+	}
+}
+
+// http2Body is the request body of a stream, filled by the frame reader
+// and read by the handler
+type http2Body struct {
+	stream  *http2Stream
+	mu      sync.Mutex
+	cond    *sync.Cond
+	buf     bytes.Buffer
+	err     error
+	maxSize int64
+	read    int64
+}
+
+func newHTTP2Body(stream *http2Stream, maxSize int64) *http2Body {
+	body := &http2Body{stream: stream, maxSize: maxSize}
+	body.cond = sync.NewCond(&body.mu)
+	return body
+}
+
+func (body *http2Body) write(p []byte) {
+	body.mu.Lock()
+	defer body.mu.Unlock()
+	if body.err == nil {
+		body.buf.Write(p)
+		body.cond.Broadcast()
+	}
+}
+
+func (body *http2Body) closeWithError(err error) {
+	body.mu.Lock()
+	defer body.mu.Unlock()
+	if body.err == nil {
+		body.err = err
+		body.cond.Broadcast()
+	}
+}
+
+func (body *http2Body) Read(p []byte) (int, error) {
+	body.mu.Lock()
+	for body.buf.Len() == 0 && body.err == nil {
+		body.cond.Wait()
+	}
+	if body.buf.Len() == 0 {
+		err := body.err
+		body.mu.Unlock()
+		return 0, err
+	}
+	if body.read >= body.maxSize {
+		body.mu.Unlock()
+		return 0, errBodyTooLarge
+	}
+	p = p[:min(int64(len(p)), body.maxSize-body.read)]
+	n, _ := body.buf.Read(p)
+	body.read += int64(n)
+	body.mu.Unlock()
+
+	body.stream.conn.returnWindow(body.stream, int64(n))
+	return n, nil
+}
+
+// discard drops buffered data once the handler is done and returns its size
+func (body *http2Body) discard() int64 {
+	body.mu.Lock()
+	defer body.mu.Unlock()
+	n := int64(body.buf.Len())
+	body.buf.Reset()
+	if body.err == nil {
+		body.err = errStreamClosed
+	}
+	return n
+}
+
+// http2ResponseWriter is the ResponseWriter of a stream
+type http2ResponseWriter struct {
+	stream        *http2Stream
+	req           *Request
+	header        Header
+	status        int
+	wroteHeader   bool
+	bodyAllowed   bool
+	isHead        bool
+	endStreamSent bool
+	contentLength int64
+	written       int64
+	buf           *bufio.Writer
+}
+
+func newHTTP2ResponseWriter(stream *http2Stream, req *Request) *http2ResponseWriter {
+	res := &http2ResponseWriter{stream: stream, req: req, header: make(Header), contentLength: -1}
+	res.buf = bufio.NewWriterSize(http2DataWriter{res}, http2DefaultFrameLen)
+	return res
+}
+
+// http2DataWriter sends the buffered body of a response as DATA frames
+type http2DataWriter struct {
+	res *http2ResponseWriter
+}
+
+func (writer http2DataWriter) Write(p []byte) (int, error) {
+	if err := writer.res.stream.conn.writeData(writer.res.stream, p, false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (res *http2ResponseWriter) Header() Header {
+	return res.header
+}
+
+// WriteHeader sends the HEADERS frame. HTTP/1 connection fields are
+// dropped as HTTP/2 has no use for them.
+func (res *http2ResponseWriter) WriteHeader(code int) {
+	if res.wroteHeader {
+		return
+	}
+	res.wroteHeader = true
+	res.status = code
+
+	header := res.header
+	if !header.Has("Server") {
+		header.Set("Server", "Custom/Server")
+	}
+	res.bodyAllowed = code >= 200 && code != HTTP_NO_CONTENT && code != HTTP_NOT_MODIFIED
+	res.isHead = res.req.Method == "HEAD"
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length >= 0 {
+		res.contentLength = length
+	} else {
+		header.Del("Content-Length")
+	}
+
+	block := appendHPACKField(nil, ":status", strconv.Itoa(code))
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := strings.ToLower(key)
+		if isHTTP2ConnectionHeader(name) {
+			continue
+		}
+		for _, value := range header[key] {
+			block = appendHPACKField(block, name, http2ValueReplacer.Replace(value))
+		}
+	}
+
+	res.endStreamSent = !res.bodyAllowed || res.isHead || res.contentLength == 0
+	res.stream.conn.writeHeaders(res.stream.id, block, res.endStreamSent)
+}
+
+// http2ValueReplacer keeps line breaks out of response field values
+var http2ValueReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+func isHTTP2ConnectionHeader(name string) bool {
+	for _, connectionHeader := range http2ConnectionHeaders {
+		if name == connectionHeader {
+			return true
+		}
+	}
+	return false
+}
+
+func (res *http2ResponseWriter) Write(p []byte) (int, error) {
+	if !res.wroteHeader {
+		res.WriteHeader(HTTP_OK)
+	}
+	if !res.bodyAllowed {
+		return 0, errBodyNotAllowed
+	}
+	if res.isHead {
+		return len(p), nil
+	}
+	if res.contentLength >= 0 && res.written+int64(len(p)) > res.contentLength {
+		return 0, errTooMuchContent
+	}
+	res.written += int64(len(p))
+	return res.buf.Write(p)
+}
+
+// CloseNotify fires when the client resets the stream or the server shuts down
+func (res *http2ResponseWriter) CloseNotify() <-chan struct{} {
+	return res.stream.closed
+}
+
+// Flush sends everything written so far to the client
+func (res *http2ResponseWriter) Flush() error {
+	if !res.wroteHeader {
+		res.WriteHeader(HTTP_OK)
+	}
+	return res.buf.Flush()
+}
+
+// finish sends the rest of the body and ends the stream
+func (res *http2ResponseWriter) finish() error {
+	if !res.wroteHeader {
+		if !res.header.Has("Content-Length") {
+			res.header.Set("Content-Length", "0")
+		}
+		res.WriteHeader(HTTP_OK)
+	}
+	if err := res.buf.Flush(); err != nil {
+		return err
+	}
+	if res.endStreamSent {
+		return nil
+	}
+	res.endStreamSent = true
+	if res.contentLength >= 0 && res.written < res.contentLength {
+		res.stream.conn.resetStream(res.stream.id, http2InternalError)
+		return errStreamClosed
+	}
+	return res.stream.conn.writeData(res.stream, nil, true)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// http2Preface is what every HTTP/2 client sends before its first frame
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Frame types, RFC 9113 section 6
+const (
+	http2FrameData         = 0x0
+	http2FrameHeaders      = 0x1
+	http2FramePriority     = 0x2
+	http2FrameRSTStream    = 0x3
+	http2FrameSettings     = 0x4
+	http2FramePushPromise  = 0x5
+	http2FramePing         = 0x6
+	http2FrameGoAway       = 0x7
+	http2FrameWindowUpdate = 0x8
+	http2FrameContinuation = 0x9
+)
+
+// Frame flags, ACK shares its bit with END_STREAM
+const (
+	http2FlagEndStream  = 0x1
+	http2FlagAck        = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+)
+
+// Error codes sent in RST_STREAM and GOAWAY frames
+const (
+	http2NoError          = 0x0
+	http2ProtocolError    = 0x1
+	http2InternalError    = 0x2
+	http2FlowControlError = 0x3
+	http2StreamClosed     = 0x5
+	http2FrameSizeError   = 0x6
+	http2RefusedStream    = 0x7
+	http2Cancel           = 0x8
+	http2CompressionError = 0x9
+	http2EnhanceYourCalm  = 0xb
+	http2HTTP11Required   = 0xd
+)
+
+// Settings identifiers
+const (
+	http2SettingHeaderTableSize      = 0x1
+	http2SettingEnablePush           = 0x2
+	http2SettingMaxConcurrentStreams = 0x3
+	http2SettingInitialWindowSize    = 0x4
+	http2SettingMaxFrameSize         = 0x5
+	http2SettingMaxHeaderListSize    = 0x6
+)
+
+const (
+	http2FrameHeaderLen = 9
+	// http2DefaultWindow is the flow control window before any SETTINGS
+	http2DefaultWindow   = 65535
+	http2DefaultFrameLen = 16384
+	http2MaxFrameLen     = 1<<24 - 1
+	http2MaxWindow       = 1<<31 - 1
+)
+
+type http2Frame struct {
+	typ      byte
+	flags    byte
+	streamID uint32
+	payload  []byte
+}
+
+// http2Error is a connection error when streamID is 0 and a stream error otherwise
+type http2Error struct {
+	code     uint32
+	streamID uint32
+	reason   string
+}
+
+func (err *http2Error) Error() string {
+	return fmt.Sprintf("http2: stream %d error %d: %s", err.streamID, err.code, err.reason)
+}
+
+func http2ConnError(code uint32, reason string) *http2Error {
+	return &http2Error{code: code, reason: reason}
+}
+
+func http2StreamError(streamID uint32, code uint32, reason string) *http2Error {
+	return &http2Error{code: code, streamID: streamID, reason: reason}
+}
+
+// readHTTP2Frame reads the next frame, payloads above maxLen are a FRAME_SIZE_ERROR
+func readHTTP2Frame(r io.Reader, maxLen uint32) (http2Frame, error) {
+	var header [http2FrameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return http2Frame{}, err
+	}
+	length := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	frame := http2Frame{
+		typ:      header[3],
+		flags:    header[4],
+		streamID: binary.BigEndian.Uint32(header[5:]) & (1<<31 - 1),
+	}
+	if length > maxLen {
+		return frame, http2ConnError(http2FrameSizeError, "frame too large")
+	}
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, frame.payload); err != nil {
+		return frame, err
+	}
+	return frame, nil
+}
+
+func writeHTTP2Frame(w io.Writer, typ byte, flags byte, streamID uint32, payload []byte) error {
+	header := [http2FrameHeaderLen]byte{
+		byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)),
+		typ, flags,
+	}
+	binary.BigEndian.PutUint32(header[5:], streamID)
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// stripPadding removes the padding of PADDED DATA and HEADERS frames
+func (frame *http2Frame) stripPadding() error {
+	if frame.flags&http2FlagPadded == 0 {
+		return nil
+	}
+	if len(frame.payload) == 0 {
+		return http2ConnError(http2ProtocolError, "missing pad length")
+	}
+	padLen := int(frame.payload[0])
+	if padLen >= len(frame.payload) {
+		return http2ConnError(http2ProtocolError, "padding exceeds payload")
+	}
+	frame.payload = frame.payload[1 : len(frame.payload)-padLen]
+	return nil
+}
+
+type http2Setting struct {
+	id    uint16
+	value uint32
+}
+
+func encodeHTTP2Settings(settings []http2Setting) []byte {
+	payload := make([]byte, 0, 6*len(settings))
+	for _, setting := range settings {
+		payload = binary.BigEndian.AppendUint16(payload, setting.id)
+		payload = binary.BigEndian.AppendUint32(payload, setting.value)
+	}
+	return payload
+}
+
+func decodeHTTP2Settings(payload []byte) ([]http2Setting, error) {
+	if len(payload)%6 != 0 {
+		return nil, http2ConnError(http2FrameSizeError, "settings length")
+	}
+	var settings []http2Setting
+	for i := 0; i < len(payload); i += 6 {
+		settings = append(settings, http2Setting{
+			id:    binary.BigEndian.Uint16(payload[i:]),
+			value: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings, nil
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// http2TestClient speaks HTTP/2 frame by frame over a cleartext connection
+type http2TestClient struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	decoder *hpackDecoder
+}
+
+// http2TestResponse collects the frames the server sent for one stream
+type http2TestResponse struct {
+	status  string
+	header  map[string]string
+	body    []byte
+	reset   bool
+	goAway  bool
+	lastID  uint32
+	endSeen bool
+}
+
+func dialHTTP2(t *testing.T, addr string) *http2TestClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	client := &http2TestClient{conn: conn, br: bufio.NewReader(conn), decoder: newHPACKDecoder(4096, 1<<20)}
+	io.WriteString(conn, http2Preface)
+	writeHTTP2Frame(conn, http2FrameSettings, 0, 0, nil)
+	return client
+}
+
+func (client *http2TestClient) request(id uint32, method string, path string, authority string, endStream bool) {
+	block := appendHPACKField(nil, ":method", method)
+	block = appendHPACKField(block, ":scheme", "http")
+	block = appendHPACKField(block, ":path", path)
+	block = appendHPACKField(block, ":authority", authority)
+	flags := byte(http2FlagEndHeaders)
+	if endStream {
+		flags |= http2FlagEndStream
+	}
+	writeHTTP2Frame(client.conn, http2FrameHeaders, flags, id, block)
+}
+
+// read collects frames until the stream ends, is reset or the
+// connection is closed
+func (client *http2TestClient) read(t *testing.T, id uint32) *http2TestResponse {
+	res := &http2TestResponse{header: make(map[string]string)}
+	for !res.endSeen && !res.reset {
+		frame, err := readHTTP2Frame(client.br, http2MaxFrameLen)
+		if err != nil {
+			return res
+		}
+		switch frame.typ {
+		case http2FrameSettings:
+			if frame.flags&http2FlagAck == 0 {
+				writeHTTP2Frame(client.conn, http2FrameSettings, http2FlagAck, 0, nil)
+			}
+		case http2FrameGoAway:
+			res.goAway = true
+			res.lastID = binary.BigEndian.Uint32(frame.payload)
+		case http2FrameHeaders:
+			fields, err := client.decoder.decode(frame.payload)
+			if err != nil {
+				t.Fatalf(`Failed to decode response headers %s`, err)
+			}
+			if frame.streamID == id {
+				for _, field := range fields {
+					if field.name == ":status" {
+						res.status = field.value
+					} else {
+						res.header[field.name] = field.value
+					}
+				}
+				res.endSeen = frame.flags&http2FlagEndStream != 0
+			}
+		case http2FrameData:
+			if frame.streamID == id {
+				res.body = append(res.body, frame.payload...)
+				res.endSeen = frame.flags&http2FlagEndStream != 0
+			}
+		case http2FrameRSTStream:
+			res.reset = frame.streamID == id
+		}
+	}
+	return res
+}
+
+func http2TestTransport() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		},
+		Timeout: 10 * time.Second,
+	}
+}
+
+func TestHTTP2OverTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "a.test")
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+
+	// Every request waits until all of them arrived, which only works when
+	// they are served side by side
+	const parallel = 5
+	var arrived sync.WaitGroup
+	arrived.Add(parallel)
+	server.HandleFunc("GET", "/users/:id", func(w ResponseWriter, req *Request) {
+		arrived.Done()
+		arrived.Wait()
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(fmt.Sprintf("user %s over %s from %s", req.Param("id"), req.Proto, req.RemoteAddr)))
+	})
+	addr := runTLSServer(t, &server, [2]string{certFile, keyFile})
+
+	client := http2TestTransport()
+	bodies := make([]string, parallel)
+	var wg sync.WaitGroup
+	for i := range parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(fmt.Sprintf("https://%s/users/%d", addr, i))
+			if err != nil {
+				t.Errorf(`Failed HTTP/2 request %s`, err)
+				return
+			}
+			defer res.Body.Close()
+			content, _ := io.ReadAll(res.Body)
+			if res.ProtoMajor != 2 || res.StatusCode != HTTP_OK || res.Header.Get("Content-Type") != "text/plain" || res.Header.Get("Server") != "Custom/Server" {
+				t.Errorf(`Wrong HTTP/2 response got: %s %d %v`, res.Proto, res.StatusCode, res.Header)
+			}
+			bodies[i] = string(content)
+		}()
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	remoteAddr := ""
+	for i, body := range bodies {
+		prefix := fmt.Sprintf("user %d over HTTP/2.0 from ", i)
+		if !strings.HasPrefix(body, prefix) {
+			t.Fatalf(`Wrong body got: %q`, body)
+		}
+		if remoteAddr != "" && body[len(prefix):] != remoteAddr {
+			t.Fatalf(`Requests were not multiplexed on one connection got: %q and %q`, remoteAddr, body[len(prefix):])
+		}
+		remoteAddr = body[len(prefix):]
+	}
+
+	res, err := client.Get(fmt.Sprintf("https://%s/missing", addr))
+	if err != nil {
+		t.Fatalf(`Failed HTTP/2 request %s`, err)
+	}
+	res.Body.Close()
+	if res.StatusCode != HTTP_NOT_FOUND {
+		t.Fatalf(`Expected 404 got: %d`, res.StatusCode)
+	}
+}
+
+func TestHTTP2LargeBodies(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "a.test")
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetMaxBodyBytes(8 << 20)
+	server.HandleFunc("POST", "/echo", func(w ResponseWriter, req *Request) {
+		content, err := io.ReadAll(req.Body)
+		if err != nil {
+			sendStatus(w, HTTP_BAD_REQUEST)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write(content)
+	})
+	addr := runTLSServer(t, &server, [2]string{certFile, keyFile})
+
+	// Both directions go well past the initial flow control windows
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 3<<16)
+	res, err := http2TestTransport().Post(fmt.Sprintf("https://%s/echo", addr), "application/octet-stream", bytes.NewReader(payload))
+	if err != nil {
+		t.Fatalf(`Failed HTTP/2 request %s`, err)
+	}
+	defer res.Body.Close()
+	content, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf(`Failed to read response body %s`, err)
+	}
+	if res.ProtoMajor != 2 || res.StatusCode != HTTP_OK || !bytes.Equal(content, payload) {
+		t.Fatalf(`Wrong echo got: %s %d with %d bytes`, res.Proto, res.StatusCode, len(content))
+	}
+}
+
+func TestHTTP2Disabled(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "a.test")
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetHTTP2(false)
+	server.HandleFunc("GET", "/", func(w ResponseWriter, req *Request) {
+		w.Write([]byte(req.Proto))
+	})
+	addr := runTLSServer(t, &server, [2]string{certFile, keyFile})
+
+	res, err := http2TestTransport().Get(fmt.Sprintf("https://%s/", addr))
+	if err != nil {
+		t.Fatalf(`Failed request %s`, err)
+	}
+	defer res.Body.Close()
+	content, _ := io.ReadAll(res.Body)
+	if res.ProtoMajor != 1 || string(content) != "HTTP/1.1" {
+		t.Fatalf(`Expected HTTP/1.1 got: %s %q`, res.Proto, content)
+	}
+}
+
+func TestHTTP2PriorKnowledge(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	server.HandleFunc("GET", "/hello", func(w ResponseWriter, req *Request) {
+		w.Header().Set("X-Proto", req.Proto)
+		w.Write([]byte("hello " + req.Host))
+	})
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	client := dialHTTP2(t, addr)
+	defer client.conn.Close()
+
+	client.request(1, "GET", "/hello", addr, true)
+	res := client.read(t, 1)
+	if res.status != "200" || string(res.body) != "hello "+addr || res.header["x-proto"] != "HTTP/2.0" {
+		t.Fatalf(`Wrong prior knowledge response got: %s %q %v`, res.status, res.body, res.header)
+	}
+
+	client.request(3, "HEAD", "/hello", addr, true)
+	res = client.read(t, 3)
+	if res.status != "200" || len(res.body) != 0 || !res.endSeen {
+		t.Fatalf(`Wrong HEAD response got: %s %q`, res.status, res.body)
+	}
+
+	client.request(5, "BREW", "/hello", addr, true)
+	if res = client.read(t, 5); res.status != "400" {
+		t.Fatalf(`Expected 400 for unknown method got: %s`, res.status)
+	}
+
+	// Connection specific header fields make the request malformed
+	block := appendHPACKField(nil, ":method", "GET")
+	block = appendHPACKField(block, ":scheme", "http")
+	block = appendHPACKField(block, ":path", "/hello")
+	block = appendHPACKField(block, "connection", "keep-alive")
+	writeHTTP2Frame(client.conn, http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 7, block)
+	if res = client.read(t, 7); !res.reset {
+		t.Fatalf(`Expected malformed request to be reset got: %s`, res.status)
+	}
+
+	// HTTP/1.1 keeps working on the same listener
+	res1, _ := sendRequestTo(t, addr, fmt.Sprintf("GET /hello HTTP/1.1\r\nHost: %s\r\n\r\n", addr))
+	if res1.StatusCode != HTTP_OK || res1.Header.Get("X-Proto") != "HTTP/1.1" {
+		t.Fatalf(`Wrong HTTP/1.1 response got: %d %s`, res1.StatusCode, res1.Header.Get("X-Proto"))
+	}
+}
+
+func TestH2CUpgrade(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	server.HandleFunc("GET", "/hello", func(w ResponseWriter, req *Request) {
+		w.Write([]byte("hello over " + req.Proto))
+	})
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	settings := base64.RawURLEncoding.EncodeToString(encodeHTTP2Settings([]http2Setting{{http2SettingInitialWindowSize, 1 << 16}}))
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", "/hello")
+	rt += fmt.Sprintf("Host: %v\r\n", addr)
+	rt += fmt.Sprintf("Connection: Upgrade, HTTP2-Settings\r\n")
+	rt += fmt.Sprintf("Upgrade: h2c\r\n")
+	rt += fmt.Sprintf("HTTP2-Settings: %v\r\n", settings)
+	rt += fmt.Sprintf("\r\n")
+	conn.Write([]byte(rt))
+
+	client := &http2TestClient{conn: conn, br: bufio.NewReader(conn), decoder: newHPACKDecoder(4096, 1<<20)}
+	res, err := http.ReadResponse(client.br, nil)
+	if err != nil {
+		t.Fatalf(`Failed to read upgrade response %s`, err)
+	}
+	if res.StatusCode != HTTP_SWITCHING_PROTOCOLS || res.Header.Get("Upgrade") != "h2c" {
+		t.Fatalf(`Expected 101 got: %d %v`, res.StatusCode, res.Header)
+	}
+
+	io.WriteString(conn, http2Preface)
+	writeHTTP2Frame(conn, http2FrameSettings, 0, 0, nil)
+	// The upgraded request is answered on stream 1
+	h2Res := client.read(t, 1)
+	if h2Res.status != "200" || string(h2Res.body) != "hello over HTTP/2.0" {
+		t.Fatalf(`Wrong upgraded response got: %s %q`, h2Res.status, h2Res.body)
+	}
+
+	client.request(3, "GET", "/hello", addr, true)
+	if h2Res = client.read(t, 3); h2Res.status != "200" {
+		t.Fatalf(`Wrong response after upgrade got: %s`, h2Res.status)
+	}
+}
+
+func TestHTTP2ShutdownSendsGoAway(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	started := make(chan struct{})
+	server.HandleFunc("GET", "/slow", func(w ResponseWriter, req *Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("finished"))
+	})
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	client := dialHTTP2(t, addr)
+	defer client.conn.Close()
+	client.request(1, "GET", "/slow", addr, true)
+	<-started
+
+	shutdownDone := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, err := server.Shutdown(ctx)
+		shutdownDone <- err
+	}()
+
+	// The running stream completes after the GOAWAY
+	res := client.read(t, 1)
+	if !res.goAway || res.lastID != 1 {
+		t.Fatalf(`Expected GOAWAY with last stream 1 got: %v %d`, res.goAway, res.lastID)
+	}
+	if res.status != "200" || string(res.body) != "finished" {
+		t.Fatalf(`Active stream was not completed got: %s %q`, res.status, res.body)
+	}
+	if err := <-shutdownDone; err != nil {
+		t.Fatalf(`Shutdown did not drain got: %s`, err)
+	}
+	if _, err := readHTTP2Frame(client.br, http2MaxFrameLen); err == nil {
+		t.Fatalf(`Expected the connection to be closed after draining`)
+	}
+}
+
+func TestHTTP2EndStreamWithNegativeWindow(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	finish := make(chan struct{})
+	server.HandleFunc("GET", "/window", func(w ResponseWriter, req *Request) {
+		w.Write(make([]byte, 65535))
+		w.(Flusher).Flush()
+		<-finish
+	})
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	client := dialHTTP2(t, addr)
+	defer client.conn.Close()
+	client.request(1, "GET", "/window", addr, true)
+
+	// Wait for the whole initial window, then shrink it below what was sent
+	received, settingsAcked := 0, false
+	for received < 65535 || !settingsAcked {
+		frame, err := readHTTP2Frame(client.br, http2MaxFrameLen)
+		if err != nil {
+			t.Fatalf(`Failed to read frame %s`, err)
+		}
+		switch {
+		case frame.typ == http2FrameData:
+			received += len(frame.payload)
+			if received == 65535 {
+				settings := binary.BigEndian.AppendUint16(nil, http2SettingInitialWindowSize)
+				writeHTTP2Frame(client.conn, http2FrameSettings, 0, 0, binary.BigEndian.AppendUint32(settings, 0))
+			}
+		case frame.typ == http2FrameSettings && frame.flags&http2FlagAck == 0:
+			writeHTTP2Frame(client.conn, http2FrameSettings, http2FlagAck, 0, nil)
+		case frame.typ == http2FrameSettings && received == 65535:
+			settingsAcked = true
+		}
+	}
+	close(finish)
+
+	// The empty frame ending the stream needs no window
+	res := client.read(t, 1)
+	if res.reset || !res.endSeen || len(res.body) != 0 {
+		t.Fatalf(`Expected the stream to end cleanly got: reset %v end %v %d bytes`, res.reset, res.endSeen, len(res.body))
+	}
+}
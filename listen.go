@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// unixScheme prefixes listen addresses that are Unix socket paths
+const unixScheme = "unix:"
+
+// listener is a bound listen address. host keeps the host part as it
+// was configured so a name like localhost is still accepted in Host.
+type listener struct {
+	net.Listener
+	host string
+	// handler serves the requests of this listener instead of the server
+	handler Handler
+}
+
+// SetListenAddrs replaces the host and port given to CreateServer with one
+// or more "host:port" addresses. IPv6 literals go in brackets as in
+// "[::1]:8080", "[::]" binds every interface on both IPv4 and IPv6 and
+// port 0 lets the system pick a free port, reported by Addrs.
+// "unix:/run/app.sock" listens on a Unix domain socket instead.
+func (server *Server) SetListenAddrs(addrs ...string) {
+	server.listenAddrs = addrs
+}
+
+// SetUnixSocketMode sets the permissions of Unix sockets created by Listen
+func (server *Server) SetUnixSocketMode(mode os.FileMode) {
+	server.unixSocketMode = mode
+}
+
+// ListenUnix serves connections on the Unix socket at path until Shutdown
+func (server *Server) ListenUnix(path string) error {
+	server.SetListenAddrs(unixScheme + path)
+	return server.Listen()
+}
+
+// Addrs returns the addresses the server is bound to once it is ready
+func (server *Server) Addrs() []net.Addr {
+	return server.tracker.addrs()
+}
+
+// bindAddrs returns the configured listen addresses
+func (server *Server) bindAddrs() []string {
+	if len(server.listenAddrs) > 0 {
+		return server.listenAddrs
+	}
+	// Brackets are optional for an IPv6 host passed to CreateServer
+	host := strings.TrimSuffix(strings.TrimPrefix(server.host, "["), "]")
+	return []string{net.JoinHostPort(host, server.port)}
+}
+
+// Listen binds every listen address and serves connections until Shutdown.
+// Either all addresses are bound or none, the first failure is returned.
+func (server *Server) Listen() error {
+	if err := server.LoadTemplates(); err != nil {
+		fmt.Println("Couldn't parse templates", err)
+		return err
+	}
+	tlsConfig, err := server.listenTLSConfig()
+	if err != nil {
+		fmt.Println("Couldn't set up TLS", err)
+		return err
+	}
+
+	var listeners []*listener
+	failed := func(addr string, err error) error {
+		fmt.Printf("Couldn't listen on %s %s\n", addr, err)
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		return err
+	}
+
+	tlsPort := 0
+	for _, addr := range server.bindAddrs() {
+		ln, err := server.bind(addr)
+		if err != nil {
+			return failed(addr, err)
+		}
+		if tlsConfig != nil {
+			if tcpAddr, ok := ln.Addr().(*net.TCPAddr); ok && tlsPort == 0 {
+				tlsPort = tcpAddr.Port
+			}
+			ln.Listener = tls.NewListener(ln.Listener, tlsConfig)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	if tlsConfig != nil && server.redirectAddr != "" {
+		ln, err := server.bind(server.redirectAddr)
+		if err != nil {
+			return failed(server.redirectAddr, err)
+		}
+		ln.handler = redirectHandler(tlsPort)
+		if server.acme != nil {
+			ln.handler = server.acme.httpChallengeHandler(ln.handler)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	defer func() {
+		if server.debug {
+			fmt.Println("Closing down server")
+		}
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+
+	for _, ln := range listeners {
+		if !server.tracker.addListener(ln) {
+			return nil
+		}
+	}
+
+	close(server.readyChan)
+
+	if server.debug {
+		go server.templates.poll(server.shutdownChan, server.debug)
+	}
+
+	if tlsConfig != nil {
+		go server.certs.poll(server.shutdownChan, server.debug)
+		if server.acme != nil {
+			go server.acme.renewLoop(server.shutdownChan)
+		}
+	}
+
+	for _, ln := range listeners {
+		fmt.Printf("Accepting connections on %s\n", ln.Addr())
+		go server.acceptLoop(ln)
+	}
+
+	<-server.shutdownChan
+	return nil
+}
+
+// bind opens the listener for a single listen address
+func (server *Server) bind(addr string) (*listener, error) {
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		ln, err := listenUnix(path, server.unixSocketMode)
+		if err != nil {
+			return nil, err
+		}
+		return &listener{Listener: ln}, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{Listener: ln, host: host}, nil
+}
+
+// listenUnix creates the socket at path with mode. A socket file left
+// behind by a server that didn't shut down cleanly is removed first,
+// one that still accepts connections belongs to a running server.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("socket %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// acceptLoop hands each connection accepted on ln to its own goroutine
+func (server *Server) acceptLoop(ln *listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !server.tracker.isShuttingDown() {
+				fmt.Println("Error accepting connection:", err)
+			}
+			return
+		}
+		if !server.tracker.add(conn, server.wg) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer server.wg.Done()
+			server.handleConnection(conn, ln.handler)
+		}()
+	}
+}
+
+// isValidHost checks the Host header names one of the addresses the server
+// listens on. Listeners bound to an unspecified address such as 0.0.0.0
+// can be reached under any name, so only the port is compared for them.
+// Over TLS the names of the server's certificates are accepted as well.
+// Without a port the default port 80, or 443 over TLS, is assumed. Requests over a Unix
+// socket come through a local proxy and keep the client's Host, so any
+// name is accepted there.
+func (server *Server) isValidHost(conn net.Conn, host string) bool {
+	if conn.LocalAddr().Network() == "unix" {
+		return true
+	}
+
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), "80"
+		if _, ok := conn.(*tls.Conn); ok {
+			port = "443"
+		}
+	}
+
+	for _, ln := range server.tracker.listenerList() {
+		addr, ok := ln.Addr().(*net.TCPAddr)
+		if !ok || fmt.Sprint(addr.Port) != port {
+			continue
+		}
+		if ip := net.ParseIP(ln.host); ln.host == "" || (ip != nil && ip.IsUnspecified()) {
+			return true
+		}
+		if strings.EqualFold(name, ln.host) {
+			return true
+		}
+		if tlsConn, ok := conn.(*tls.Conn); ok && server.certificateCovers(tlsConn, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func getRequestWithHost(host string) string {
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", "/")
+	rt += fmt.Sprintf("Host: %v\r\n", host)
+	rt += fmt.Sprintf("Connection: close\r\n")
+	rt += fmt.Sprintf("\r\n")
+	return rt
+}
+
+func TestListenOnPickedPort(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	runServer(t, &server)
+
+	addrs := server.Addrs()
+	if len(addrs) != 1 {
+		t.Fatalf(`Expected one bound address got: %v`, addrs)
+	}
+	addr := addrs[0].(*net.TCPAddr)
+	if addr.Port == 0 || !addr.IP.IsLoopback() {
+		t.Fatalf(`Wrong bound address got: %v`, addr)
+	}
+
+	res, _ := sendRequestTo(t, addr.String(), getRequestWithHost(addr.String()))
+	if res.StatusCode != HTTP_OK {
+		t.Fatalf(`Wrong status got: %d`, res.StatusCode)
+	}
+	res, _ = sendRequestTo(t, addr.String(), getRequestWithHost("127.0.0.1:1337"))
+	if res.StatusCode != HTTP_BAD_REQUEST {
+		t.Fatalf(`Expected Host with the wrong port to be rejected got: %d`, res.StatusCode)
+	}
+}
+
+func TestListenOnMultipleAddrs(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0", "localhost:0")
+	runServer(t, &server)
+
+	addrs := server.Addrs()
+	if len(addrs) != 2 {
+		t.Fatalf(`Expected two bound addresses got: %v`, addrs)
+	}
+
+	res, _ := sendRequestTo(t, addrs[0].String(), getRequestWithHost(addrs[0].String()))
+	if res.StatusCode != HTTP_OK {
+		t.Fatalf(`Wrong status on the first address got: %d`, res.StatusCode)
+	}
+	port := addrs[1].(*net.TCPAddr).Port
+	res, _ = sendRequestTo(t, addrs[1].String(), getRequestWithHost(fmt.Sprintf("LocalHost:%d", port)))
+	if res.StatusCode != HTTP_OK {
+		t.Fatalf(`Wrong status for the configured host name got: %d`, res.StatusCode)
+	}
+}
+
+func TestListenFailsOnBadAddr(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0", "127.0.0.1")
+
+	if err := server.Listen(); err == nil {
+		t.Fatalf(`Expected address without a port to fail`)
+	}
+	if len(server.Addrs()) != 0 {
+		t.Fatalf(`Expected no address to stay bound got: %v`, server.Addrs())
+	}
+}
+
+func TestListenOnIPv6(t *testing.T) {
+	ln, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback is not available")
+	}
+	ln.Close()
+
+	server, cleanup := CreateServer("::1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	runServer(t, &server)
+
+	addr := server.Addrs()[0].String()
+	res, _ := sendRequestTo(t, addr, getRequestWithHost(addr))
+	if res.StatusCode != HTTP_OK {
+		t.Fatalf(`Wrong status over IPv6 got: %d`, res.StatusCode)
+	}
+}
+
+func TestUnspecifiedAddrAcceptsAnyHost(t *testing.T) {
+	server, cleanup := CreateServer("0.0.0.0", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	runServer(t, &server)
+
+	port := server.Addrs()[0].(*net.TCPAddr).Port
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	res, _ := sendRequestTo(t, addr, getRequestWithHost(fmt.Sprintf("example.com:%d", port)))
+	if res.StatusCode != HTTP_OK {
+		t.Fatalf(`Expected any host name to be accepted got: %d`, res.StatusCode)
+	}
+	res, _ = sendRequestTo(t, addr, getRequestWithHost("example.com:1"))
+	if res.StatusCode != HTTP_BAD_REQUEST {
+		t.Fatalf(`Expected Host with the wrong port to be rejected got: %d`, res.StatusCode)
+	}
+}
+
+func TestListenOnUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "server.sock")
+	// A socket file left behind by a crashed server
+	stale, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Skipf("Unix sockets are not available %s", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	server.SetUnixSocketMode(0600)
+	server.SetListenAddrs(unixScheme + socketPath)
+	runServer(t, &server)
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf(`Socket was not created %s`, err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf(`Wrong socket permissions got: %v`, info.Mode().Perm())
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(getRequestWithHost("app.example.com")))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf(`Failed to read response %s`, err)
+	}
+	if res.StatusCode != HTTP_OK {
+		t.Fatalf(`Expected any Host over a Unix socket got: %d`, res.StatusCode)
+	}
+
+	second, cleanupSecond := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanupSecond()
+	if err := second.ListenUnix(socketPath); err == nil {
+		t.Fatalf(`Expected a socket in use to be refused`)
+	}
+}
+
+func TestListenUnixRefusesRegularFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "server.sock")
+	if err := os.WriteFile(filePath, nil, 0644); err != nil {
+		t.Fatalf(`Failed to create file %s`, err)
+	}
+
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	if err := server.ListenUnix(filePath); err == nil {
+		t.Fatalf(`Expected a regular file not to be replaced`)
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		t.Fatalf(`File was removed %s`, err)
+	}
+}
@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -13,17 +22,46 @@ const (
 	POST
 	PUT
 	DELETE
+	PATCH
+	HEAD
+	OPTIONS
 )
 
+// methodNames is indexed by the method constants above
+var methodNames = []string{"GET", "POST", "PUT", "DELETE", "PATCH", "HEAD", "OPTIONS"}
+
 type Server struct {
 	host          string
 	port          string
 	templatesPath string
+	templates     *templateSet
 	paths         map[string][]Path
-	readyChan     chan struct{}
-	shutdownChan  chan struct{}
-	debug         bool
-	// wg            *sync.WaitGroup
+	router        *router
+	limits        requestLimits
+	readTimeout   time.Duration
+	idleTimeout   time.Duration
+	// maxRequestsPerConn closes connections after that many requests, 0 is no limit
+	maxRequestsPerConn int
+	readyChan          chan struct{}
+	shutdownChan       chan struct{}
+	// listenAddrs overrides host and port, see SetListenAddrs
+	listenAddrs    []string
+	unixSocketMode os.FileMode
+	// tlsConfig enables HTTPS when set, redirectAddr listens for HTTP to redirect
+	tlsConfig    *tls.Config
+	redirectAddr string
+	certs        *certStore
+	acme         *acmeManager
+	// http2 serves HTTP/2 next to HTTP/1.1, see SetHTTP2
+	http2 bool
+	// webSocketReadLimit is the largest WebSocket message a client may send
+	webSocketReadLimit int64
+	// dirListing lists directories without an index.html, see ServeDir
+	dirListing bool
+	debug      bool
+	// wg counts the goroutines serving connections, tracker knows their state
+	wg      *sync.WaitGroup
+	tracker *connTracker
 }
 
 type Path struct {
@@ -42,166 +80,381 @@ type Payload struct {
 
 // HTTP response codes as int values
 const (
-	HTTP_OK                    = 200
-	HTTP_ACCEPTED              = 202
-	HTTP_BAD_REQUEST           = 400
-	HTTP_UNAUTHORIZED          = 401
-	HTTP_FORBIDDEN             = 403
-	HTTP_NOT_FOUND             = 404
-	HTTP_GONE                  = 410
-	HTTP_INTERNAL_SERVER_ERROR = 500
+	HTTP_SWITCHING_PROTOCOLS             = 101
+	HTTP_OK                              = 200
+	HTTP_ACCEPTED                        = 202
+	HTTP_NO_CONTENT                      = 204
+	HTTP_PARTIAL_CONTENT                 = 206
+	HTTP_NOT_MODIFIED                    = 304
+	HTTP_PERMANENT_REDIRECT              = 308
+	HTTP_BAD_REQUEST                     = 400
+	HTTP_UNAUTHORIZED                    = 401
+	HTTP_FORBIDDEN                       = 403
+	HTTP_NOT_FOUND                       = 404
+	HTTP_METHOD_NOT_ALLOWED              = 405
+	HTTP_GONE                            = 410
+	HTTP_PRECONDITION_FAILED             = 412
+	HTTP_CONTENT_TOO_LARGE               = 413
+	HTTP_URI_TOO_LONG                    = 414
+	HTTP_RANGE_NOT_SATISFIABLE           = 416
+	HTTP_UPGRADE_REQUIRED                = 426
+	HTTP_REQUEST_HEADER_FIELDS_TOO_LARGE = 431
+	HTTP_INTERNAL_SERVER_ERROR           = 500
+	HTTP_NOT_IMPLEMENTED                 = 501
+	HTTP_VERSION_NOT_SUPPORTED           = 505
 )
 
-func (server *Server) Listen() error {
-	server.host = "127.0.0.1"
-	ln, err := net.Listen("tcp", server.host+":"+server.port)
-
-	defer func() {
-		if ln != nil {
-			if server.debug {
-				fmt.Println("Closing down server")
-			}
-			ln.Close()
-		}
-	}()
-
-	if err != nil {
-		fmt.Printf("Couldn't listen to port %s %s", server.port, err)
-		return err
+// statusText returns the reason phrase sent after code in the status line
+func statusText(code int) string {
+	switch code {
+	case HTTP_SWITCHING_PROTOCOLS:
+		return "SWITCHING PROTOCOLS"
+	case HTTP_OK:
+		return "OK"
+	case HTTP_ACCEPTED:
+		return "ACCEPTED"
+	case HTTP_NO_CONTENT:
+		return "NO CONTENT"
+	case HTTP_PARTIAL_CONTENT:
+		return "PARTIAL CONTENT"
+	case HTTP_NOT_MODIFIED:
+		return "NOT MODIFIED"
+	case HTTP_PERMANENT_REDIRECT:
+		return "PERMANENT REDIRECT"
+	case HTTP_BAD_REQUEST:
+		return "BAD REQUEST"
+	case HTTP_UNAUTHORIZED:
+		return "UNAUTHORIZED"
+	case HTTP_FORBIDDEN:
+		return "FORBIDDEN"
+	case HTTP_NOT_FOUND:
+		return "NOT FOUND"
+	case HTTP_METHOD_NOT_ALLOWED:
+		return "METHOD NOT ALLOWED"
+	case HTTP_GONE:
+		return "GONE"
+	case HTTP_PRECONDITION_FAILED:
+		return "PRECONDITION FAILED"
+	case HTTP_CONTENT_TOO_LARGE:
+		return "CONTENT TOO LARGE"
+	case HTTP_URI_TOO_LONG:
+		return "URI TOO LONG"
+	case HTTP_RANGE_NOT_SATISFIABLE:
+		return "RANGE NOT SATISFIABLE"
+	case HTTP_UPGRADE_REQUIRED:
+		return "UPGRADE REQUIRED"
+	case HTTP_REQUEST_HEADER_FIELDS_TOO_LARGE:
+		return "REQUEST HEADER FIELDS TOO LARGE"
+	case HTTP_INTERNAL_SERVER_ERROR:
+		return "INTERNAL SERVER ERROR"
+	case HTTP_NOT_IMPLEMENTED:
+		return "NOT IMPLEMENTED"
+	case HTTP_VERSION_NOT_SUPPORTED:
+		return "HTTP VERSION NOT SUPPORTED"
 	}
+	return "SERVER ERROR"
+}
 
-	close(server.readyChan)
+func main() {
+	server, _ := CreateDefaultServer()
 
-	fmt.Printf("Accepting connections on %s:%s\n", server.host, server.port)
+	// Listen returns as soon as shutdown starts, wait for the drain to finish
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if cut, err := server.Shutdown(ctx); err != nil {
+			fmt.Printf("Forced shutdown, cut off %d requests\n", cut)
+		}
+	}()
 
+	// SIGHUP reloads the certificates added with AddReloadableCertificate
 	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				fmt.Println("Error accepting connection:", err)
-				break
-			}
-			go server.handleConnection(conn)
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		for range reload {
+			server.ReloadCertificates()
 		}
 	}()
 
-	<-server.shutdownChan
-	return nil
+	if err := server.Listen(); err != nil {
+		os.Exit(1)
+	}
+	<-drained
 }
 
-func (server *Server) handleConnection(conn net.Conn) {
+// handleConnection serves requests from conn one after another until the
+// client or server asks to close it. Pipelined requests wait in the
+// buffered reader, so responses always go out in request order.
+// handler replaces the server's routes when it is not nil.
+func (server *Server) handleConnection(conn net.Conn, handler Handler) {
 	defer func() {
 		if server.debug {
 			fmt.Println("Closing the connection server-side")
 		}
+		server.tracker.remove(conn)
 		conn.Close()
 	}()
 	if server.debug {
 		fmt.Println("New connection.")
 	}
 
-	buff := make([]byte, 32768)
-	conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-	_, err := conn.Read(buff)
+	reader := &connReader{conn: conn}
+	br := bufio.NewReader(reader)
 
-	if err != nil {
-		if err.Error() == "EOF" {
-			fmt.Println("Closing connection, got no response to read. Error:", err)
+	// HTTPS clients pick HTTP/2 during the handshake
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if isTLS {
+		conn.SetReadDeadline(time.Now().Add(server.readTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			if server.debug {
+				fmt.Println("TLS handshake failed:", err)
+			}
+			return
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol == "h2" && server.http2 {
+			server.serveHTTP2(conn, br, nil, nil)
 			return
 		}
-		fmt.Println("Error reading response:", err)
-		panic("Couldn't read response.")
 	}
 
-	getString := fmt.Sprintf("GET")
-	postString := fmt.Sprintf("POST")
-	httpString := fmt.Sprintf("HTTP/1.")
-	hostString := fmt.Sprintf("Host: %s:%s", server.host, server.port)
-	reqString := string(buff[:])
+	for served := 0; ; served++ {
+		// Idle connections are closed right away once shutdown started
+		if !server.tracker.setActive(conn, false) {
+			return
+		}
 
-	if server.debug {
-		fmt.Println("Got request:", reqString)
-	}
+		// Between requests the client may stay idle for idleTimeout,
+		// once it starts one the header section has to arrive within readTimeout
+		reader.timeout = 0
+		if served > 0 {
+			conn.SetReadDeadline(time.Now().Add(server.idleTimeout))
+			if _, err := br.Peek(1); err != nil {
+				return
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(server.readTimeout))
+		if served == 0 && !isTLS && server.http2 && handler == nil && hasHTTP2Preface(br) {
+			server.serveHTTP2(conn, br, nil, nil)
+			return
+		}
+		req, err := readRequest(br, server.limits)
 
-	responseCode := HTTP_BAD_REQUEST
-	responseString := "BAD REQUEST"
+		if err != nil {
+			if server.tracker.isShuttingDown() {
+				return
+			}
+			var reqErr *requestError
+			if errors.As(err, &reqErr) {
+				if server.debug {
+					fmt.Println("Bad request:", reqErr)
+				}
+				server.writeError(conn, reqErr.code)
+				return
+			}
+			if err == io.EOF {
+				if served == 0 {
+					fmt.Println("Closing connection, got no response to read. Error:", err)
+				}
+				return
+			}
+			fmt.Println("Error reading request:", err)
+			return
+		}
 
-	if (strings.Contains(reqString, getString) || strings.Contains(reqString, postString)) &&
-		strings.Contains(reqString, hostString) && strings.Contains(reqString, httpString) {
-		responseCode = HTTP_OK
-		responseString = "OK"
-	}
+		if !isTLS && server.http2 && handler == nil {
+			if settings, ok := h2cUpgradeSettings(req); ok {
+				server.upgradeHTTP2(conn, br, req, settings)
+				return
+			}
+		}
+
+		server.tracker.setActive(conn, true)
+		// Body reads only fail when the client stalls for longer than readTimeout
+		reader.timeout = server.readTimeout
+		req.RemoteAddr = conn.RemoteAddr().String()
+		req.conn = conn
+		if isTLS {
+			state := tlsConn.ConnectionState()
+			req.TLS = &state
+		}
 
-	_, relativeFilePath, found := strings.Cut(reqString, "GET ")
-	if found == false {
-		_, relativeFilePath, found = strings.Cut(reqString, "POST ")
-		if found == false {
-			response := fmt.Sprintf("HTTP/1.1 %v %s\r\n", HTTP_BAD_REQUEST, "BAD REQUEST")
-			conn.Write([]byte(response))
-			fmt.Println("Path not found in get")
+		if server.debug {
+			fmt.Printf("Got request: %s %s %s\n", req.Method, req.Target, req.Proto)
+		}
+
+		res := newResponse(conn, req)
+		res.closeAfter = !server.keepAlive(req, served+1)
+		res.shuttingDown = server.tracker.isShuttingDown
+		res.hijack = func() (net.Conn, *bufio.Reader) {
+			reader.timeout = 0
+			conn.SetDeadline(time.Time{})
+			return conn, br
+		}
+		res.closeNotify = sync.OnceValue(func() <-chan struct{} {
+			return server.watchConn(conn)
+		})
+		if !server.serve(res, req, handler) || res.hijacked {
+			return
+		}
+		if err := res.finish(); err != nil {
+			if server.debug {
+				fmt.Println("Error writing response:", err)
+			}
 			return
 		}
-	}
 
-	filePathRune := []rune(relativeFilePath)
-	httpIndex := strings.Index(relativeFilePath, " HTTP/")
-	if httpIndex == -1 {
-		response := fmt.Sprintf("HTTP/1.1 %v %s\r\n", HTTP_BAD_REQUEST, "BAD REQUEST")
-		conn.Write([]byte(response))
-		fmt.Println("Bad request")
-		return
+		// Leftover body bytes would be parsed as the next request, or make
+		// closing the socket reset the response, so skip past them
+		if !drainBody(req.Body) || res.closeAfter {
+			return
+		}
 	}
+}
 
-	if !server.isValidPath(string(filePathRune[:httpIndex])) {
-		responseCode = HTTP_NOT_FOUND
-		responseString = "NOT FOUND"
-		response := fmt.Sprintf("HTTP/1.1 %v %s\r\n", responseCode, responseString)
-		response += fmt.Sprintf("Server: Custom/Server\r\n")
+// watchConn returns a channel closed once the client closes conn or the
+// server shuts down. Anything the client sends meanwhile is discarded.
+func (server *Server) watchConn(conn net.Conn) <-chan struct{} {
+	done := make(chan struct{})
+	var once sync.Once
+	notify := func() { once.Do(func() { close(done) }) }
+	if !server.tracker.setShutdownHook(conn, notify) {
+		notify()
+	}
+	go func() {
+		conn.SetReadDeadline(time.Time{})
+		io.Copy(io.Discard, conn)
+		notify()
+	}()
+	return done
+}
 
-		conn.Write([]byte(response))
+// ServeHTTP runs the middleware added with Use around the routing of req
+func (server *Server) ServeHTTP(w ResponseWriter, req *Request) {
+	server.globalHandler().ServeHTTP(w, req)
+}
 
-		fmt.Printf("Path not in server paths %s.\n", string(filePathRune[:httpIndex]))
+// dispatch passes req to the handler registered for its method and path
+func (server *Server) dispatch(w ResponseWriter, req *Request) {
+	if req.Method == "OPTIONS" && req.Path == "*" {
+		w.Header().Set("Allow", strings.Join(methodNames, ", "))
+		sendStatus(w, HTTP_NO_CONTENT)
 		return
 	}
 
-	relativeFilePath = "." + server.templatesPath + "/" + server.getFileFromPath(string(filePathRune[:httpIndex]))
+	found, params := server.router.match(req.RawPath)
+	if found == nil {
+		sendStatus(w, HTTP_NOT_FOUND)
+		if server.debug {
+			fmt.Printf("Path not in server paths %s.\n", req.Path)
+		}
+		return
+	}
 
-	fileinfo, err := os.Stat(relativeFilePath)
-	if err != nil {
-		fmt.Println("Couldn't read stats of file", relativeFilePath)
+	if req.conn != nil && !server.isValidHost(req.conn, req.Host) {
+		sendStatus(w, HTTP_BAD_REQUEST)
 		return
 	}
 
-	contentLength := fileinfo.Size()
-	requestFile, err := os.ReadFile(relativeFilePath)
-	if err != nil {
-		fmt.Println("Failed to read file:", err)
+	route, ok := found.routeFor(req.Method)
+	if !ok {
+		w.Header().Set("Allow", strings.Join(found.allowedMethods(), ", "))
+		if req.Method == "OPTIONS" {
+			sendStatus(w, HTTP_NO_CONTENT)
+			return
+		}
+		sendStatus(w, HTTP_METHOD_NOT_ALLOWED)
 		return
 	}
+	req.params = params
+
+	handler := route.handler
+	if handler == nil {
+		// Paths given to CreateServer and AddPath name a template file,
+		// html ones are rendered and anything else is sent as it is
+		if strings.HasSuffix(route.path.value, ".html") {
+			handler = server.TemplateHandler(route.path.value)
+		} else {
+			handler = server.FileHandler(route.path.value)
+		}
+	}
+	handler.ServeHTTP(w, req)
+}
 
-	response := fmt.Sprintf("HTTP/1.1 %v %s\r\n", responseCode, responseString)
-	response += fmt.Sprintf("Server: Custom/Server\r\n")
-	response += fmt.Sprintf("Content-Type: text/html\r\n")
-	response += fmt.Sprintf("Content-Length: %d\r\n\n", contentLength)
-	response += fmt.Sprintf(string(requestFile))
+// serve runs the handlers for req. A panicking handler is answered with
+// 500 when nothing was sent yet, serve reports false if the connection
+// has to be dropped because the response is unusable.
+func (server *Server) serve(res *response, req *Request, handler Handler) (ok bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Printf("Handler for %s %s panicked: %v\n", req.Method, req.Path, err)
+			ok = !res.wroteHeader
+			if ok {
+				res.header = make(Header)
+				res.closeAfter = true
+				sendStatus(res, HTTP_INTERNAL_SERVER_ERROR)
+			}
+		}
+	}()
 
-	conn.Write([]byte(response))
+	if handler == nil {
+		handler = server
+	}
+	handler.ServeHTTP(res, req)
+	return true
 }
 
-func (server *Server) isValidPath(path string) bool {
-	if server.paths[path] != nil {
-		return true
+// keepAlive decides if the connection stays open after the nth request.
+// HTTP/1.1 connections are persistent unless either side sends
+// Connection: close, HTTP/1.0 ones only when the client asks for keep-alive.
+func (server *Server) keepAlive(req *Request, n int) bool {
+	if server.tracker.isShuttingDown() {
+		return false
+	}
+	if server.maxRequestsPerConn > 0 && n >= server.maxRequestsPerConn {
+		return false
+	}
+	if hasToken(req.Header.Values("Connection"), "close") {
+		return false
+	}
+	if req.ProtoMinor == 0 {
+		return hasToken(req.Header.Values("Connection"), "keep-alive")
 	}
-	fmt.Println(server.paths)
-	return false
+	return true
 }
 
-func (server *Server) getFileFromPath(path string) string {
-	if server.paths[path] != nil {
-		return server.paths[path][0].value
+// drainBody discards what the handler left unread of body.
+// It reports false when the rest is too large to skip or can't be read.
+func drainBody(body io.Reader) bool {
+	const maxDrainBytes = 256 << 10
+	n, err := io.CopyN(io.Discard, body, maxDrainBytes+1)
+	return err == io.EOF && n <= maxDrainBytes
+}
+
+// writeError sends a bodyless response with code, the connection is closed afterwards
+func (server *Server) writeError(conn net.Conn, code int) {
+	response := fmt.Sprintf("HTTP/1.1 %v %s\r\n", code, statusText(code))
+	response += fmt.Sprintf("Server: Custom/Server\r\n")
+	response += fmt.Sprintf("Content-Length: 0\r\n")
+	response += fmt.Sprintf("Connection: close\r\n\r\n")
+	conn.Write([]byte(response))
+}
+
+// connReader refreshes the read deadline before every read once timeout is set
+type connReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (reader *connReader) Read(p []byte) (int, error) {
+	if reader.timeout > 0 {
+		reader.conn.SetReadDeadline(time.Now().Add(reader.timeout))
 	}
-	fmt.Println("No value from paths, returning index.html")
-	return "index.html"
+	return reader.conn.Read(p)
 }
 
 func CreateServer(host string, port string, templatesPath string, paths []Path, debug bool) (Server, func()) {
@@ -209,51 +462,76 @@ func CreateServer(host string, port string, templatesPath string, paths []Path,
 	server.host = host
 	server.port = port
 	server.templatesPath = templatesPath
+	server.templates = newTemplateSet(os.DirFS("."+templatesPath), "."+templatesPath)
 	server.paths = make(map[string][]Path)
+	server.router = newRouter()
 	for _, path := range paths {
 		server.paths[path.url] = append(server.paths[path.url], Path{path.url, path.method, path.value})
+		if err := server.router.add(path, nil); err != nil {
+			panic(err)
+		}
 	}
+	server.limits = defaultRequestLimits()
+	server.readTimeout = 10 * time.Second
+	server.idleTimeout = 60 * time.Second
+	server.maxRequestsPerConn = 1000
+	server.unixSocketMode = 0660
+	server.http2 = true
+	server.webSocketReadLimit = 1 << 20
+	server.certs = &certStore{interval: time.Minute}
 	server.readyChan = make(chan struct{})
 	server.shutdownChan = make(chan struct{})
 	server.debug = debug
+	server.wg = &sync.WaitGroup{}
+	server.tracker = newConnTracker()
 
 	return server, func() {
-		server.Shutdown()
-		time.Sleep(100 * time.Millisecond)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
 	}
 }
 
 func CreateDefaultServer() (Server, func()) {
-	var server Server
-	server.host = "127.0.0.1"
-	server.port = "1337"
-	server.templatesPath = "/templates"
-	var path Path = Path{url: "/", method: "GET", value: "index.html"}
-	server.paths = make(map[string][]Path)
-	server.paths["/"] = append(server.paths["/"], path)
-	server.readyChan = make(chan struct{})
-	server.shutdownChan = make(chan struct{})
-	server.debug = true
-	return server, func() {
-		server.Shutdown()
-		time.Sleep(100 * time.Millisecond)
-	}
+	paths := []Path{{url: "/", method: "GET", value: "index.html"}}
+	return CreateServer("127.0.0.1", "1337", "/templates", paths, true)
+}
+
+// SetMaxBodyBytes limits request bodies, larger ones are answered with 413
+func (server *Server) SetMaxBodyBytes(n int64) {
+	server.limits.maxBodyBytes = n
+}
+
+// SetReadTimeout sets how long the server waits for a request header
+// and for each read of the request body
+func (server *Server) SetReadTimeout(timeout time.Duration) {
+	server.readTimeout = timeout
+}
+
+// SetIdleTimeout sets how long a persistent connection may wait for its next request
+func (server *Server) SetIdleTimeout(timeout time.Duration) {
+	server.idleTimeout = timeout
 }
 
-func (server *Server) Shutdown() {
-	close(server.shutdownChan)
+// SetMaxRequestsPerConn closes connections after n requests, 0 disables the limit
+func (server *Server) SetMaxRequestsPerConn(n int) {
+	server.maxRequestsPerConn = n
 }
 
+// AddPath serves the template file returnValue for method requests to url
 func (server *Server) AddPath(url string, method string, returnValue string) error {
-	if strings.HasSuffix(returnValue, ".html") {
-		// TODO: return html
+	if _, err := fs.Stat(server.templates.fsys, returnValue); err != nil {
+		return fmt.Errorf("file %s in %s doesn't exist or has incorrect access permissions: %w", returnValue, server.templates.dir, err)
 	}
-	htmlFileContent, err := os.ReadFile(server.templatesPath + "/" + returnValue)
-	if err != nil {
-		panic("File doesn't exist or has incorrect access permissions.")
+	if _, ok := methods[method]; !ok {
+		return fmt.Errorf("unknown method %s", method)
+	}
+
+	path := Path{url, method, returnValue}
+	if err := server.router.add(path, nil); err != nil {
+		return err
 	}
-	htmlFile := string(htmlFileContent)
-	server.paths[url] = append(server.paths[url], Path{url, method, htmlFile})
+	server.paths[url] = append(server.paths[url], path)
 
 	return nil
 }
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
+	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -337,6 +341,7 @@ func TestTwoValidGetGetRequests(t *testing.T) {
 	isValidServerResponse(t, resString, HTTP_OK)
 }
 
+// The default server only registers GET / so the POST is refused with 405
 func TestTwoValidGetPostRequests(t *testing.T) {
 	cleanup := prepareAndRunDefaultServer(t)
 	defer cleanup()
@@ -400,9 +405,10 @@ func TestTwoValidGetPostRequests(t *testing.T) {
 	_, err = conn.Read(buff)
 
 	resString = string(buff[:])
-	isValidServerResponse(t, resString, HTTP_OK)
+	isValidServerResponse(t, resString, HTTP_METHOD_NOT_ALLOWED)
 }
 
+// The default server only registers GET / so both POSTs are refused with 405
 func TestTwoValidPostPostRequests(t *testing.T) {
 	cleanup := prepareAndRunDefaultServer(t)
 	defer cleanup()
@@ -439,7 +445,7 @@ func TestTwoValidPostPostRequests(t *testing.T) {
 	_, err = conn.Read(buff)
 
 	resString := string(buff[:])
-	isValidServerResponse(t, resString, HTTP_OK)
+	isValidServerResponse(t, resString, HTTP_METHOD_NOT_ALLOWED)
 
 	// Second Request
 
@@ -466,7 +472,7 @@ func TestTwoValidPostPostRequests(t *testing.T) {
 	_, err = conn.Read(buff)
 
 	resString = string(buff[:])
-	isValidServerResponse(t, resString, HTTP_OK)
+	isValidServerResponse(t, resString, HTTP_METHOD_NOT_ALLOWED)
 }
 
 func TestValidGetInvalidGetRequests(t *testing.T) {
@@ -596,7 +602,7 @@ func TestInvalidGetGetRequests(t *testing.T) {
 	_, err = conn.Read(buff)
 
 	resString = string(buff[:])
-	isValidServerResponse(t, resString, HTTP_BAD_REQUEST)
+	isValidServerResponse(t, resString, HTTP_VERSION_NOT_SUPPORTED)
 }
 
 func TestInvalidGetValidGetRequests(t *testing.T) {
@@ -791,7 +797,7 @@ func TestInvalidPostPostRequests(t *testing.T) {
 	_, err = conn.Read(buff)
 
 	resString = string(buff[:])
-	isValidServerResponse(t, resString, HTTP_BAD_REQUEST)
+	isValidServerResponse(t, resString, HTTP_VERSION_NOT_SUPPORTED)
 }
 
 func TestThousandValidRequests(t *testing.T) {
@@ -921,7 +927,8 @@ func isValidServerResponse(t *testing.T, response string, expectedCode int) {
 		t.Fatalf(`Error in first line got: %s expected: %s`, response, firstResponseLine)
 	}
 
-	if expectedCode == HTTP_BAD_REQUEST || expectedCode == HTTP_NOT_FOUND {
+	if expectedCode == HTTP_BAD_REQUEST || expectedCode == HTTP_NOT_FOUND || expectedCode == HTTP_METHOD_NOT_ALLOWED ||
+		expectedCode == HTTP_CONTENT_TOO_LARGE || expectedCode == HTTP_VERSION_NOT_SUPPORTED {
 		return
 	}
 	thirdResponseLine := "Server: Custom/Server"
@@ -948,6 +955,15 @@ func getStatusForCode(code int) string {
 	if code == 400 {
 		return "BAD REQUEST"
 	}
+	if code == 405 {
+		return "METHOD NOT ALLOWED"
+	}
+	if code == 413 {
+		return "CONTENT TOO LARGE"
+	}
+	if code == 505 {
+		return "HTTP VERSION NOT SUPPORTED"
+	}
 	return "SERVER ERROR"
 }
 
@@ -1065,3 +1081,298 @@ func prepareAndRunBenchmarkServer(t *testing.T) func() {
 
 	return cleanup
 }
+
+func TestRequestBodyTooLarge(t *testing.T) {
+	server, cleanup := CreateDefaultServer()
+	defer cleanup()
+	server.SetMaxBodyBytes(16)
+	runServer(t, &server)
+
+	serverAddressAndPort := "127.0.0.1:1337"
+
+	conn, err := net.Dial("tcp", serverAddressAndPort)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	defer conn.Close()
+
+	rt := fmt.Sprintf("POST %v HTTP/1.1\r\n", "/")
+	rt += fmt.Sprintf("Host: %v\r\n", serverAddressAndPort)
+	rt += fmt.Sprintf("Content-Length: %d\r\n", 17)
+	rt += fmt.Sprintf("\r\n")
+	rt += strings.Repeat("a", 17)
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err = conn.Write([]byte(rt)); err != nil {
+		t.Fatalf(`Failed to write data to server %s`, err)
+	}
+
+	buff := make([]byte, 32768)
+	_, err = conn.Read(buff)
+
+	isValidServerResponse(t, string(buff), HTTP_CONTENT_TOO_LARGE)
+}
+
+func runServer(t *testing.T, server *Server) {
+	go func() {
+		if err := server.Listen(); err != nil {
+			t.Errorf("Server listen error: %v", err)
+		}
+	}()
+	<-server.readyChan
+}
+
+func TestKeepAliveRequests(t *testing.T) {
+	server, cleanup := CreateDefaultServer()
+	defer cleanup()
+	runServer(t, &server)
+
+	serverAddressAndPort := "127.0.0.1:1337"
+
+	conn, err := net.Dial("tcp", serverAddressAndPort)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	for i := range 3 {
+		rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", "/")
+		rt += fmt.Sprintf("Host: %v\r\n", serverAddressAndPort)
+		rt += fmt.Sprintf("\r\n")
+
+		if _, err = conn.Write([]byte(rt)); err != nil {
+			t.Fatalf(`Failed to write request %d to server %s`, i, err)
+		}
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf(`Failed to read response %d %s`, i, err)
+		}
+		io.Copy(io.Discard, res.Body)
+		if res.StatusCode != HTTP_OK || res.Close {
+			t.Fatalf(`Expected persistent 200 response got: %d close: %v`, res.StatusCode, res.Close)
+		}
+	}
+}
+
+func TestPipelinedRequests(t *testing.T) {
+	paths := []Path{{"/", "GET", "index.html"}, {"/post", "POST", "form.html"}}
+	server, cleanup := CreateServer("127.0.0.1", "1337", "/templates", paths, false)
+	defer cleanup()
+	runServer(t, &server)
+
+	serverAddressAndPort := "127.0.0.1:1337"
+
+	conn, err := net.Dial("tcp", serverAddressAndPort)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	targets := []string{"GET /", "POST /post", "GET /missing", "GET /"}
+	rt := ""
+	for _, target := range targets {
+		rt += fmt.Sprintf("%v HTTP/1.1\r\n", target)
+		rt += fmt.Sprintf("Host: %v\r\n", serverAddressAndPort)
+		rt += fmt.Sprintf("\r\n")
+	}
+	if _, err = conn.Write([]byte(rt)); err != nil {
+		t.Fatalf(`Failed to write pipelined requests %s`, err)
+	}
+
+	index, _ := os.ReadFile("templates/index.html")
+	form, _ := os.ReadFile("templates/form.html")
+	expected := []struct {
+		code   int
+		length int
+	}{{HTTP_OK, len(index)}, {HTTP_OK, len(form)}, {HTTP_NOT_FOUND, 0}, {HTTP_OK, len(index)}}
+
+	reader := bufio.NewReader(conn)
+	for i, want := range expected {
+		res, err := http.ReadResponse(reader, nil)
+		if err != nil {
+			t.Fatalf(`Failed to read response %d %s`, i, err)
+		}
+		content, _ := io.ReadAll(res.Body)
+		if res.StatusCode != want.code || len(content) != want.length {
+			t.Fatalf(`Response %d out of order got: %d with %d bytes`, i, res.StatusCode, len(content))
+		}
+	}
+}
+
+func TestHTTP10KeepAlive(t *testing.T) {
+	server, cleanup := CreateDefaultServer()
+	defer cleanup()
+	server.SetMaxRequestsPerConn(2)
+	runServer(t, &server)
+
+	serverAddressAndPort := "127.0.0.1:1337"
+
+	conn, err := net.Dial("tcp", serverAddressAndPort)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	rt := fmt.Sprintf("GET %v HTTP/1.0\r\n", "/")
+	rt += fmt.Sprintf("Host: %v\r\n", serverAddressAndPort)
+	rt += fmt.Sprintf("Connection: keep-alive\r\n")
+	rt += fmt.Sprintf("\r\n")
+
+	conn.Write([]byte(rt))
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf(`Failed to read first response %s`, err)
+	}
+	io.Copy(io.Discard, res.Body)
+	if res.Header.Get("Connection") != "keep-alive" {
+		t.Fatalf(`Expected keep-alive response got: %q`, res.Header.Get("Connection"))
+	}
+
+	// The second request reaches the per connection limit
+	conn.Write([]byte(rt))
+	res, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf(`Failed to read second response %s`, err)
+	}
+	io.Copy(io.Discard, res.Body)
+	if !res.Close {
+		t.Fatalf(`Expected close after max requests`)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf(`Expected server to close the connection got: %v`, err)
+	}
+}
+
+func TestIdleConnectionTimeout(t *testing.T) {
+	server, cleanup := CreateDefaultServer()
+	defer cleanup()
+	server.SetIdleTimeout(100 * time.Millisecond)
+	runServer(t, &server)
+
+	serverAddressAndPort := "127.0.0.1:1337"
+
+	conn, err := net.Dial("tcp", serverAddressAndPort)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", "/")
+	rt += fmt.Sprintf("Host: %v\r\n", serverAddressAndPort)
+	rt += fmt.Sprintf("\r\n")
+
+	conn.Write([]byte(rt))
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf(`Failed to read response %s`, err)
+	}
+	io.Copy(io.Discard, res.Body)
+
+	start := time.Now()
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf(`Expected idle connection to be closed got: %v`, err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf(`Idle connection closed too late`)
+	}
+}
+
+func TestMethodRouting(t *testing.T) {
+	paths := []Path{{"/same", "GET", "index.html"}, {"/same", "POST", "form.html"}, {"/put", "PUT", "index.html"}}
+	server, cleanup := CreateServer("127.0.0.1", "1337", "/templates", paths, false)
+	defer cleanup()
+	runServer(t, &server)
+
+	serverAddressAndPort := "127.0.0.1:1337"
+
+	conn, err := net.Dial("tcp", serverAddressAndPort)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(conn)
+
+	index, _ := os.ReadFile("templates/index.html")
+	form, _ := os.ReadFile("templates/form.html")
+	tests := []struct {
+		method string
+		target string
+		code   int
+		length int
+		allow  string
+	}{
+		{"GET", "/same", HTTP_OK, len(index), ""},
+		{"POST", "/same", HTTP_OK, len(form), ""},
+		{"HEAD", "/same", HTTP_OK, 0, ""},
+		{"DELETE", "/same", HTTP_METHOD_NOT_ALLOWED, 0, "GET, POST, HEAD, OPTIONS"},
+		{"OPTIONS", "/same", HTTP_NO_CONTENT, 0, "GET, POST, HEAD, OPTIONS"},
+		{"PUT", "/put", HTTP_OK, len(index), ""},
+		{"PATCH", "/put", HTTP_METHOD_NOT_ALLOWED, 0, "PUT, OPTIONS"},
+		{"OPTIONS", "*", HTTP_NO_CONTENT, 0, "GET, POST, PUT, DELETE, PATCH, HEAD, OPTIONS"},
+	}
+
+	for _, test := range tests {
+		rt := fmt.Sprintf("%s %v HTTP/1.1\r\n", test.method, test.target)
+		rt += fmt.Sprintf("Host: %v\r\n", serverAddressAndPort)
+		rt += fmt.Sprintf("\r\n")
+		if _, err = conn.Write([]byte(rt)); err != nil {
+			t.Fatalf(`Failed to write request %s`, err)
+		}
+
+		req, _ := http.NewRequest(test.method, "/", nil)
+		res, err := http.ReadResponse(reader, req)
+		if err != nil {
+			t.Fatalf(`%s %s: failed to read response %s`, test.method, test.target, err)
+		}
+		content, _ := io.ReadAll(res.Body)
+		if res.StatusCode != test.code || len(content) != test.length {
+			t.Fatalf(`%s %s: got %d with %d bytes`, test.method, test.target, res.StatusCode, len(content))
+		}
+		if res.Header.Get("Allow") != test.allow {
+			t.Fatalf(`%s %s: wrong Allow header got: %q`, test.method, test.target, res.Header.Get("Allow"))
+		}
+		if test.method == "HEAD" && res.ContentLength != int64(len(index)) {
+			t.Fatalf(`HEAD should report the GET length got: %d`, res.ContentLength)
+		}
+	}
+}
+
+// sendRequest writes raw to a new connection and reads back one response with its body
+func sendRequest(t *testing.T, raw string) (*http.Response, string) {
+	return sendRequestTo(t, "127.0.0.1:1337", raw)
+}
+
+// sendRequestTo writes raw to the server at serverAddressAndPort and reads one response
+func sendRequestTo(t *testing.T, serverAddressAndPort string, raw string) (*http.Response, string) {
+	conn, err := net.Dial("tcp", serverAddressAndPort)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err = conn.Write([]byte(raw)); err != nil {
+		t.Fatalf(`Failed to write data to server %s`, err)
+	}
+
+	method, _, _ := strings.Cut(raw, " ")
+	req, _ := http.NewRequest(method, "/", nil)
+	res, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		t.Fatalf(`Failed to read response %s`, err)
+	}
+	content, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf(`Failed to read response body %s`, err)
+	}
+	return res, string(content)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// Middleware wraps a Handler to run code around it. It may answer the
+// request itself and never call the wrapped handler to short-circuit.
+//
+// Middleware added with Server.Use runs first, for every request including
+// 404 and 405 answers. Group middleware runs next, outer groups first, then
+// the middleware passed when registering the route. Within each level the
+// middleware given first is the outermost.
+type Middleware func(next Handler) Handler
+
+// chain wraps handler so middlewares[0] is the outermost
+func chain(handler Handler, middlewares []Middleware) Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Use adds middleware that runs for every request to the server
+func (server *Server) Use(middlewares ...Middleware) {
+	r := server.router
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.middlewares = append(r.middlewares, middlewares...)
+	r.chained = nil
+}
+
+// globalHandler returns the middleware added with Use around dispatch,
+// behind the ACME http-01 challenges. The chain is built once, so
+// middleware keeps what it set up when it was constructed across requests.
+func (server *Server) globalHandler() Handler {
+	r := server.router
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.chained == nil || r.chainedFor != server {
+		r.chained = chain(HandlerFunc(server.dispatch), r.middlewares)
+		if server.acme != nil {
+			r.chained = server.acme.httpChallengeHandler(r.chained)
+		}
+		r.chainedFor = server
+	}
+	return r.chained
+}
+
+// Group registers routes below a common prefix sharing middleware.
+// Middleware applies to the routes registered after it was added.
+type Group struct {
+	server      *Server
+	prefix      string
+	middlewares []Middleware
+}
+
+func (server *Server) Group(prefix string, middlewares ...Middleware) *Group {
+	return &Group{server: server, prefix: strings.TrimSuffix(prefix, "/"), middlewares: middlewares}
+}
+
+// Group creates a nested group running this group's middleware first
+func (group *Group) Group(prefix string, middlewares ...Middleware) *Group {
+	inherited := append([]Middleware{}, group.middlewares...)
+	return &Group{
+		server:      group.server,
+		prefix:      group.prefix + strings.TrimSuffix(prefix, "/"),
+		middlewares: append(inherited, middlewares...),
+	}
+}
+
+func (group *Group) Use(middlewares ...Middleware) {
+	group.middlewares = append(group.middlewares, middlewares...)
+}
+
+func (group *Group) Handle(method string, url string, handler Handler, middlewares ...Middleware) error {
+	if handler == nil {
+		return fmt.Errorf("nil handler for %s %s", method, group.prefix+url)
+	}
+	all := append(append([]Middleware{}, group.middlewares...), middlewares...)
+	return group.server.Handle(method, group.prefix+url, handler, all...)
+}
+
+func (group *Group) HandleFunc(method string, url string, handler func(w ResponseWriter, req *Request), middlewares ...Middleware) error {
+	return group.Handle(method, url, HandlerFunc(handler), middlewares...)
+}
+
+// ResponseObserver wraps a ResponseWriter and records the status
+// and the number of body bytes a handler wrote through it
+type ResponseObserver struct {
+	ResponseWriter
+	status  int
+	written int64
+}
+
+func NewResponseObserver(w ResponseWriter) *ResponseObserver {
+	return &ResponseObserver{ResponseWriter: w}
+}
+
+func (observer *ResponseObserver) WriteHeader(code int) {
+	if observer.status == 0 {
+		observer.status = code
+	}
+	observer.ResponseWriter.WriteHeader(code)
+}
+
+func (observer *ResponseObserver) Write(p []byte) (int, error) {
+	if observer.status == 0 {
+		observer.status = HTTP_OK
+	}
+	n, err := observer.ResponseWriter.Write(p)
+	observer.written += int64(n)
+	return n, err
+}
+
+func (observer *ResponseObserver) Flush() error {
+	if flusher, ok := observer.ResponseWriter.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (observer *ResponseObserver) Hijack() (net.Conn, *bufio.Reader, error) {
+	if hijacker, ok := observer.ResponseWriter.(Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errNoHijack
+}
+
+func (observer *ResponseObserver) CloseNotify() <-chan struct{} {
+	if notifier, ok := observer.ResponseWriter.(CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return nil
+}
+
+// Status is the code sent so far, HTTP_OK once the handler returns without one
+func (observer *ResponseObserver) Status() int {
+	return observer.status
+}
+
+func (observer *ResponseObserver) BytesWritten() int64 {
+	return observer.written
+}
+
+// Unwrap returns the wrapped writer so its other capabilities stay reachable
+func (observer *ResponseObserver) Unwrap() ResponseWriter {
+	return observer.ResponseWriter
+}
+
+// Logger writes one line per request with its status, size and duration
+func Logger(out io.Writer) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *Request) {
+			start := time.Now()
+			observer := NewResponseObserver(w)
+			next.ServeHTTP(observer, req)
+			status := observer.Status()
+			if status == 0 {
+				status = HTTP_OK
+			}
+			fmt.Fprintf(out, "%s %s %s %d %dB %s\n", req.RemoteAddr, req.Method, req.Target, status, observer.BytesWritten(), time.Since(start))
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// tagMiddleware appends name to the X-Order header before and after next runs
+func tagMiddleware(name string, order *[]string) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *Request) {
+			*order = append(*order, name)
+			next.ServeHTTP(w, req)
+			*order = append(*order, "/"+name)
+		})
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	server, cleanup := CreateDefaultServer()
+	defer cleanup()
+
+	var order []string
+	server.Use(tagMiddleware("global1", &order), tagMiddleware("global2", &order))
+	api := server.Group("/api", tagMiddleware("api", &order))
+	v1 := api.Group("/v1")
+	v1.Use(tagMiddleware("v1", &order))
+	v1.HandleFunc("GET", "/items/:id", func(w ResponseWriter, req *Request) {
+		order = append(order, "handler")
+		fmt.Fprintf(w, "item %s", req.Param("id"))
+	}, tagMiddleware("route", &order))
+	runServer(t, &server)
+
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", "/api/v1/items/3")
+	rt += fmt.Sprintf("Host: %v\r\n", "127.0.0.1:1337")
+	rt += fmt.Sprintf("\r\n")
+	res, content := sendRequest(t, rt)
+	if res.StatusCode != HTTP_OK || content != "item 3" {
+		t.Fatalf(`Wrong grouped route response got: %d %q`, res.StatusCode, content)
+	}
+
+	expected := "global1 global2 api v1 route handler /route /v1 /api /global2 /global1"
+	if strings.Join(order, " ") != expected {
+		t.Fatalf(`Wrong middleware order got: %s expected: %s`, strings.Join(order, " "), expected)
+	}
+
+	// Global middleware also wraps requests no route matched
+	order = nil
+	rt = fmt.Sprintf("GET %v HTTP/1.1\r\n", "/nothing")
+	rt += fmt.Sprintf("Host: %v\r\n", "127.0.0.1:1337")
+	rt += fmt.Sprintf("\r\n")
+	res, _ = sendRequest(t, rt)
+	if res.StatusCode != HTTP_NOT_FOUND || strings.Join(order, " ") != "global1 global2 /global2 /global1" {
+		t.Fatalf(`Wrong middleware order for 404 got: %v`, order)
+	}
+}
+
+func TestMiddlewareShortCircuit(t *testing.T) {
+	server, cleanup := CreateDefaultServer()
+	defer cleanup()
+
+	requireToken := func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *Request) {
+			if req.Header.Get("Authorization") != "Bearer secret" {
+				sendStatus(w, HTTP_UNAUTHORIZED)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+	called := false
+	server.HandleFunc("GET", "/private", func(w ResponseWriter, req *Request) {
+		called = true
+		w.Write([]byte("private"))
+	}, requireToken)
+	runServer(t, &server)
+
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", "/private")
+	rt += fmt.Sprintf("Host: %v\r\n", "127.0.0.1:1337")
+	rt += fmt.Sprintf("\r\n")
+	res, _ := sendRequest(t, rt)
+	if res.StatusCode != HTTP_UNAUTHORIZED || called {
+		t.Fatalf(`Middleware did not short-circuit got: %d called: %v`, res.StatusCode, called)
+	}
+
+	rt = fmt.Sprintf("GET %v HTTP/1.1\r\n", "/private")
+	rt += fmt.Sprintf("Host: %v\r\n", "127.0.0.1:1337")
+	rt += fmt.Sprintf("Authorization: Bearer secret\r\n")
+	rt += fmt.Sprintf("\r\n")
+	res, content := sendRequest(t, rt)
+	if res.StatusCode != HTTP_OK || content != "private" {
+		t.Fatalf(`Authorized request failed got: %d %q`, res.StatusCode, content)
+	}
+}
+
+func TestLoggerObservesResponse(t *testing.T) {
+	server, cleanup := CreateDefaultServer()
+	defer cleanup()
+
+	var log bytes.Buffer
+	server.Use(Logger(&log))
+	runServer(t, &server)
+
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", "/")
+	rt += fmt.Sprintf("Host: %v\r\n", "127.0.0.1:1337")
+	rt += fmt.Sprintf("\r\n")
+	_, content := sendRequest(t, rt)
+
+	expected := fmt.Sprintf("GET / 200 %dB", len(content))
+	if !strings.Contains(log.String(), expected) {
+		t.Fatalf(`Wrong log line got: %q expected: %q`, log.String(), expected)
+	}
+}
+
+func TestGlobalMiddlewareBuiltOnce(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	server.HandleFunc("GET", "/", func(w ResponseWriter, req *Request) {
+		sendStatus(w, HTTP_NO_CONTENT)
+	})
+
+	var built, served atomic.Int32
+	server.Use(func(next Handler) Handler {
+		built.Add(1)
+		return HandlerFunc(func(w ResponseWriter, req *Request) {
+			served.Add(1)
+			next.ServeHTTP(w, req)
+		})
+	})
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	for range 3 {
+		sendRequestTo(t, addr, fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\n\r\n", addr))
+	}
+	if built.Load() != 1 || served.Load() != 3 {
+		t.Fatalf(`Middleware built %d times for %d requests, expected once`, built.Load(), served.Load())
+	}
+}
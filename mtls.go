@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ClientIdentity describes the verified certificate a client presented
+// during a mutual TLS handshake
+type ClientIdentity struct {
+	Subject        pkix.Name
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	Certificate    *x509.Certificate
+}
+
+// SetClientAuth sets whether clients have to present a certificate.
+// tls.RequireAndVerifyClientCert refuses handshakes without a valid one,
+// tls.VerifyClientCertIfGiven only checks certificates that are sent so
+// RequireClientCert can protect single routes. Both need the client CAs
+// of SetClientCAs or AddClientCAFile, Listen fails without them.
+func (server *Server) SetClientAuth(mode tls.ClientAuthType) {
+	server.ensureTLSConfig().ClientAuth = mode
+}
+
+// SetClientCAs replaces the pool client certificates are verified against
+func (server *Server) SetClientCAs(pool *x509.CertPool) {
+	server.ensureTLSConfig().ClientCAs = pool
+}
+
+// AddClientCAFile adds the PEM encoded CA certificates in file to the client CA pool
+func (server *Server) AddClientCAFile(file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	config := server.ensureTLSConfig()
+	if config.ClientCAs == nil {
+		config.ClientCAs = x509.NewCertPool()
+	}
+	if !config.ClientCAs.AppendCertsFromPEM(data) {
+		return fmt.Errorf("no certificates found in %s", file)
+	}
+	return nil
+}
+
+// ClientIdentity returns the identity of a client certificate verified
+// against the client CAs, nil when the client didn't send one
+func (req *Request) ClientIdentity() *ClientIdentity {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := req.TLS.VerifiedChains[0][0]
+	return &ClientIdentity{
+		Subject:        cert.Subject,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+		URIs:           cert.URIs,
+		Certificate:    cert,
+	}
+}
+
+// HasName reports whether name is the common name or one of the DNS names
+func (identity *ClientIdentity) HasName(name string) bool {
+	if strings.EqualFold(identity.Subject.CommonName, name) {
+		return true
+	}
+	for _, dnsName := range identity.DNSNames {
+		if strings.EqualFold(dnsName, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireClientCert only lets requests through that come with a verified
+// client certificate accepted by allow, a nil allow accepts any of them.
+// Requests without one get 401, rejected identities 403.
+func RequireClientCert(allow func(identity *ClientIdentity) bool) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *Request) {
+			identity := req.ClientIdentity()
+			if identity == nil {
+				sendStatus(w, HTTP_UNAUTHORIZED)
+				return
+			}
+			if allow != nil && !allow(identity) {
+				sendStatus(w, HTTP_FORBIDDEN)
+				return
+			}
+			next.ServeHTTP(w, req)
+		})
+	}
+}
+
+// AllowClientNames accepts identities having one of names, see HasName
+func AllowClientNames(names ...string) func(identity *ClientIdentity) bool {
+	return func(identity *ClientIdentity) bool {
+		for _, name := range names {
+			if identity.HasName(name) {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+// newTestCA creates a CA and writes its certificate to dir
+func newTestCA(t *testing.T, dir string, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf(`Failed to generate key %s`, err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf(`Failed to create CA %s`, err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	file := filepath.Join(dir, name+".pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf(`Failed to write CA %s`, err)
+	}
+	return &testCA{cert, key, file}
+}
+
+// issueClientCert returns a client certificate for commonName signed by ca
+func (ca *testCA) issueClientCert(t *testing.T, commonName string, dnsNames ...string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf(`Failed to generate key %s`, err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Tests"}},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf(`Failed to issue client certificate %s`, err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// sendTLSRequest sends a GET for target presenting clientCert when it isn't nil
+func sendTLSRequest(addr string, clientCert *tls.Certificate, target string) (int, string, error) {
+	config := &tls.Config{InsecureSkipVerify: true}
+	if clientCert != nil {
+		// Sent even when the server doesn't list its issuer as acceptable
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return clientCert, nil
+		}
+	}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", target)
+	rt += fmt.Sprintf("Host: %v\r\n", addr)
+	rt += fmt.Sprintf("\r\n")
+	if _, err := conn.Write([]byte(rt)); err != nil {
+		return 0, "", err
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0, "", err
+	}
+	content, err := io.ReadAll(res.Body)
+	return res.StatusCode, string(content), err
+}
+
+func TestClientCertPerRoute(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "internal-ca")
+	otherCA := newTestCA(t, dir, "other-ca")
+	certFile, keyFile := writeTestCertificate(t, dir, "a.test")
+
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	if err := server.AddClientCAFile(ca.file); err != nil {
+		t.Fatalf(`Failed to add client CA %s`, err)
+	}
+	server.SetClientAuth(tls.VerifyClientCertIfGiven)
+	server.HandleFunc("GET", "/public", func(w ResponseWriter, req *Request) {
+		w.Write([]byte("public"))
+	})
+	server.HandleFunc("GET", "/internal", func(w ResponseWriter, req *Request) {
+		identity := req.ClientIdentity()
+		w.Write([]byte(identity.Subject.CommonName + " " + identity.Subject.Organization[0]))
+	}, RequireClientCert(AllowClientNames("billing.internal")))
+	addr := runTLSServer(t, &server, [2]string{certFile, keyFile})
+
+	billing := ca.issueClientCert(t, "billing", "billing.internal")
+	reports := ca.issueClientCert(t, "reports", "reports.internal")
+
+	tests := []struct {
+		name       string
+		clientCert *tls.Certificate
+		target     string
+		status     int
+		content    string
+	}{
+		{"public without certificate", nil, "/public", HTTP_OK, "public"},
+		{"internal without certificate", nil, "/internal", HTTP_UNAUTHORIZED, ""},
+		{"internal with allowed certificate", billing, "/internal", HTTP_OK, "billing Tests"},
+		{"internal with other certificate", reports, "/internal", HTTP_FORBIDDEN, ""},
+	}
+	for _, test := range tests {
+		status, content, err := sendTLSRequest(addr, test.clientCert, test.target)
+		if err != nil {
+			t.Fatalf(`%s: request failed %s`, test.name, err)
+		}
+		if status != test.status || content != test.content {
+			t.Fatalf(`%s: got %d %q`, test.name, status, content)
+		}
+	}
+
+	if _, _, err := sendTLSRequest(addr, otherCA.issueClientCert(t, "billing", "billing.internal"), "/public"); err == nil {
+		t.Fatalf(`Expected certificate from an unknown CA to be refused`)
+	}
+}
+
+func TestRequireClientCertOnHandshake(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "internal-ca")
+	certFile, keyFile := writeTestCertificate(t, dir, "a.test")
+
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	server.SetClientCAs(pool)
+	server.SetClientAuth(tls.RequireAndVerifyClientCert)
+	addr := runTLSServer(t, &server, [2]string{certFile, keyFile})
+
+	if _, _, err := sendTLSRequest(addr, nil, "/"); err == nil {
+		t.Fatalf(`Expected handshake without client certificate to fail`)
+	}
+	status, _, err := sendTLSRequest(addr, ca.issueClientCert(t, "billing"), "/")
+	if err != nil || status != HTTP_OK {
+		t.Fatalf(`Expected request with client certificate to pass got: %d %v`, status, err)
+	}
+}
+
+func TestClientVerificationNeedsCAs(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "a.test")
+
+	for _, mode := range []tls.ClientAuthType{tls.VerifyClientCertIfGiven, tls.RequireAndVerifyClientCert} {
+		server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+		server.SetListenAddrs("127.0.0.1:0")
+		server.SetClientAuth(mode)
+		if err := server.AddCertificate(certFile, keyFile); err != nil {
+			t.Fatalf(`Failed to add certificate %s`, err)
+		}
+		// Client certificates would be checked against the system roots
+		if err := server.Listen(); err == nil {
+			t.Fatalf(`Expected Listen without client CAs to fail for mode %v`, mode)
+		}
+		cleanup()
+	}
+}
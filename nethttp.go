@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// FromHTTPHandler mounts a net/http handler on a Server route.
+// Route parameters are available through the request's PathValue.
+func FromHTTPHandler(handler http.Handler) Handler {
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		handler.ServeHTTP(&httpResponseWriter{w}, toHTTPRequest(req))
+	})
+}
+
+// HTTPHandler exposes the server's routes as a net/http handler so both
+// stacks can run side by side. Host validation is left to the net/http server.
+func (server *Server) HTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.ServeHTTP(&serverResponseWriter{w}, fromHTTPRequest(r))
+	})
+}
+
+func toHTTPRequest(req *Request) *http.Request {
+	u := &url.URL{Path: req.Path, RawQuery: req.RawQuery}
+	if req.RawPath != u.EscapedPath() {
+		u.RawPath = req.RawPath
+	}
+
+	body := io.NopCloser(req.Body)
+	if req.ContentLength == 0 {
+		body = http.NoBody
+	}
+
+	r := &http.Request{
+		Method:        req.Method,
+		URL:           u,
+		Proto:         req.Proto,
+		ProtoMajor:    req.ProtoMajor,
+		ProtoMinor:    req.ProtoMinor,
+		Header:        http.Header(req.Header),
+		Body:          body,
+		ContentLength: req.ContentLength,
+		Host:          req.Host,
+		RemoteAddr:    req.RemoteAddr,
+		RequestURI:    req.Target,
+		Trailer:       http.Header(req.Trailer),
+		TLS:           req.TLS,
+	}
+	if req.ContentLength == -1 {
+		r.TransferEncoding = []string{"chunked"}
+	}
+	for _, param := range req.params {
+		r.SetPathValue(param.name, param.value)
+	}
+	return r
+}
+
+func fromHTTPRequest(r *http.Request) *Request {
+	req := &Request{
+		Method:        r.Method,
+		Target:        r.RequestURI,
+		Path:          r.URL.Path,
+		RawPath:       r.URL.EscapedPath(),
+		RawQuery:      r.URL.RawQuery,
+		Proto:         r.Proto,
+		ProtoMajor:    r.ProtoMajor,
+		ProtoMinor:    r.ProtoMinor,
+		Header:        Header(r.Header),
+		Host:          r.Host,
+		RemoteAddr:    r.RemoteAddr,
+		ContentLength: r.ContentLength,
+		Body:          r.Body,
+		Trailer:       Header(r.Trailer),
+		TLS:           r.TLS,
+	}
+	if req.Target == "" {
+		req.Target = r.URL.RequestURI()
+	}
+	if req.Body == nil {
+		req.Body = noBody{}
+	}
+	return req
+}
+
+// httpResponseWriter presents a ResponseWriter to net/http handlers
+type httpResponseWriter struct {
+	w ResponseWriter
+}
+
+func (hw *httpResponseWriter) Header() http.Header {
+	return http.Header(hw.w.Header())
+}
+
+func (hw *httpResponseWriter) Write(p []byte) (int, error) {
+	return hw.w.Write(p)
+}
+
+func (hw *httpResponseWriter) WriteHeader(code int) {
+	hw.w.WriteHeader(code)
+}
+
+func (hw *httpResponseWriter) Flush() {
+	if flusher, ok := hw.w.(Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets net/http handlers upgrade the connection, as WebSocket libraries do
+func (hw *httpResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := hw.w.(Hijacker)
+	if !ok {
+		return nil, nil, errNoHijack
+	}
+	conn, br, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, bufio.NewReadWriter(br, bufio.NewWriter(conn)), nil
+}
+
+// serverResponseWriter presents a net/http ResponseWriter to our handlers
+type serverResponseWriter struct {
+	w http.ResponseWriter
+}
+
+func (sw *serverResponseWriter) Header() Header {
+	return Header(sw.w.Header())
+}
+
+func (sw *serverResponseWriter) Write(p []byte) (int, error) {
+	return sw.w.Write(p)
+}
+
+func (sw *serverResponseWriter) WriteHeader(code int) {
+	sw.w.WriteHeader(code)
+}
+
+func (sw *serverResponseWriter) Flush() error {
+	return http.NewResponseController(sw.w).Flush()
+}
+
+func (sw *serverResponseWriter) Hijack() (net.Conn, *bufio.Reader, error) {
+	conn, rw, err := http.NewResponseController(sw.w).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, rw.Reader, nil
+}
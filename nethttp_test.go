@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMountHTTPHandler(t *testing.T) {
+	server, cleanup := CreateDefaultServer()
+	defer cleanup()
+
+	server.Handle("GET", "/legacy/:name", FromHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Legacy", "yes")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "hello %s %s", r.PathValue("name"), r.URL.Query().Get("q"))
+	})))
+	server.Handle("POST", "/legacy/echo", FromHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})))
+	runServer(t, &server)
+
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", "/legacy/gopher?q=1")
+	rt += fmt.Sprintf("Host: %v\r\n", "127.0.0.1:1337")
+	rt += fmt.Sprintf("\r\n")
+	res, content := sendRequest(t, rt)
+	if res.StatusCode != http.StatusCreated || content != "hello gopher 1" || res.Header.Get("X-Legacy") != "yes" {
+		t.Fatalf(`Wrong mounted handler response got: %d %q`, res.StatusCode, content)
+	}
+
+	rt = fmt.Sprintf("POST %v HTTP/1.1\r\n", "/legacy/echo")
+	rt += fmt.Sprintf("Host: %v\r\n", "127.0.0.1:1337")
+	rt += fmt.Sprintf("Transfer-Encoding: chunked\r\n")
+	rt += fmt.Sprintf("\r\n")
+	rt += "5\r\nhello\r\n0\r\n\r\n"
+	res, content = sendRequest(t, rt)
+	if res.StatusCode != HTTP_OK || content != "hello" {
+		t.Fatalf(`Wrong mounted echo response got: %d %q`, res.StatusCode, content)
+	}
+}
+
+func TestServerAsHTTPHandler(t *testing.T) {
+	server, cleanup := CreateDefaultServer()
+	defer cleanup()
+
+	server.HandleFunc("PUT", "/users/:id", func(w ResponseWriter, req *Request) {
+		content, _ := io.ReadAll(req.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintf(w, "%s=%s", req.Param("id"), content)
+	})
+
+	ts := httptest.NewServer(server.HTTPHandler())
+	defer ts.Close()
+
+	req, _ := http.NewRequest("PUT", ts.URL+"/users/7", strings.NewReader("alice"))
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf(`Failed to send request through net/http %s`, err)
+	}
+	content, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != HTTP_OK || string(content) != "7=alice" {
+		t.Fatalf(`Wrong response through net/http got: %d %q`, res.StatusCode, content)
+	}
+
+	res, err = ts.Client().Get(ts.URL + "/")
+	if err != nil {
+		t.Fatalf(`Failed to get template through net/http %s`, err)
+	}
+	content, _ = io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != HTTP_OK || !strings.Contains(string(content), "<html") || res.Header.Get("Content-Type") != "text/html" {
+		t.Fatalf(`Wrong template response through net/http got: %d`, res.StatusCode)
+	}
+
+	res, err = ts.Client().Post(ts.URL+"/", "text/plain", nil)
+	if err != nil {
+		t.Fatalf(`Failed to post through net/http %s`, err)
+	}
+	res.Body.Close()
+	if res.StatusCode != HTTP_METHOD_NOT_ALLOWED || res.Header.Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Fatalf(`Expected 405 through net/http got: %d %q`, res.StatusCode, res.Header.Get("Allow"))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errRangeNotSatisfiable = errors.New("no range overlaps the file")
+
+// byteRange is a part of a file of length bytes starting at start
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange returns the satisfiable ranges of a Range header for a file of
+// size bytes. Malformed headers return a nil slice and are ignored, as
+// RFC 9110 allows, errRangeNotSatisfiable means none of the ranges overlap.
+func parseRange(value string, size int64) ([]byteRange, error) {
+	specs, ok := strings.CutPrefix(value, "bytes=")
+	if !ok {
+		return nil, nil
+	}
+	var ranges []byteRange
+	var total int64
+	for _, spec := range strings.Split(specs, ",") {
+		spec = trimOWS(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, nil
+		}
+		var r byteRange
+		if first == "" {
+			// A suffix range asks for the last bytes of the file
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 {
+				continue
+			}
+			r.start = max(size-n, 0)
+			r.length = size - r.start
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, nil
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r.start = start
+			r.length = min(end, size-1) - start + 1
+		}
+		ranges = append(ranges, r)
+		total += r.length
+	}
+	if len(ranges) == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+	// Many small or overlapping ranges cost more than the file itself
+	if total > size {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches reports whether the Range of req still applies. An
+// If-Range validator that doesn't match the file asks for all of it:
+// entity tags are compared strongly and dates have to equal Last-Modified.
+func ifRangeMatches(req *Request, etag string, modified time.Time) bool {
+	value := trimOWS(req.Header.Get("If-Range"))
+	if value == "" {
+		return true
+	}
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/") {
+		return etagListMatches(value, etag, false)
+	}
+	date, ok := parseHTTPDate(value)
+	return ok && !modified.IsZero() && date.Equal(modified.Truncate(time.Second))
+}
+
+// serveRanges answers with the ranges of file, a single one directly and
+// several as multipart/byteranges
+func (server *Server) serveRanges(w ResponseWriter, file io.ReadSeeker, contentType string, ranges []byteRange, size int64) {
+	header := w.Header()
+	if len(ranges) == 1 {
+		r := ranges[0]
+		header.Set("Content-Range", r.contentRange(size))
+		header.Set("Content-Length", strconv.FormatInt(r.length, 10))
+		w.WriteHeader(HTTP_PARTIAL_CONTENT)
+		if err := sendRange(w, file, r); err != nil && server.debug {
+			fmt.Println("Failed to send file:", err)
+		}
+		return
+	}
+
+	// The part headers are known up front, so the length can be sent
+	boundary := multipart.NewWriter(io.Discard).Boundary()
+	partHeaders := make([]string, len(ranges))
+	closing := "\r\n--" + boundary + "--\r\n"
+	length := int64(len(closing))
+	for i, r := range ranges {
+		partHeaders[i] = fmt.Sprintf("\r\n--%s\r\nContent-Type: %s\r\nContent-Range: %s\r\n\r\n", boundary, contentType, r.contentRange(size))
+		length += int64(len(partHeaders[i])) + r.length
+	}
+	header.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(HTTP_PARTIAL_CONTENT)
+	for i, r := range ranges {
+		if _, err := io.WriteString(w, partHeaders[i]); err != nil {
+			return
+		}
+		if err := sendRange(w, file, r); err != nil {
+			if server.debug {
+				fmt.Println("Failed to send file:", err)
+			}
+			return
+		}
+	}
+	io.WriteString(w, closing)
+}
+
+func sendRange(w io.Writer, file io.ReadSeeker, r byteRange) error {
+	if _, err := file.Seek(r.start, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, file, r.length)
+	return err
+}
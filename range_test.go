@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	cases := []struct {
+		value  string
+		ranges []byteRange
+		err    error
+	}{
+		{"bytes=0-4", []byteRange{{0, 5}}, nil},
+		{"bytes=6-", []byteRange{{6, 5}}, nil},
+		{"bytes=-3", []byteRange{{8, 3}}, nil},
+		{"bytes=-20", []byteRange{{0, 11}}, nil},
+		{"bytes=8-100", []byteRange{{8, 3}}, nil},
+		{"bytes=0-1, 4-5", []byteRange{{0, 2}, {4, 2}}, nil},
+		{"bytes=0-1,20-30", []byteRange{{0, 2}}, nil},
+		{"bytes=11-", nil, errRangeNotSatisfiable},
+		{"bytes=-0", nil, errRangeNotSatisfiable},
+		{"bytes=5-2", nil, nil},
+		{"bytes=a-b", nil, nil},
+		{"bytes=1", nil, nil},
+		{"lines=1-2", nil, nil},
+		// Ranges adding up to more than the file are ignored
+		{"bytes=0-,0-,0-", nil, nil},
+	}
+	for _, c := range cases {
+		ranges, err := parseRange(c.value, 11)
+		if err != c.err || !reflect.DeepEqual(ranges, c.ranges) {
+			t.Fatalf(`Wrong ranges for %q got: %v %v`, c.value, ranges, err)
+		}
+	}
+}
+
+func getRange(t *testing.T, addr string, target string, headers string) (*http.Response, string) {
+	return sendRequestTo(t, addr, fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", target, addr, headers))
+}
+
+func TestServeFileRanges(t *testing.T) {
+	addr, cleanup := runStaticServer(t, false)
+	defer cleanup()
+
+	res, content := getRange(t, addr, "/static/hello.txt", "")
+	if res.StatusCode != HTTP_OK || res.Header.Get("Accept-Ranges") != "bytes" || content != "hello world" {
+		t.Fatalf(`Wrong full response got: %d %q`, res.StatusCode, content)
+	}
+
+	res, content = getRange(t, addr, "/static/hello.txt", "Range: bytes=6-\r\n")
+	if res.StatusCode != HTTP_PARTIAL_CONTENT || content != "world" ||
+		res.Header.Get("Content-Range") != "bytes 6-10/11" || res.Header.Get("Content-Length") != "5" {
+		t.Fatalf(`Wrong single range got: %d %q %q`, res.StatusCode, res.Header.Get("Content-Range"), content)
+	}
+
+	res, content = getRange(t, addr, "/static/hello.txt", "Range: bytes=0-1, -3\r\n")
+	mediaType, params, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if res.StatusCode != HTTP_PARTIAL_CONTENT || mediaType != "multipart/byteranges" {
+		t.Fatalf(`Wrong multiple ranges got: %d %q`, res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	if res.Header.Get("Content-Length") != fmt.Sprint(len(content)) {
+		t.Fatalf(`Wrong multipart length got: %q for %d bytes`, res.Header.Get("Content-Length"), len(content))
+	}
+	parts := multipart.NewReader(strings.NewReader(content), params["boundary"])
+	expected := []struct{ contentRange, data string }{{"bytes 0-1/11", "he"}, {"bytes 8-10/11", "rld"}}
+	for _, e := range expected {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatalf(`Failed to read part %s`, err)
+		}
+		data, _ := io.ReadAll(part)
+		if part.Header.Get("Content-Range") != e.contentRange || part.Header.Get("Content-Type") != "text/plain; charset=utf-8" || string(data) != e.data {
+			t.Fatalf(`Wrong part got: %v %q`, part.Header, data)
+		}
+	}
+	if _, err := parts.NextPart(); err != io.EOF {
+		t.Fatalf(`Expected the end of the parts got: %v`, err)
+	}
+
+	res, content = getRange(t, addr, "/static/hello.txt", "Range: bytes=20-\r\n")
+	if res.StatusCode != HTTP_RANGE_NOT_SATISFIABLE || res.Header.Get("Content-Range") != "bytes */11" || content != "" {
+		t.Fatalf(`Wrong unsatisfiable range got: %d %q`, res.StatusCode, res.Header.Get("Content-Range"))
+	}
+
+	// A stale If-Range validator gets the whole file
+	res, content = getRange(t, addr, "/static/hello.txt", "Range: bytes=6-\r\nIf-Range: Mon, 02 Jan 2006 15:04:05 GMT\r\n")
+	if res.StatusCode != HTTP_OK || content != "hello world" {
+		t.Fatalf(`Wrong response to a stale If-Range got: %d %q`, res.StatusCode, content)
+	}
+
+	// HEAD requests and malformed ranges get the whole file too
+	res, _ = sendRequestTo(t, addr, fmt.Sprintf("HEAD /static/hello.txt HTTP/1.1\r\nHost: %s\r\nRange: bytes=0-1\r\n\r\n", addr))
+	if res.StatusCode != HTTP_OK || res.Header.Get("Content-Length") != "11" {
+		t.Fatalf(`Wrong HEAD response to a range got: %d`, res.StatusCode)
+	}
+	res, content = getRange(t, addr, "/static/hello.txt", "Range: bytes=4-1\r\n")
+	if res.StatusCode != HTTP_OK || content != "hello world" {
+		t.Fatalf(`Wrong response to a malformed range got: %d %q`, res.StatusCode, content)
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strings"
+)
+
+// Request is a single parsed HTTP/1.x request.
+// Path is the percent-decoded path of the request target,
+// RawPath and RawQuery keep the target exactly as it was sent.
+type Request struct {
+	Method     string
+	Target     string
+	Path       string
+	RawPath    string
+	RawQuery   string
+	Proto      string
+	ProtoMajor int
+	ProtoMinor int
+	Header     Header
+	Host       string
+	RemoteAddr string
+	// ContentLength is -1 when the length is not known up front
+	ContentLength int64
+	Body          io.Reader
+	// Trailer is filled once a chunked Body has been read to the end
+	Trailer Header
+	// TLS describes the connection of requests received over HTTPS, nil otherwise
+	TLS    *tls.ConnectionState
+	params []routeParam
+	// conn is the connection the request arrived on, nil for adapted requests
+	conn net.Conn
+}
+
+// Param returns the value matched by the named parameter or catch-all
+// of the route pattern, "" when the route has no such parameter
+func (req *Request) Param(name string) string {
+	for _, param := range req.params {
+		if param.name == name {
+			return param.value
+		}
+	}
+	return ""
+}
+
+// Query parses RawQuery, malformed pairs are dropped
+func (req *Request) Query() url.Values {
+	values, _ := url.ParseQuery(req.RawQuery)
+	return values
+}
+
+// requestError is returned by the parser for requests that have to be
+// answered with an error status instead of being served.
+type requestError struct {
+	code   int
+	reason string
+}
+
+func (err *requestError) Error() string {
+	return err.reason
+}
+
+var (
+	errMalformedRequestLine = &requestError{HTTP_BAD_REQUEST, "malformed request line"}
+	errUnknownMethod        = &requestError{HTTP_BAD_REQUEST, "unknown method"}
+	errMalformedTarget      = &requestError{HTTP_BAD_REQUEST, "malformed request target"}
+	errMalformedHeader      = &requestError{HTTP_BAD_REQUEST, "malformed header field"}
+	errDuplicateHost        = &requestError{HTTP_BAD_REQUEST, "more than one Host header"}
+	errBadContentLength     = &requestError{HTTP_BAD_REQUEST, "invalid Content-Length"}
+	errBodyTooLarge         = &requestError{HTTP_CONTENT_TOO_LARGE, "request body too large"}
+	errUnsupportedEncoding  = &requestError{HTTP_NOT_IMPLEMENTED, "unsupported transfer coding"}
+	errBadTransferEncoding  = &requestError{HTTP_BAD_REQUEST, "invalid Transfer-Encoding"}
+	errConflictingFraming   = &requestError{HTTP_BAD_REQUEST, "both Transfer-Encoding and Content-Length"}
+	errURITooLong           = &requestError{HTTP_URI_TOO_LONG, "request line too long"}
+	errHeaderTooLarge       = &requestError{HTTP_REQUEST_HEADER_FIELDS_TOO_LARGE, "header section too large"}
+	errVersionNotSupported  = &requestError{HTTP_VERSION_NOT_SUPPORTED, "http version not supported"}
+)
+
+// Size limits applied while parsing, anything above is rejected
+// with 414 for the request line, 431 for the header section and 413 for the body.
+type requestLimits struct {
+	maxRequestLineBytes int
+	maxHeaderBytes      int
+	maxHeaderCount      int
+	maxBodyBytes        int64
+}
+
+func defaultRequestLimits() requestLimits {
+	return requestLimits{
+		maxRequestLineBytes: 8192,
+		maxHeaderBytes:      65536,
+		maxHeaderCount:      100,
+		maxBodyBytes:        10 << 20,
+	}
+}
+
+var methods = map[string]int{
+	"GET":     GET,
+	"POST":    POST,
+	"PUT":     PUT,
+	"DELETE":  DELETE,
+	"PATCH":   PATCH,
+	"HEAD":    HEAD,
+	"OPTIONS": OPTIONS,
+}
+
+// readRequest parses the request line and header section from br.
+// It returns io.EOF when the peer closed the connection before sending anything.
+func readRequest(br *bufio.Reader, limits requestLimits) (*Request, error) {
+	var line []byte
+	var err error
+	// Recipients should ignore empty lines received before the request line
+	for len(line) == 0 {
+		line, _, err = readLine(br, limits.maxRequestLineBytes, errURITooLong)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req := &Request{Header: make(Header)}
+	if err := parseRequestLine(req, string(line)); err != nil {
+		return nil, err
+	}
+
+	if err := readHeader(br, req.Header, limits); err != nil {
+		return nil, err
+	}
+
+	hosts := req.Header.Values("Host")
+	if len(hosts) > 1 {
+		return nil, errDuplicateHost
+	}
+	// Host from an absolute-form target takes precedence over the header
+	if req.Host == "" && len(hosts) == 1 {
+		req.Host = hosts[0]
+	}
+
+	if err := setupBody(req, br, limits); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
+// setupBody points req.Body at the message body framed by Transfer-Encoding
+// or Content-Length. The body is read lazily from br so handlers can stream
+// large uploads. Ambiguous framing is rejected since a proxy in front of us
+// might pick the other length and smuggle a second request inside the body.
+func setupBody(req *Request, br *bufio.Reader, limits requestLimits) error {
+	if req.Header.Has("Transfer-Encoding") {
+		if req.Header.Has("Content-Length") {
+			return errConflictingFraming
+		}
+		// HTTP/1.0 recipients may not understand chunked framing at all
+		if req.ProtoMinor == 0 {
+			return errBadTransferEncoding
+		}
+		if err := checkTransferEncoding(req.Header.Values("Transfer-Encoding")); err != nil {
+			return err
+		}
+		req.ContentLength = -1
+		req.Trailer = make(Header)
+		req.Body = newChunkedReader(br, limits, req.Trailer)
+		return nil
+	}
+
+	req.ContentLength = 0
+	req.Body = noBody{}
+	if !req.Header.Has("Content-Length") {
+		return nil
+	}
+
+	length, err := parseContentLength(req.Header.Values("Content-Length"))
+	if err != nil {
+		return err
+	}
+	if length > limits.maxBodyBytes {
+		return errBodyTooLarge
+	}
+
+	req.ContentLength = length
+	if length > 0 {
+		req.Body = &body{src: br, remaining: length}
+	}
+	return nil
+}
+
+// checkTransferEncoding accepts only a single chunked coding,
+// chunked has to be the final coding of every request with a body.
+func checkTransferEncoding(values []string) error {
+	var codings []string
+	for _, value := range values {
+		for _, coding := range strings.Split(value, ",") {
+			coding = strings.ToLower(trimOWS(coding))
+			if coding == "" {
+				continue
+			}
+			codings = append(codings, coding)
+		}
+	}
+	if len(codings) == 0 || codings[len(codings)-1] != "chunked" {
+		return errBadTransferEncoding
+	}
+	for _, coding := range codings[:len(codings)-1] {
+		if coding == "chunked" {
+			return errBadTransferEncoding
+		}
+	}
+	if len(codings) > 1 {
+		return errUnsupportedEncoding
+	}
+	return nil
+}
+
+// parseContentLength accepts repeated fields and comma separated lists
+// only when every member carries the same value.
+func parseContentLength(values []string) (int64, error) {
+	length := int64(-1)
+	for _, value := range values {
+		for _, member := range strings.Split(value, ",") {
+			member = trimOWS(member)
+			if member == "" || len(member) > 18 {
+				return 0, errBadContentLength
+			}
+			n := int64(0)
+			for i := 0; i < len(member); i++ {
+				if member[i] < '0' || member[i] > '9' {
+					return 0, errBadContentLength
+				}
+				n = n*10 + int64(member[i]-'0')
+			}
+			if length != -1 && n != length {
+				return 0, errBadContentLength
+			}
+			length = n
+		}
+	}
+	return length, nil
+}
+
+// body reads exactly remaining bytes of a Content-Length framed message.
+// A connection closed before the declared length is io.ErrUnexpectedEOF.
+type body struct {
+	src       io.Reader
+	remaining int64
+}
+
+func (b *body) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.src.Read(p)
+	b.remaining -= int64(n)
+	if err == io.EOF {
+		if b.remaining > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+	return n, err
+}
+
+type noBody struct{}
+
+func (noBody) Read([]byte) (int, error) {
+	return 0, io.EOF
+}
+
+func parseRequestLine(req *Request, line string) error {
+	method, rest, found := strings.Cut(line, " ")
+	if !found {
+		return errMalformedRequestLine
+	}
+	target, proto, found := strings.Cut(rest, " ")
+	if !found || strings.Contains(proto, " ") || !isToken(method) || target == "" {
+		return errMalformedRequestLine
+	}
+
+	major, minor, ok := parseVersion(proto)
+	if !ok {
+		return errMalformedRequestLine
+	}
+	if major != 1 {
+		return errVersionNotSupported
+	}
+	if _, ok := methods[method]; !ok {
+		return errUnknownMethod
+	}
+
+	req.Method = method
+	req.Proto = proto
+	req.ProtoMajor = major
+	req.ProtoMinor = minor
+	req.Target = target
+
+	return parseTarget(req, target)
+}
+
+// parseVersion accepts exactly HTTP/DIGIT.DIGIT
+func parseVersion(proto string) (int, int, bool) {
+	if len(proto) != 8 || !strings.HasPrefix(proto, "HTTP/") || proto[6] != '.' {
+		return 0, 0, false
+	}
+	major, minor := proto[5], proto[7]
+	if major < '0' || major > '9' || minor < '0' || minor > '9' {
+		return 0, 0, false
+	}
+	return int(major - '0'), int(minor - '0'), true
+}
+
+// parseTarget fills the path and query from an origin-form ("/a?b")
+// or absolute-form ("http://host/a?b") target.
+func parseTarget(req *Request, target string) error {
+	for i := 0; i < len(target); i++ {
+		if target[i] <= ' ' || target[i] >= 0x7f || target[i] == '#' {
+			return errMalformedTarget
+		}
+	}
+
+	// The asterisk-form only exists for server wide OPTIONS requests
+	if target == "*" {
+		if req.Method != "OPTIONS" {
+			return errMalformedTarget
+		}
+		req.Path = target
+		req.RawPath = target
+		return nil
+	}
+
+	if !strings.HasPrefix(target, "/") {
+		u, err := url.ParseRequestURI(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errMalformedTarget
+		}
+		req.Host = u.Host
+		target = u.RequestURI()
+	}
+
+	rawPath, rawQuery, _ := strings.Cut(target, "?")
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return errMalformedTarget
+	}
+
+	req.Path = path
+	req.RawPath = rawPath
+	req.RawQuery = rawQuery
+	return nil
+}
+
+// readHeader reads header fields until the empty line ending the section.
+// Obsolete line folding is replaced with a single space as RFC 9112 allows.
+func readHeader(br *bufio.Reader, header Header, limits requestLimits) error {
+	remaining := limits.maxHeaderBytes
+	count := 0
+	lastKey := ""
+
+	for {
+		line, n, err := readLine(br, remaining, errHeaderTooLarge)
+		if err != nil {
+			return err
+		}
+		remaining -= n
+		if len(line) == 0 {
+			return nil
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if lastKey == "" {
+				return errMalformedHeader
+			}
+			folded := trimOWS(string(line))
+			if !isValidFieldValue(folded) {
+				return errMalformedHeader
+			}
+			values := header[lastKey]
+			values[len(values)-1] += " " + folded
+			continue
+		}
+
+		name, value, found := strings.Cut(string(line), ":")
+		// No whitespace is allowed between the field name and colon
+		if !found || !isToken(name) {
+			return errMalformedHeader
+		}
+		value = trimOWS(value)
+		if !isValidFieldValue(value) {
+			return errMalformedHeader
+		}
+
+		count++
+		if count > limits.maxHeaderCount {
+			return errHeaderTooLarge
+		}
+		header.Add(name, value)
+		lastKey = textproto.CanonicalMIMEHeaderKey(name)
+	}
+}
+
+// readLine reads a CRLF or bare LF terminated line and returns it without
+// the terminator, together with the number of bytes consumed.
+// tooLong is returned once the line exceeds limit bytes.
+func readLine(br *bufio.Reader, limit int, tooLong error) ([]byte, int, error) {
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if len(line)+len(chunk) > limit {
+			return nil, 0, tooLong
+		}
+		line = append(line, chunk...)
+		if err == nil {
+			break
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			return nil, 0, io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+
+	n := len(line)
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, n, nil
+}
+
+func trimOWS(value string) string {
+	return strings.Trim(value, " \t")
+}
+
+// isToken reports whether s is a non-empty RFC 9110 token
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			continue
+		}
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", rune(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// isValidFieldValue rejects control characters other than horizontal tab
+func isValidFieldValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
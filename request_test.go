@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func parseRequestString(raw string) (*Request, error) {
+	return readRequest(bufio.NewReader(strings.NewReader(raw)), defaultRequestLimits())
+}
+
+func TestParseValidRequest(t *testing.T) {
+	raw := "GET /some%20dir/index.html?a=1&b=2 HTTP/1.1\r\n"
+	raw += "Host: 127.0.0.1:1337\r\n"
+	raw += "X-Custom:   padded value \t\r\n"
+	raw += "x-custom: second\r\n"
+	raw += "\r\n"
+
+	req, err := parseRequestString(raw)
+	if err != nil {
+		t.Fatalf(`Failed to parse valid request %s`, err)
+	}
+	if req.Method != "GET" || req.Proto != "HTTP/1.1" || req.ProtoMajor != 1 || req.ProtoMinor != 1 {
+		t.Fatalf(`Wrong request line got: %s %s`, req.Method, req.Proto)
+	}
+	if req.Path != "/some dir/index.html" || req.RawPath != "/some%20dir/index.html" {
+		t.Fatalf(`Wrong path got: %s raw: %s`, req.Path, req.RawPath)
+	}
+	if req.Query().Get("b") != "2" {
+		t.Fatalf(`Wrong query got: %s`, req.RawQuery)
+	}
+	if req.Host != "127.0.0.1:1337" {
+		t.Fatalf(`Wrong host got: %s`, req.Host)
+	}
+	values := req.Header.Values("X-CUSTOM")
+	if len(values) != 2 || values[0] != "padded value" || values[1] != "second" {
+		t.Fatalf(`Wrong header values got: %q`, values)
+	}
+}
+
+func TestParseFoldedHeader(t *testing.T) {
+	raw := "GET / HTTP/1.0\r\n"
+	raw += "X-Folded: first\r\n"
+	raw += " \t second\r\n"
+	raw += "\r\n"
+
+	req, err := parseRequestString(raw)
+	if err != nil {
+		t.Fatalf(`Failed to parse folded header %s`, err)
+	}
+	if req.Header.Get("X-Folded") != "first second" {
+		t.Fatalf(`Wrong folded value got: %q`, req.Header.Get("X-Folded"))
+	}
+}
+
+func TestParseAbsoluteTarget(t *testing.T) {
+	req, err := parseRequestString("GET http://example.com:8080/a?b=c HTTP/1.1\r\nHost: other\r\n\r\n")
+	if err != nil {
+		t.Fatalf(`Failed to parse absolute-form target %s`, err)
+	}
+	if req.Host != "example.com:8080" || req.Path != "/a" || req.RawQuery != "b=c" {
+		t.Fatalf(`Wrong absolute-form parse got host: %s path: %s query: %s`, req.Host, req.Path, req.RawQuery)
+	}
+}
+
+func TestParseInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		code int
+	}{
+		{"unknown method", "DON'T / HTTP/1.0\r\n\r\n", HTTP_BAD_REQUEST},
+		{"bad version", "GET / HP/1.0\r\n\r\n", HTTP_BAD_REQUEST},
+		{"unsupported version", "GET / HTTP/2.0\r\n\r\n", HTTP_VERSION_NOT_SUPPORTED},
+		{"double space", "GET  / HTTP/1.1\r\n\r\n", HTTP_BAD_REQUEST},
+		{"missing target", "GET HTTP/1.1\r\n\r\n", HTTP_BAD_REQUEST},
+		{"relative target", "GET index.html HTTP/1.1\r\n\r\n", HTTP_BAD_REQUEST},
+		{"bad escape", "GET /%zz HTTP/1.1\r\n\r\n", HTTP_BAD_REQUEST},
+		{"space before colon", "GET / HTTP/1.1\r\nHost : a\r\n\r\n", HTTP_BAD_REQUEST},
+		{"no colon", "GET / HTTP/1.1\r\nHost\r\n\r\n", HTTP_BAD_REQUEST},
+		{"fold first", "GET / HTTP/1.1\r\n folded\r\n\r\n", HTTP_BAD_REQUEST},
+		{"control char", "GET / HTTP/1.1\r\nX-A: a\x00b\r\n\r\n", HTTP_BAD_REQUEST},
+		{"two hosts", "GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", HTTP_BAD_REQUEST},
+		{"long target", "GET /" + strings.Repeat("a", 9000) + " HTTP/1.1\r\n\r\n", HTTP_URI_TOO_LONG},
+		{"large header", "GET / HTTP/1.1\r\nX-A: " + strings.Repeat("a", 70000) + "\r\n\r\n", HTTP_REQUEST_HEADER_FIELDS_TOO_LARGE},
+		{"many headers", "GET / HTTP/1.1\r\n" + strings.Repeat("X-A: a\r\n", 101) + "\r\n", HTTP_REQUEST_HEADER_FIELDS_TOO_LARGE},
+	}
+
+	for _, test := range tests {
+		_, err := parseRequestString(test.raw)
+		var reqErr *requestError
+		if !errors.As(err, &reqErr) {
+			t.Fatalf(`%s: expected request error got: %v`, test.name, err)
+		}
+		if reqErr.code != test.code {
+			t.Fatalf(`%s: expected code %d got: %d`, test.name, test.code, reqErr.code)
+		}
+	}
+}
+
+func TestParseTruncatedRequest(t *testing.T) {
+	if _, err := parseRequestString(""); err != io.EOF {
+		t.Fatalf(`Expected EOF for empty input got: %v`, err)
+	}
+	if _, err := parseRequestString("GET / HTTP/1.1\r\nHost: a"); err != io.ErrUnexpectedEOF {
+		t.Fatalf(`Expected unexpected EOF for truncated input got: %v`, err)
+	}
+}
+
+func TestParseRequestBody(t *testing.T) {
+	raw := "POST /post HTTP/1.1\r\n"
+	raw += "Host: 127.0.0.1:1337\r\n"
+	raw += "Content-Length: 11, 11\r\n"
+	raw += "\r\n"
+	raw += "hello worldGET / HTTP/1.1\r\n"
+
+	req, err := parseRequestString(raw)
+	if err != nil {
+		t.Fatalf(`Failed to parse request with body %s`, err)
+	}
+	if req.ContentLength != 11 {
+		t.Fatalf(`Wrong content length got: %d`, req.ContentLength)
+	}
+	content, err := io.ReadAll(req.Body)
+	if err != nil || string(content) != "hello world" {
+		t.Fatalf(`Wrong body got: %q error: %v`, content, err)
+	}
+}
+
+func TestParseInvalidContentLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		code  int
+	}{
+		{"negative", "-1", HTTP_BAD_REQUEST},
+		{"not a number", "ten", HTTP_BAD_REQUEST},
+		{"mismatched list", "5, 6", HTTP_BAD_REQUEST},
+		{"too large", "20000000", HTTP_CONTENT_TOO_LARGE},
+	}
+
+	for _, test := range tests {
+		_, err := parseRequestString("POST / HTTP/1.1\r\nContent-Length: " + test.value + "\r\n\r\n")
+		var reqErr *requestError
+		if !errors.As(err, &reqErr) || reqErr.code != test.code {
+			t.Fatalf(`%s: expected code %d got: %v`, test.name, test.code, err)
+		}
+	}
+}
+
+func TestTruncatedRequestBody(t *testing.T) {
+	req, err := parseRequestString("POST / HTTP/1.1\r\nContent-Length: 10\r\n\r\nshort")
+	if err != nil {
+		t.Fatalf(`Failed to parse request %s`, err)
+	}
+	if _, err := io.ReadAll(req.Body); err != io.ErrUnexpectedEOF {
+		t.Fatalf(`Expected unexpected EOF for truncated body got: %v`, err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	errBodyNotAllowed = errors.New("response status does not allow a body")
+	errTooMuchContent = errors.New("wrote more than the declared Content-Length")
+	errHijacked       = errors.New("connection was already hijacked or answered")
+	errNoHijack       = errors.New("connection can't be hijacked")
+)
+
+// response is the HTTP/1.x response to a single request.
+// The body goes out with the Content-Length set by the caller, chunked to
+// HTTP/1.1 clients when no length was set, and delimited by closing the
+// connection for HTTP/1.0 clients.
+type response struct {
+	w             *bufio.Writer
+	req           *Request
+	header        Header
+	status        int
+	wroteHeader   bool
+	bodyAllowed   bool
+	isHead        bool
+	chunked       *chunkedWriter
+	contentLength int64
+	written       int64
+	// closeAfter is set when the connection can't be reused after this response
+	closeAfter bool
+	// shuttingDown reports a server shutdown that started while the handler ran
+	shuttingDown func() bool
+	// hijack hands out the connection, nil when it can't be taken over
+	hijack   func() (net.Conn, *bufio.Reader)
+	hijacked bool
+	// closeNotify starts watching the connection, nil when it can't be watched
+	closeNotify func() <-chan struct{}
+}
+
+func newResponse(w io.Writer, req *Request) *response {
+	return &response{
+		w:             bufio.NewWriter(w),
+		req:           req,
+		header:        make(Header),
+		contentLength: -1,
+	}
+}
+
+func (res *response) Header() Header {
+	return res.header
+}
+
+// WriteHeader sends the status line and header fields, later calls are ignored
+func (res *response) WriteHeader(code int) {
+	if res.wroteHeader {
+		return
+	}
+	res.wroteHeader = true
+	res.status = code
+
+	header := res.header
+	if !header.Has("Server") {
+		header.Set("Server", "Custom/Server")
+	}
+
+	res.bodyAllowed = code >= 200 && code != HTTP_NO_CONTENT && code != HTTP_NOT_MODIFIED
+	// HEAD responses carry the GET header fields, so Content-Length stays
+	res.isHead = res.req.Method == "HEAD"
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length >= 0 {
+		res.contentLength = length
+	} else {
+		header.Del("Content-Length")
+	}
+
+	if hasToken(header.Values("Connection"), "close") || (res.shuttingDown != nil && res.shuttingDown()) {
+		res.closeAfter = true
+	}
+
+	header.Del("Transfer-Encoding")
+	if res.bodyAllowed && !res.isHead && res.contentLength < 0 {
+		if res.req.ProtoMinor >= 1 {
+			header.Set("Transfer-Encoding", "chunked")
+			res.chunked = &chunkedWriter{w: res.w}
+		} else {
+			res.closeAfter = true
+		}
+	}
+	if res.closeAfter {
+		header.Set("Connection", "close")
+	} else if res.req.ProtoMinor == 0 {
+		// HTTP/1.0 clients assume the connection closes unless told otherwise
+		header.Set("Connection", "keep-alive")
+	}
+
+	fmt.Fprintf(res.w, "HTTP/1.1 %v %s\r\n", code, statusText(code))
+	writeHeaderFields(res.w, header)
+	io.WriteString(res.w, "\r\n")
+}
+
+func (res *response) Write(p []byte) (int, error) {
+	if !res.wroteHeader {
+		res.WriteHeader(HTTP_OK)
+	}
+	if !res.bodyAllowed {
+		return 0, errBodyNotAllowed
+	}
+	if res.isHead {
+		return len(p), nil
+	}
+	if res.contentLength >= 0 && res.written+int64(len(p)) > res.contentLength {
+		return 0, errTooMuchContent
+	}
+
+	res.written += int64(len(p))
+	if res.chunked != nil {
+		return res.chunked.Write(p)
+	}
+	return res.w.Write(p)
+}
+
+// Flush sends everything written so far to the client
+func (res *response) Flush() error {
+	if !res.wroteHeader {
+		res.WriteHeader(HTTP_OK)
+	}
+	return res.w.Flush()
+}
+
+// Hijack takes the connection over from the server, which neither writes
+// a response nor reads further requests from it. It is closed once the
+// handler returns.
+func (res *response) Hijack() (net.Conn, *bufio.Reader, error) {
+	if res.hijack == nil {
+		return nil, nil, errNoHijack
+	}
+	if res.wroteHeader {
+		return nil, nil, errHijacked
+	}
+	res.wroteHeader = true
+	res.hijacked = true
+	conn, br := res.hijack()
+	return conn, br, nil
+}
+
+// CloseNotify fires when the client closes the connection or the server
+// shuts down. Watching the connection means it can't serve further
+// requests, so it is closed after this response.
+func (res *response) CloseNotify() <-chan struct{} {
+	if res.closeNotify == nil {
+		return nil
+	}
+	res.closeAfter = true
+	return res.closeNotify()
+}
+
+// finish completes the response after the handler returned
+func (res *response) finish() error {
+	if !res.wroteHeader {
+		// Nothing was written so the length is known to be zero
+		if !res.header.Has("Content-Length") {
+			res.header.Set("Content-Length", "0")
+		}
+		res.WriteHeader(HTTP_OK)
+	}
+	if res.chunked != nil {
+		if err := res.chunked.Close(nil); err != nil {
+			return err
+		}
+	}
+	// The client would wait forever for the missing bytes
+	if res.contentLength >= 0 && res.written < res.contentLength && res.bodyAllowed && !res.isHead {
+		res.closeAfter = true
+	}
+	return res.w.Flush()
+}
+
+// writeHeaderFields writes header sorted by name. Line breaks inside
+// values are replaced so a value can't inject extra fields.
+func writeHeaderFields(w io.Writer, header Header) {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sanitize := strings.NewReplacer("\r", " ", "\n", " ")
+	for _, key := range keys {
+		for _, value := range header[key] {
+			fmt.Fprintf(w, "%s: %s\r\n", key, sanitize.Replace(value))
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestResponseWithContentLength(t *testing.T) {
+	var buff bytes.Buffer
+	res := newResponse(&buff, &Request{ProtoMajor: 1, ProtoMinor: 1})
+	res.Header().Set("Content-Length", "5")
+	res.Write([]byte("hello"))
+	if _, err := res.Write([]byte("!")); err != errTooMuchContent {
+		t.Fatalf(`Expected error for writing past Content-Length got: %v`, err)
+	}
+	res.finish()
+
+	expected := "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nServer: Custom/Server\r\n\r\nhello"
+	if buff.String() != expected {
+		t.Fatalf(`Wrong response got: %q expected: %q`, buff.String(), expected)
+	}
+}
+
+func TestResponseChunkedWithoutLength(t *testing.T) {
+	var buff bytes.Buffer
+	res := newResponse(&buff, &Request{ProtoMajor: 1, ProtoMinor: 1})
+	res.Write([]byte("hello"))
+	res.Flush()
+	res.Write([]byte(" world"))
+	res.finish()
+
+	if !strings.Contains(buff.String(), "Transfer-Encoding: chunked\r\n") {
+		t.Fatalf(`Expected chunked response got: %q`, buff.String())
+	}
+	if !strings.HasSuffix(buff.String(), "\r\n\r\n5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n") {
+		t.Fatalf(`Wrong chunked body got: %q`, buff.String())
+	}
+	if res.closeAfter {
+		t.Fatalf(`Chunked response should not need the connection closed`)
+	}
+}
+
+func TestResponseCloseDelimitedForHTTP10(t *testing.T) {
+	var buff bytes.Buffer
+	res := newResponse(&buff, &Request{ProtoMajor: 1, ProtoMinor: 0})
+	res.Write([]byte("hello"))
+	res.finish()
+
+	if !res.closeAfter || !strings.Contains(buff.String(), "Connection: close\r\n") {
+		t.Fatalf(`Expected close delimited response got: %q`, buff.String())
+	}
+	if strings.Contains(buff.String(), "Transfer-Encoding") || !strings.HasSuffix(buff.String(), "\r\n\r\nhello") {
+		t.Fatalf(`Wrong HTTP/1.0 body got: %q`, buff.String())
+	}
+}
+
+func TestResponseHeaderInjection(t *testing.T) {
+	var buff bytes.Buffer
+	res := newResponse(&buff, &Request{ProtoMajor: 1, ProtoMinor: 1})
+	res.Header().Set("X-Value", "a\r\nSet-Cookie: b")
+	res.finish()
+
+	if strings.Contains(buff.String(), "\r\nSet-Cookie") {
+		t.Fatalf(`Header value injected a field: %q`, buff.String())
+	}
+}
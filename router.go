@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// router matches request paths against the registered path patterns.
+// A pattern is split on "/" into segments which are either static text,
+// a named parameter ":id", a parameter with a regex constraint ":id([0-9]+)"
+// or a trailing catch-all "*filepath" that takes the rest of the path.
+//
+// When several segments could match, static text wins over constrained
+// parameters, constrained over plain parameters and those over a catch-all.
+// A branch that fails deeper down falls back to the next candidate.
+type router struct {
+	root *node
+	// middlewares wrap every request, matched or not
+	middlewares []Middleware
+	// chained is middlewares wrapped around the dispatch of chainedFor,
+	// built on the first request and again after Use
+	mu         sync.Mutex
+	chained    Handler
+	chainedFor *Server
+}
+
+type node struct {
+	static   map[string]*node
+	params   []*node
+	catchAll *node
+	// paramName and constraint describe parameter and catch-all nodes
+	paramName  string
+	constraint *regexp.Regexp
+	// routes holds the routes ending at this node keyed by method
+	routes map[string]route
+}
+
+type routeParam struct {
+	name  string
+	value string
+}
+
+func newRouter() *router {
+	return &router{root: &node{}}
+}
+
+func (r *router) add(path Path, handler Handler) error {
+	if !strings.HasPrefix(path.url, "/") {
+		return fmt.Errorf("path %s has to start with /", path.url)
+	}
+
+	current := r.root
+	segments := strings.Split(path.url[1:], "/")
+	for i, segment := range segments {
+		switch {
+		case strings.HasPrefix(segment, "*"):
+			if i != len(segments)-1 {
+				return fmt.Errorf("catch-all %s has to be the last segment of %s", segment, path.url)
+			}
+			name := segment[1:]
+			if name == "" {
+				return fmt.Errorf("catch-all in %s needs a name", path.url)
+			}
+			if current.catchAll == nil {
+				current.catchAll = &node{paramName: name}
+			} else if current.catchAll.paramName != name {
+				return fmt.Errorf("catch-all %s in %s conflicts with *%s", segment, path.url, current.catchAll.paramName)
+			}
+			current = current.catchAll
+
+		case strings.HasPrefix(segment, ":"):
+			child, err := current.paramChild(segment)
+			if err != nil {
+				return fmt.Errorf("parameter %s in %s: %w", segment, path.url, err)
+			}
+			current = child
+
+		default:
+			if current.static == nil {
+				current.static = make(map[string]*node)
+			}
+			if current.static[segment] == nil {
+				current.static[segment] = &node{}
+			}
+			current = current.static[segment]
+		}
+	}
+
+	if current.routes == nil {
+		current.routes = make(map[string]route)
+	}
+	current.routes[path.method] = route{path, handler}
+	return nil
+}
+
+// paramChild returns the child for a ":name" or ":name(regex)" segment,
+// creating it when no child with the same name and constraint exists.
+// Constrained parameters are kept in front of plain ones.
+func (n *node) paramChild(segment string) (*node, error) {
+	name, expr, hasConstraint := strings.Cut(segment[1:], "(")
+	if hasConstraint {
+		if !strings.HasSuffix(expr, ")") {
+			return nil, fmt.Errorf("unterminated constraint")
+		}
+		expr = expr[:len(expr)-1]
+	}
+	if name == "" {
+		return nil, fmt.Errorf("missing name")
+	}
+
+	for _, child := range n.params {
+		if child.paramName != name {
+			continue
+		}
+		if !hasConstraint && child.constraint == nil {
+			return child, nil
+		}
+		if hasConstraint && child.constraint != nil && child.constraint.String() == "^(?:"+expr+")$" {
+			return child, nil
+		}
+	}
+
+	child := &node{paramName: name}
+	if !hasConstraint {
+		n.params = append(n.params, child)
+		return child, nil
+	}
+
+	constraint, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return nil, err
+	}
+	child.constraint = constraint
+	insertAt := 0
+	for insertAt < len(n.params) && n.params[insertAt].constraint != nil {
+		insertAt++
+	}
+	n.params = append(n.params[:insertAt], append([]*node{child}, n.params[insertAt:]...)...)
+	return child, nil
+}
+
+// match finds the node for the escaped request path and the parameter
+// values extracted on the way there. Segments are decoded one by one so
+// an encoded slash stays inside its segment.
+func (r *router) match(rawPath string) (*node, []routeParam) {
+	if !strings.HasPrefix(rawPath, "/") {
+		return nil, nil
+	}
+	var params []routeParam
+	found := r.root.match(strings.Split(rawPath[1:], "/"), &params)
+	if found == nil {
+		return nil, nil
+	}
+	return found, params
+}
+
+func (n *node) match(segments []string, params *[]routeParam) *node {
+	if len(segments) == 0 {
+		if len(n.routes) > 0 {
+			return n
+		}
+		return nil
+	}
+
+	segment, err := url.PathUnescape(segments[0])
+	if err != nil {
+		return nil
+	}
+
+	if child := n.static[segment]; child != nil {
+		if found := child.match(segments[1:], params); found != nil {
+			return found
+		}
+	}
+
+	if segment != "" {
+		for _, child := range n.params {
+			if child.constraint != nil && !child.constraint.MatchString(segment) {
+				continue
+			}
+			mark := len(*params)
+			*params = append(*params, routeParam{child.paramName, segment})
+			if found := child.match(segments[1:], params); found != nil {
+				return found
+			}
+			*params = (*params)[:mark]
+		}
+	}
+
+	if n.catchAll != nil && len(n.catchAll.routes) > 0 {
+		rest, err := url.PathUnescape(strings.Join(segments, "/"))
+		if err != nil {
+			return nil
+		}
+		*params = append(*params, routeParam{n.catchAll.paramName, rest})
+		return n.catchAll
+	}
+	return nil
+}
+
+// routeFor returns the route registered for method.
+// HEAD requests fall back to the GET route when there is no HEAD one.
+func (n *node) routeFor(method string) (route, bool) {
+	if found, ok := n.routes[method]; ok {
+		return found, true
+	}
+	if method == "HEAD" {
+		return n.routeFor("GET")
+	}
+	return route{}, false
+}
+
+// allowedMethods lists the methods the node answers to for the Allow header
+func (n *node) allowedMethods() []string {
+	var allowed []string
+	for _, method := range methodNames {
+		if _, found := n.routeFor(method); found || method == "OPTIONS" {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+)
+
+func newTestRouter(t *testing.T, urls ...string) *router {
+	r := newRouter()
+	for _, url := range urls {
+		if err := r.add(Path{url, "GET", url}, nil); err != nil {
+			t.Fatalf(`Failed to add route %s %s`, url, err)
+		}
+	}
+	return r
+}
+
+func TestRouterMatching(t *testing.T) {
+	r := newTestRouter(t,
+		"/",
+		"/users/new",
+		"/users/:id([0-9]+)",
+		"/users/:name",
+		"/users/:name/posts/:post",
+		"/users/me/settings",
+		"/static/*filepath",
+		"/static/logo.png",
+	)
+
+	tests := []struct {
+		path    string
+		pattern string
+		params  map[string]string
+	}{
+		{"/", "/", nil},
+		{"/users/new", "/users/new", nil},
+		{"/users/42", "/users/:id([0-9]+)", map[string]string{"id": "42"}},
+		{"/users/alice", "/users/:name", map[string]string{"name": "alice"}},
+		{"/users/a%2Fb", "/users/:name", map[string]string{"name": "a/b"}},
+		{"/users/me/settings", "/users/me/settings", nil},
+		// "me" has no posts route under the static node so the parameter is tried next
+		{"/users/me/posts/1", "/users/:name/posts/:post", map[string]string{"name": "me", "post": "1"}},
+		{"/static/logo.png", "/static/logo.png", nil},
+		{"/static/css/site.css", "/static/*filepath", map[string]string{"filepath": "css/site.css"}},
+		{"/static/", "/static/*filepath", map[string]string{"filepath": ""}},
+		{"/users", "", nil},
+		{"/users/", "", nil},
+		{"/missing", "", nil},
+	}
+
+	for _, test := range tests {
+		found, params := r.match(test.path)
+		if test.pattern == "" {
+			if found != nil {
+				t.Fatalf(`%s: expected no match got: %v`, test.path, found.routes)
+			}
+			continue
+		}
+		if found == nil {
+			t.Fatalf(`%s: expected match for %s`, test.path, test.pattern)
+		}
+		if found.routes["GET"].path.url != test.pattern {
+			t.Fatalf(`%s: matched %s expected: %s`, test.path, found.routes["GET"].path.url, test.pattern)
+		}
+		if len(params) != len(test.params) {
+			t.Fatalf(`%s: wrong params got: %v`, test.path, params)
+		}
+		req := &Request{params: params}
+		for name, value := range test.params {
+			if req.Param(name) != value {
+				t.Fatalf(`%s: param %s got: %q expected: %q`, test.path, name, req.Param(name), value)
+			}
+		}
+	}
+}
+
+func TestRouterConstraintPriority(t *testing.T) {
+	// Registration order must not change which route wins
+	r := newTestRouter(t, "/items/:slug", "/items/:id([0-9]+)")
+
+	found, params := r.match("/items/7")
+	if found == nil || found.routes["GET"].path.url != "/items/:id([0-9]+)" || params[0].name != "id" {
+		t.Fatalf(`Constrained parameter should win for /items/7`)
+	}
+	found, params = r.match("/items/seven")
+	if found == nil || found.routes["GET"].path.url != "/items/:slug" || params[0].value != "seven" {
+		t.Fatalf(`Plain parameter should match /items/seven`)
+	}
+}
+
+func TestRouterInvalidPatterns(t *testing.T) {
+	for _, url := range []string{"no-slash", "/files/*path/more", "/files/*", "/users/:", "/users/:id([0-9]+", "/users/:id([)"} {
+		if err := newRouter().add(Path{url, "GET", ""}, nil); err == nil {
+			t.Fatalf(`Expected error for pattern %s`, url)
+		}
+	}
+
+	r := newTestRouter(t, "/files/*path")
+	if err := r.add(Path{"/files/*other", "GET", ""}, nil); err == nil {
+		t.Fatalf(`Expected error for conflicting catch-all names`)
+	}
+}
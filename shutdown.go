@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// connTracker keeps the listeners and connections of a Server so Shutdown
+// can stop accepting, close idle connections and wait for active ones.
+// It is shared by every copy of the Server.
+type connTracker struct {
+	mu        sync.Mutex
+	listeners []*listener
+	// conns maps each open connection to whether it is serving a request
+	conns map[net.Conn]bool
+	// shutdownHooks tell connections that speak HTTP/2 or WebSocket to
+	// wind down themselves instead of being closed
+	shutdownHooks map[net.Conn]func()
+	shuttingDown  bool
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]bool), shutdownHooks: make(map[net.Conn]func())}
+}
+
+// addListener reports false when the server already shut down
+func (tracker *connTracker) addListener(ln *listener) bool {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.shuttingDown {
+		return false
+	}
+	tracker.listeners = append(tracker.listeners, ln)
+	return true
+}
+
+// add registers a new idle connection with wg, it reports false
+// once shutdown started and the connection should be refused
+func (tracker *connTracker) add(conn net.Conn, wg *sync.WaitGroup) bool {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.shuttingDown {
+		return false
+	}
+	wg.Add(1)
+	tracker.conns[conn] = false
+	return true
+}
+
+func (tracker *connTracker) remove(conn net.Conn) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	delete(tracker.conns, conn)
+	delete(tracker.shutdownHooks, conn)
+}
+
+// setShutdownHook registers the function run for conn when shutdown
+// starts, it reports false when that already happened
+func (tracker *connTracker) setShutdownHook(conn net.Conn, hook func()) bool {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.shuttingDown {
+		return false
+	}
+	// Connections of other servers, as with HTTPHandler, aren't tracked
+	if _, ok := tracker.conns[conn]; ok {
+		tracker.shutdownHooks[conn] = hook
+	}
+	return true
+}
+
+// setActive marks conn as serving a request or waiting for the next one.
+// Going idle reports false during shutdown, the caller closes the connection.
+func (tracker *connTracker) setActive(conn net.Conn, active bool) bool {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if !active && tracker.shuttingDown {
+		return false
+	}
+	tracker.conns[conn] = active
+	return true
+}
+
+// listenerList returns the listeners the server is bound to
+func (tracker *connTracker) listenerList() []*listener {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	return append([]*listener(nil), tracker.listeners...)
+}
+
+func (tracker *connTracker) addrs() []net.Addr {
+	var addrs []net.Addr
+	for _, ln := range tracker.listenerList() {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+func (tracker *connTracker) isShuttingDown() bool {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	return tracker.shuttingDown
+}
+
+// beginShutdown closes the listeners and idle connections,
+// it reports false when shutdown had already started
+func (tracker *connTracker) beginShutdown() bool {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.shuttingDown {
+		return false
+	}
+	tracker.shuttingDown = true
+
+	for _, ln := range tracker.listeners {
+		ln.Close()
+	}
+	for conn, active := range tracker.conns {
+		if hook, ok := tracker.shutdownHooks[conn]; ok {
+			hook()
+		} else if !active {
+			conn.Close()
+		}
+	}
+	return true
+}
+
+// closeAll force-closes every connection and returns how many were mid request
+func (tracker *connTracker) closeAll() int {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	cut := 0
+	for conn, active := range tracker.conns {
+		if active {
+			cut++
+		}
+		conn.Close()
+	}
+	return cut
+}
+
+// Shutdown stops accepting connections, closes idle ones and waits for
+// requests in flight to complete. When ctx ends first the remaining
+// connections are closed anyway and the number of requests cut off is
+// returned together with the context error.
+func (server *Server) Shutdown(ctx context.Context) (int, error) {
+	if server.tracker.beginShutdown() {
+		close(server.shutdownChan)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return 0, nil
+	case <-ctx.Done():
+		cut := server.tracker.closeAll()
+		if server.debug {
+			fmt.Printf("Shutdown deadline passed, cut off %d requests\n", cut)
+		}
+		return cut, ctx.Err()
+	}
+}
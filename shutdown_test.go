@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsActiveRequests(t *testing.T) {
+	server, cleanup := CreateDefaultServer()
+	defer cleanup()
+
+	started := make(chan struct{})
+	server.HandleFunc("GET", "/slow", func(w ResponseWriter, req *Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("finished"))
+	})
+	runServer(t, &server)
+
+	serverAddressAndPort := "127.0.0.1:1337"
+
+	// An idle keep-alive connection which already got its response
+	idle, err := net.Dial("tcp", serverAddressAndPort)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	defer idle.Close()
+	idle.SetDeadline(time.Now().Add(5 * time.Second))
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", "/")
+	rt += fmt.Sprintf("Host: %v\r\n", serverAddressAndPort)
+	rt += fmt.Sprintf("\r\n")
+	idle.Write([]byte(rt))
+	idleReader := bufio.NewReader(idle)
+	res, err := http.ReadResponse(idleReader, nil)
+	if err != nil {
+		t.Fatalf(`Failed to read idle connection response %s`, err)
+	}
+	io.Copy(io.Discard, res.Body)
+
+	active, err := net.Dial("tcp", serverAddressAndPort)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	defer active.Close()
+	active.SetDeadline(time.Now().Add(5 * time.Second))
+	rt = fmt.Sprintf("GET %v HTTP/1.1\r\n", "/slow")
+	rt += fmt.Sprintf("Host: %v\r\n", serverAddressAndPort)
+	rt += fmt.Sprintf("\r\n")
+	active.Write([]byte(rt))
+	<-started
+
+	type result struct {
+		cut int
+		err error
+	}
+	shutdownDone := make(chan result)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		cut, err := server.Shutdown(ctx)
+		shutdownDone <- result{cut, err}
+	}()
+
+	if _, err := idleReader.ReadByte(); err != io.EOF {
+		t.Fatalf(`Expected idle connection to be closed got: %v`, err)
+	}
+	if conn, err := net.DialTimeout("tcp", serverAddressAndPort, time.Second); err == nil {
+		conn.Close()
+		t.Fatalf(`Server still accepts connections during shutdown`)
+	}
+
+	res, err = http.ReadResponse(bufio.NewReader(active), nil)
+	if err != nil {
+		t.Fatalf(`Active request was not completed %s`, err)
+	}
+	content, _ := io.ReadAll(res.Body)
+	if res.StatusCode != HTTP_OK || string(content) != "finished" || !res.Close {
+		t.Fatalf(`Wrong drained response got: %d %q close: %v`, res.StatusCode, content, res.Close)
+	}
+
+	shutdown := <-shutdownDone
+	if shutdown.cut != 0 || shutdown.err != nil {
+		t.Fatalf(`Expected clean shutdown got: %d %v`, shutdown.cut, shutdown.err)
+	}
+}
+
+func TestShutdownDeadlineCutsOffRequests(t *testing.T) {
+	server, cleanup := CreateDefaultServer()
+	defer cleanup()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	server.HandleFunc("GET", "/stuck", func(w ResponseWriter, req *Request) {
+		close(started)
+		<-release
+	})
+	runServer(t, &server)
+
+	serverAddressAndPort := "127.0.0.1:1337"
+
+	conn, err := net.Dial("tcp", serverAddressAndPort)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", "/stuck")
+	rt += fmt.Sprintf("Host: %v\r\n", serverAddressAndPort)
+	rt += fmt.Sprintf("\r\n")
+	conn.Write([]byte(rt))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	cut, err := server.Shutdown(ctx)
+	if cut != 1 || err != context.DeadlineExceeded {
+		t.Fatalf(`Expected one request cut off got: %d %v`, cut, err)
+	}
+
+	buff := make([]byte, 1)
+	if _, err := conn.Read(buff); err == nil {
+		t.Fatalf(`Expected cut off connection to be closed`)
+	}
+}
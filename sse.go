@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sseHeartbeat is the default interval of the comment lines that keep
+// idle streams open through proxies
+const sseHeartbeat = 15 * time.Second
+
+var errSSEClosed = errors.New("sse: stream closed")
+
+// SSEEvent is a single Server-Sent Event. Data may span several lines,
+// Retry tells the client how long to wait before reconnecting.
+type SSEEvent struct {
+	ID    string
+	Event string
+	Data  string
+	Retry time.Duration
+}
+
+// SSEReplayBuffer keeps recent events so reconnecting clients get what
+// they missed. Publishers add every event they send to it.
+type SSEReplayBuffer interface {
+	Add(event SSEEvent)
+	// Since returns the events added after the one with lastEventID,
+	// ok is false when that event is not in the buffer anymore
+	Since(lastEventID string) (events []SSEEvent, ok bool)
+}
+
+// SSEOptions configures SSEHandler
+type SSEOptions struct {
+	// Heartbeat is the interval of keep-alive comments, 15 seconds when
+	// zero and none at all when negative
+	Heartbeat time.Duration
+	// Retry is sent to the client once when the stream starts
+	Retry time.Duration
+	// Replay resends missed events to clients sending Last-Event-ID
+	Replay SSEReplayBuffer
+}
+
+// SSEStream is the event stream of one client
+type SSEStream struct {
+	w       ResponseWriter
+	flusher Flusher
+	req     *Request
+
+	mu sync.Mutex
+	// done is closed once the client went away or the server shuts down
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// SSEHandler answers requests with an event stream. handler sends
+// events until it returns or the stream's Done channel is closed, events
+// the client missed are replayed before it is called.
+func SSEHandler(options SSEOptions, handler func(stream *SSEStream)) Handler {
+	heartbeat := options.Heartbeat
+	if heartbeat == 0 {
+		heartbeat = sseHeartbeat
+	}
+
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		flusher, ok := w.(Flusher)
+		if !ok {
+			sendStatus(w, HTTP_INTERNAL_SERVER_ERROR)
+			return
+		}
+		header := w.Header()
+		header.Set("Content-Type", "text/event-stream")
+		header.Set("Cache-Control", "no-cache")
+		// Keeps buffering proxies such as nginx from holding events back
+		header.Set("X-Accel-Buffering", "no")
+		w.WriteHeader(HTTP_OK)
+
+		stream := &SSEStream{w: w, flusher: flusher, req: req, done: make(chan struct{})}
+		var closed <-chan struct{}
+		if notifier, ok := w.(CloseNotifier); ok {
+			closed = notifier.CloseNotify()
+		}
+
+		if options.Retry > 0 {
+			stream.write(fmt.Sprintf("retry: %d\n\n", options.Retry.Milliseconds()))
+		}
+		if lastEventID := stream.LastEventID(); options.Replay != nil && lastEventID != "" {
+			events, _ := options.Replay.Since(lastEventID)
+			for _, event := range events {
+				stream.Send(event)
+			}
+		}
+		stream.flush()
+
+		// The response must not be written to after the handler returned
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			stream.watch(closed, stop, heartbeat)
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+		handler(stream)
+	})
+}
+
+// watch sends heartbeats and closes the stream when the client leaves
+func (stream *SSEStream) watch(closed <-chan struct{}, stop chan struct{}, heartbeat time.Duration) {
+	var tick <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-closed:
+			stream.close()
+			return
+		case <-stop:
+			return
+		case <-stream.done:
+			return
+		case <-tick:
+			if stream.write(":\n\n") == nil {
+				stream.flush()
+			}
+		}
+	}
+}
+
+// Done is closed once the client disconnected or the server shuts down
+func (stream *SSEStream) Done() <-chan struct{} {
+	return stream.done
+}
+
+func (stream *SSEStream) Request() *Request {
+	return stream.req
+}
+
+// LastEventID is the id of the last event a reconnecting client saw
+func (stream *SSEStream) LastEventID() string {
+	return stream.req.Header.Get("Last-Event-ID")
+}
+
+// Send writes event and flushes it to the client right away
+func (stream *SSEStream) Send(event SSEEvent) error {
+	if strings.ContainsAny(event.ID, "\r\n\x00") || strings.ContainsAny(event.Event, "\r\n") {
+		return errors.New("sse: id and event must be a single line")
+	}
+
+	var frame strings.Builder
+	if event.ID != "" {
+		frame.WriteString("id: " + event.ID + "\n")
+	}
+	if event.Event != "" {
+		frame.WriteString("event: " + event.Event + "\n")
+	}
+	if event.Retry > 0 {
+		fmt.Fprintf(&frame, "retry: %d\n", event.Retry.Milliseconds())
+	}
+	// Every line of the data gets its own field, the client joins them with \n
+	data := strings.ReplaceAll(strings.ReplaceAll(event.Data, "\r\n", "\n"), "\r", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		frame.WriteString("data: " + line + "\n")
+	}
+	frame.WriteString("\n")
+
+	if err := stream.write(frame.String()); err != nil {
+		return err
+	}
+	return stream.flush()
+}
+
+// Comment sends a comment line, which clients ignore
+func (stream *SSEStream) Comment(text string) error {
+	if strings.ContainsAny(text, "\r\n") {
+		return errors.New("sse: comment must be a single line")
+	}
+	if err := stream.write(": " + text + "\n\n"); err != nil {
+		return err
+	}
+	return stream.flush()
+}
+
+func (stream *SSEStream) write(s string) error {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	select {
+	case <-stream.done:
+		return errSSEClosed
+	default:
+	}
+	if _, err := stream.w.Write([]byte(s)); err != nil {
+		stream.close()
+		return err
+	}
+	return nil
+}
+
+func (stream *SSEStream) flush() error {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+	if err := stream.flusher.Flush(); err != nil {
+		stream.close()
+		return err
+	}
+	return nil
+}
+
+func (stream *SSEStream) close() {
+	stream.closeOnce.Do(func() { close(stream.done) })
+}
+
+// SSEMemoryBuffer is an SSEReplayBuffer holding the last size events in memory
+type SSEMemoryBuffer struct {
+	mu     sync.Mutex
+	events []SSEEvent
+	size   int
+}
+
+func NewSSEMemoryBuffer(size int) *SSEMemoryBuffer {
+	return &SSEMemoryBuffer{size: size}
+}
+
+// Add keeps event, events without an id can't be resumed from and are skipped
+func (buffer *SSEMemoryBuffer) Add(event SSEEvent) {
+	if event.ID == "" {
+		return
+	}
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+	buffer.events = append(buffer.events, event)
+	if len(buffer.events) > buffer.size {
+		buffer.events = append([]SSEEvent(nil), buffer.events[len(buffer.events)-buffer.size:]...)
+	}
+}
+
+func (buffer *SSEMemoryBuffer) Since(lastEventID string) ([]SSEEvent, bool) {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+	for i := len(buffer.events) - 1; i >= 0; i-- {
+		if buffer.events[i].ID == lastEventID {
+			return append([]SSEEvent(nil), buffer.events[i+1:]...), true
+		}
+	}
+	return nil, false
+}
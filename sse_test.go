@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openEventStream sends a GET for path and returns the response with a
+// reader over its decoded body
+func openEventStream(t *testing.T, addr string, path string, lastEventID string) (net.Conn, *http.Response, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", path)
+	rt += fmt.Sprintf("Host: %v\r\n", addr)
+	if lastEventID != "" {
+		rt += fmt.Sprintf("Last-Event-ID: %v\r\n", lastEventID)
+	}
+	rt += fmt.Sprintf("\r\n")
+	conn.Write([]byte(rt))
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf(`Failed to read response %s`, err)
+	}
+	return conn, res, bufio.NewReader(res.Body)
+}
+
+// readEvent returns the lines of the next event without the blank line ending it
+func readEvent(t *testing.T, reader *bufio.Reader) []string {
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf(`Failed to read event %s after %q`, err, lines)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestSSEStream(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	server.Handle("GET", "/events", SSEHandler(SSEOptions{Retry: 3 * time.Second}, func(stream *SSEStream) {
+		stream.Send(SSEEvent{ID: "1", Event: "greeting", Data: "hello"})
+		stream.Send(SSEEvent{Data: "two\nlines"})
+		if err := stream.Send(SSEEvent{ID: "bad\nid"}); err == nil {
+			t.Errorf(`Expected an id with a line break to fail`)
+		}
+	}))
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	conn, res, reader := openEventStream(t, addr, "/events", "")
+	defer conn.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" || res.Header.Get("Cache-Control") != "no-cache" || len(res.TransferEncoding) == 0 {
+		t.Fatalf(`Wrong event stream headers got: %v %v`, res.Header, res.TransferEncoding)
+	}
+
+	expected := [][]string{
+		{"retry: 3000"},
+		{"id: 1", "event: greeting", "data: hello"},
+		{"data: two", "data: lines"},
+	}
+	for _, want := range expected {
+		if got := readEvent(t, reader); strings.Join(got, "|") != strings.Join(want, "|") {
+			t.Fatalf(`Wrong event got: %q expected: %q`, got, want)
+		}
+	}
+}
+
+func TestSSEHeartbeatAndDisconnect(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	disconnected := make(chan struct{})
+	server.Handle("GET", "/events", SSEHandler(SSEOptions{Heartbeat: 20 * time.Millisecond}, func(stream *SSEStream) {
+		<-stream.Done()
+		close(disconnected)
+	}))
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	conn, _, reader := openEventStream(t, addr, "/events", "")
+	if got := readEvent(t, reader); len(got) != 1 || got[0] != ":" {
+		t.Fatalf(`Expected a heartbeat comment got: %q`, got)
+	}
+	conn.Close()
+
+	select {
+	case <-disconnected:
+	case <-time.After(2 * time.Second):
+		t.Fatalf(`Handler was not told about the disconnect`)
+	}
+}
+
+func TestSSEReplay(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	buffer := NewSSEMemoryBuffer(3)
+	for i := 1; i <= 5; i++ {
+		buffer.Add(SSEEvent{ID: fmt.Sprint(i), Data: fmt.Sprintf("event %d", i)})
+	}
+	server.Handle("GET", "/events", SSEHandler(SSEOptions{Replay: buffer}, func(stream *SSEStream) {
+		stream.Send(SSEEvent{ID: "6", Data: "live"})
+	}))
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	conn, _, reader := openEventStream(t, addr, "/events", "3")
+	defer conn.Close()
+	for _, want := range []string{"event 4", "event 5", "live"} {
+		if got := readEvent(t, reader); got[len(got)-1] != "data: "+want {
+			t.Fatalf(`Wrong replayed event got: %q expected: %s`, got, want)
+		}
+	}
+
+	// Event 1 fell out of the buffer, so nothing can be replayed
+	if events, ok := buffer.Since("1"); ok || len(events) != 0 {
+		t.Fatalf(`Expected evicted id to be unknown got: %v`, events)
+	}
+	conn, _, reader = openEventStream(t, addr, "/events", "1")
+	defer conn.Close()
+	if got := readEvent(t, reader); got[len(got)-1] != "data: live" {
+		t.Fatalf(`Expected only the live event got: %q`, got)
+	}
+}
+
+func TestSSEEndsOnShutdown(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "a.test")
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.Handle("GET", "/events", SSEHandler(SSEOptions{}, func(stream *SSEStream) {
+		stream.Send(SSEEvent{Data: "ready"})
+		<-stream.Done()
+	}))
+	addr := runTLSServer(t, &server, [2]string{certFile, keyFile})
+
+	// The stream is served over HTTP/2 here
+	res, err := http2TestTransport().Get(fmt.Sprintf("https://%s/events", addr))
+	if err != nil {
+		t.Fatalf(`Failed to open event stream %s`, err)
+	}
+	defer res.Body.Close()
+	reader := bufio.NewReader(res.Body)
+	if got := readEvent(t, reader); res.ProtoMajor != 2 || got[0] != "data: ready" {
+		t.Fatalf(`Wrong first event got: %s %q`, res.Proto, got)
+	}
+
+	// And over HTTP/1.1 on a second connection
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		t.Fatalf(`Failed TLS handshake %s`, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "GET /events HTTP/1.1\r\nHost: %s\r\n\r\n", addr)
+	res1, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf(`Failed to read response %s`, err)
+	}
+	if got := readEvent(t, bufio.NewReader(res1.Body)); got[0] != "data: ready" {
+		t.Fatalf(`Wrong first HTTP/1.1 event got: %q`, got)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := server.Shutdown(ctx); err != nil {
+		t.Fatalf(`Open event stream kept shutdown from draining got: %s`, err)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ServeDir serves the files below dir under the URL prefix. Directories
+// are answered with their index.html, or a listing with SetDirListing.
+// Paths leaving dir, including through symlinks, are not served.
+func (server *Server) ServeDir(prefix string, dir string) error {
+	fsys, err := newDirFS(dir)
+	if err != nil {
+		return err
+	}
+	return server.ServeFS(prefix, fsys)
+}
+
+// SetDirListing lists the files of directories without an index.html
+// instead of answering 403
+func (server *Server) SetDirListing(enabled bool) {
+	server.dirListing = enabled
+}
+
+// ServeFS serves the files of fsys under the URL prefix like ServeDir,
+// so assets can be compiled in with embed.FS. fs.Sub strips the directory
+// an embed.FS keeps its files in.
+func (server *Server) ServeFS(prefix string, fsys fs.FS) error {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if err := server.Handle("GET", prefix+"/*filepath", server.staticHandler(fsys)); err != nil {
+		return err
+	}
+	if prefix == "" {
+		return nil
+	}
+	// The bare prefix is the root directory, which needs its slash
+	return server.HandleFunc("GET", prefix, func(w ResponseWriter, req *Request) {
+		redirectToDir(w, req)
+	})
+}
+
+// staticHandler serves the file named by the filepath parameter from fsys
+func (server *Server) staticHandler(fsys fs.FS) Handler {
+	etags := newETagCache()
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		// An encoded slash or backslash could smuggle a separator past the router
+		lowerPath := strings.ToLower(req.RawPath)
+		if strings.Contains(lowerPath, "%2f") || strings.Contains(lowerPath, "%5c") || strings.Contains(req.Path, "\\") {
+			sendStatus(w, HTTP_BAD_REQUEST)
+			return
+		}
+		requested := req.Param("filepath")
+		name := strings.TrimSuffix(requested, "/")
+		if name == "" {
+			name = "."
+		}
+		// ValidPath rejects .. and . elements, empty ones and absolute paths
+		if !fs.ValidPath(name) {
+			sendStatus(w, HTTP_BAD_REQUEST)
+			return
+		}
+
+		info, err := fs.Stat(fsys, name)
+		if err != nil {
+			server.sendFSError(w, err)
+			return
+		}
+		if !info.IsDir() {
+			if requested != name {
+				sendStatus(w, HTTP_NOT_FOUND)
+				return
+			}
+			server.serveFile(w, req, fsys, etags, name, info)
+			return
+		}
+
+		if !strings.HasSuffix(req.Path, "/") {
+			redirectToDir(w, req)
+			return
+		}
+		index := path.Join(name, "index.html")
+		if indexInfo, err := fs.Stat(fsys, index); err == nil && !indexInfo.IsDir() {
+			server.serveFile(w, req, fsys, etags, index, indexInfo)
+			return
+		}
+		if !server.dirListing {
+			sendStatus(w, HTTP_FORBIDDEN)
+			return
+		}
+		server.serveDirListing(w, req, fsys, name)
+	})
+}
+
+// sendFSError answers a failed lookup, files outside the root look missing
+func (server *Server) sendFSError(w ResponseWriter, err error) {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		sendStatus(w, HTTP_NOT_FOUND)
+		return
+	}
+	if server.debug {
+		fmt.Println("Failed to open file:", err)
+	}
+	sendStatus(w, HTTP_INTERNAL_SERVER_ERROR)
+}
+
+// redirectToDir sends the client to the directory URL with its trailing slash
+func redirectToDir(w ResponseWriter, req *Request) {
+	location := req.RawPath + "/"
+	if req.RawQuery != "" {
+		location += "?" + req.RawQuery
+	}
+	w.Header().Set("Location", location)
+	sendStatus(w, HTTP_PERMANENT_REDIRECT)
+}
+
+// serveFile sends the file name of fsys with its detected content type,
+// or the parts of it asked for with Range. Conditional requests are
+// answered by its ETag and Last-Modified.
+func (server *Server) serveFile(w ResponseWriter, req *Request, fsys fs.FS, etags *etagCache, name string, info fs.FileInfo) {
+	etag, err := fileETag(fsys, etags, name, info)
+	if err != nil {
+		server.sendFSError(w, err)
+		return
+	}
+	header := w.Header()
+	header.Set("ETag", etag)
+	if !info.ModTime().IsZero() {
+		header.Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+	}
+	switch code := checkPreconditions(req, etag, info.ModTime()); code {
+	case HTTP_NOT_MODIFIED:
+		w.WriteHeader(code)
+		return
+	case HTTP_PRECONDITION_FAILED:
+		sendStatus(w, code)
+		return
+	}
+
+	file, err := fsys.Open(name)
+	if err != nil {
+		server.sendFSError(w, err)
+		return
+	}
+	defer file.Close()
+
+	// Sniffing needs the start of the file, which is sent from the buffer
+	var sniffed []byte
+	if mime.TypeByExtension(path.Ext(name)) == "" {
+		sniffed = make([]byte, 512)
+		n, err := io.ReadFull(file, sniffed)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			server.sendFSError(w, err)
+			return
+		}
+		sniffed = sniffed[:n]
+	}
+	contentType := detectContentType(name, sniffed)
+
+	header.Set("Content-Type", contentType)
+	header.Set("X-Content-Type-Options", "nosniff")
+
+	// Ranges need seeking, files that can't are always sent whole
+	seeker, canSeek := file.(io.ReadSeeker)
+	if canSeek {
+		header.Set("Accept-Ranges", "bytes")
+	}
+	if canSeek && req.Method == "GET" && req.Header.Has("Range") && ifRangeMatches(req, etag, info.ModTime()) {
+		ranges, err := parseRange(req.Header.Get("Range"), info.Size())
+		if err != nil {
+			header.Del("Content-Type")
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size()))
+			sendStatus(w, HTTP_RANGE_NOT_SATISFIABLE)
+			return
+		}
+		if ranges != nil {
+			server.serveRanges(w, seeker, contentType, ranges, info.Size())
+			return
+		}
+	}
+
+	header.Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.WriteHeader(HTTP_OK)
+	if req.Method == "HEAD" {
+		return
+	}
+	if _, err := io.Copy(w, io.MultiReader(bytes.NewReader(sniffed), file)); err != nil && server.debug {
+		fmt.Println("Failed to send file:", err)
+	}
+}
+
+// detectContentType picks the type by the extension of name and falls
+// back to sniffing the first bytes of the content
+func detectContentType(name string, start []byte) string {
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		return contentType
+	}
+	return http.DetectContentType(start)
+}
+
+// serveDirListing answers with links to the entries of the directory name
+func (server *Server) serveDirListing(w ResponseWriter, req *Request, fsys fs.FS, name string) {
+	entries, err := fs.ReadDir(fsys, name)
+	if err != nil {
+		server.sendFSError(w, err)
+		return
+	}
+
+	title := html.EscapeString("Index of " + req.Path)
+	var page bytes.Buffer
+	page.WriteString("<!DOCTYPE html>\n<html>\n<head><meta charset=\"utf-8\"><title>" + title + "</title></head>\n<body>\n")
+	page.WriteString("<h1>" + title + "</h1>\n<ul>\n")
+	if name != "." {
+		page.WriteString("<li><a href=\"../\">../</a></li>\n")
+	}
+	for _, entry := range entries {
+		entryName := entry.Name()
+		if entry.IsDir() {
+			entryName += "/"
+		}
+		href := (&url.URL{Path: entryName}).EscapedPath()
+		// A colon in the first segment would read as a URL scheme
+		if strings.Contains(entry.Name(), ":") {
+			href = "./" + href
+		}
+		page.WriteString("<li><a href=\"" + html.EscapeString(href) + "\">" + html.EscapeString(entryName) + "</a></li>\n")
+	}
+	page.WriteString("</ul>\n</body>\n</html>\n")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(page.Len()))
+	w.WriteHeader(HTTP_OK)
+	w.Write(page.Bytes())
+}
+
+// dirFS is an fs.FS over a directory which refuses files that only
+// symlinks pointing outside of it lead to
+type dirFS struct {
+	root string
+}
+
+func newDirFS(dir string) (*dirFS, error) {
+	root, err := filepath.Abs(dir)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	return &dirFS{root: root}, nil
+}
+
+func (fsys *dirFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(fsys.root, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	if resolved != fsys.root && !strings.HasPrefix(resolved, fsys.root+string(filepath.Separator)) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return os.Open(resolved)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeStaticTree creates a directory to serve and a secret file next to it
+func writeStaticTree(t *testing.T) string {
+	base := t.TempDir()
+	root := filepath.Join(base, "public")
+	files := map[string]string{
+		"hello.txt":           "hello world",
+		"style.css":           "body { color: red }",
+		"blob":                "\x89PNG\r\n\x1a\n0000",
+		"docs/index.html":     "<h1>docs</h1>",
+		"assets/a <b>.txt":    "let a = 1",
+		"assets/nested/x.txt": "x",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf(`Failed to write file %s`, err)
+		}
+	}
+	os.WriteFile(filepath.Join(base, "secret.txt"), []byte("secret"), 0644)
+	if err := os.Symlink(filepath.Join(base, "secret.txt"), filepath.Join(root, "escape.txt")); err != nil {
+		t.Fatalf(`Failed to create symlink %s`, err)
+	}
+	os.Symlink("hello.txt", filepath.Join(root, "inside.txt"))
+	return root
+}
+
+func runStaticServer(t *testing.T, listing bool) (string, func()) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	server.SetListenAddrs("127.0.0.1:0")
+	server.SetDirListing(listing)
+	if err := server.ServeDir("/static/", writeStaticTree(t)); err != nil {
+		t.Fatalf(`Failed to serve directory %s`, err)
+	}
+	runServer(t, &server)
+	return server.Addrs()[0].String(), cleanup
+}
+
+func getPath(t *testing.T, addr string, method string, target string) (int, string, string, string) {
+	res, content := sendRequestTo(t, addr, fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\n\r\n", method, target, addr))
+	return res.StatusCode, res.Header.Get("Content-Type"), res.Header.Get("Location"), content
+}
+
+func TestServeDirFiles(t *testing.T) {
+	addr, cleanup := runStaticServer(t, false)
+	defer cleanup()
+
+	cases := []struct {
+		target      string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"/static/hello.txt", HTTP_OK, "text/plain; charset=utf-8", "hello world"},
+		{"/static/style.css", HTTP_OK, "text/css; charset=utf-8", "body { color: red }"},
+		{"/static/blob", HTTP_OK, "image/png", "\x89PNG\r\n\x1a\n0000"},
+		{"/static/docs/", HTTP_OK, "text/html; charset=utf-8", "<h1>docs</h1>"},
+		{"/static/assets/a%20%3Cb%3E.txt", HTTP_OK, "text/plain; charset=utf-8", "let a = 1"},
+		{"/static/inside.txt", HTTP_OK, "text/plain; charset=utf-8", "hello world"},
+		{"/static/missing.txt", HTTP_NOT_FOUND, "", ""},
+		{"/static/hello.txt/", HTTP_NOT_FOUND, "", ""},
+		{"/static/assets/", HTTP_FORBIDDEN, "", ""},
+	}
+	for _, c := range cases {
+		status, contentType, _, body := getPath(t, addr, "GET", c.target)
+		if status != c.status || (c.status == HTTP_OK && (contentType != c.contentType || body != c.body)) {
+			t.Fatalf(`Wrong response for %s got: %d %q %q`, c.target, status, contentType, body)
+		}
+	}
+
+	if status, _, _, body := getPath(t, addr, "HEAD", "/static/hello.txt"); status != HTTP_OK || body != "" {
+		t.Fatalf(`Wrong HEAD response got: %d %q`, status, body)
+	}
+	for _, target := range []string{"/static/docs?page=2", "/static"} {
+		status, _, location, _ := getPath(t, addr, "GET", target)
+		want := strings.Replace(target, "?", "/?", 1)
+		if !strings.Contains(want, "?") {
+			want += "/"
+		}
+		if status != HTTP_PERMANENT_REDIRECT || location != want {
+			t.Fatalf(`Expected redirect for %s to %s got: %d %q`, target, want, status, location)
+		}
+	}
+}
+
+func TestServeDirRejectsTraversal(t *testing.T) {
+	addr, cleanup := runStaticServer(t, false)
+	defer cleanup()
+
+	for _, target := range []string{
+		"/static/../secret.txt",
+		"/static/%2e%2e/secret.txt",
+		"/static/docs/..%2fhello.txt",
+		"/static/docs%2Findex.html",
+		"/static/docs%5cindex.html",
+		"/static//hello.txt",
+	} {
+		if status, _, _, body := getPath(t, addr, "GET", target); status != HTTP_BAD_REQUEST || strings.Contains(body, "secret") {
+			t.Fatalf(`Expected %s to be rejected got: %d %q`, target, status, body)
+		}
+	}
+	// A symlink leading outside of the root looks like a missing file
+	if status, _, _, body := getPath(t, addr, "GET", "/static/escape.txt"); status != HTTP_NOT_FOUND || body == "secret" {
+		t.Fatalf(`Expected escaping symlink to be hidden got: %d %q`, status, body)
+	}
+}
+
+func TestServeDirListing(t *testing.T) {
+	addr, cleanup := runStaticServer(t, true)
+	defer cleanup()
+
+	status, contentType, _, body := getPath(t, addr, "GET", "/static/assets/")
+	if status != HTTP_OK || contentType != "text/html; charset=utf-8" {
+		t.Fatalf(`Wrong listing response got: %d %q`, status, contentType)
+	}
+	for _, want := range []string{`<a href="../">`, `<a href="a%20%3Cb%3E.txt">a &lt;b&gt;.txt</a>`, `<a href="nested/">nested/</a>`} {
+		if !strings.Contains(body, want) {
+			t.Fatalf(`Listing is missing %s got: %s`, want, body)
+		}
+	}
+	// Directories with an index still serve it
+	if _, _, _, body := getPath(t, addr, "GET", "/static/docs/"); body != "<h1>docs</h1>" {
+		t.Fatalf(`Expected the index got: %q`, body)
+	}
+}
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+func TestServeFSEmbedded(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	assets, err := fs.Sub(embeddedTemplates, "templates")
+	if err != nil {
+		t.Fatalf(`Failed to open embedded directory %s`, err)
+	}
+	if err := server.ServeFS("/assets", assets); err != nil {
+		t.Fatalf(`Failed to serve fs %s`, err)
+	}
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	expected, err := embeddedTemplates.ReadFile("templates/index.html")
+	if err != nil {
+		t.Fatalf(`Failed to read embedded file %s`, err)
+	}
+	status, contentType, _, content := getPath(t, addr, "GET", "/assets/index.html")
+	if status != HTTP_OK || contentType != "text/html; charset=utf-8" || content != string(expected) {
+		t.Fatalf(`Wrong embedded file got: %d %q %q`, status, contentType, content)
+	}
+	status, _, location, _ := getPath(t, addr, "GET", "/assets")
+	if status != HTTP_PERMANENT_REDIRECT || location != "/assets/" {
+		t.Fatalf(`Wrong redirect to the embedded root got: %d %q`, status, location)
+	}
+	status, _, _, _ = getPath(t, addr, "GET", "/assets/../main.go")
+	if status == HTTP_OK {
+		t.Fatalf(`Served a file outside the embedded directory`)
+	}
+}
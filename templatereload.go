@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strconv"
+	"time"
+)
+
+// liveReloadPath is the event stream pages listen on for template changes
+const liveReloadPath = "/_livereload"
+
+var liveReloadScript = []byte(`<script>new EventSource("` + liveReloadPath + `").addEventListener("reload", function () { location.reload() })</script>`)
+
+// SetTemplatePollInterval sets how often a debug server checks
+// templatesPath for edits, 0 turns reloading off
+func (server *Server) SetTemplatePollInterval(interval time.Duration) {
+	server.templates.interval = interval
+}
+
+// SetLiveReload makes rendered pages of a debug server refresh themselves
+// whenever the templates are reloaded. It does nothing outside debug mode.
+func (server *Server) SetLiveReload(enabled bool) error {
+	if !server.debug || server.templates.liveReload == enabled {
+		return nil
+	}
+	server.templates.liveReload = enabled
+	if !enabled {
+		// The route stays, pages just stop listening on it
+		return nil
+	}
+	return server.Handle("GET", liveReloadPath, SSEHandler(SSEOptions{}, func(stream *SSEStream) {
+		for {
+			select {
+			case <-stream.Done():
+				return
+			case <-server.templates.changedChan():
+				if stream.Send(SSEEvent{Event: "reload", Data: "templates changed"}) != nil {
+					return
+				}
+			}
+		}
+	}))
+}
+
+// poll reloads the templates whenever their files change until done is closed
+func (set *templateSet) poll(done chan struct{}, debug bool) {
+	if set.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(set.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			_, _, stamp, err := set.scan()
+			set.mu.RLock()
+			unchanged := stamp == set.stamp
+			set.mu.RUnlock()
+			if err != nil || unchanged {
+				continue
+			}
+
+			err = set.load()
+			if debug {
+				if err != nil {
+					fmt.Println("Failed to reload templates:", err)
+				} else {
+					fmt.Println("Reloaded templates from", set.dir)
+				}
+			}
+			set.mu.Lock()
+			close(set.changed)
+			set.changed = make(chan struct{})
+			set.mu.Unlock()
+		}
+	}
+}
+
+// changedChan is closed after the next reload
+func (set *templateSet) changedChan() <-chan struct{} {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	return set.changed
+}
+
+// renderTemplateError shows a failed template to the developer in the
+// browser, the page reloads itself once the template is fixed
+func (server *Server) renderTemplateError(w ResponseWriter, err error) {
+	var page bytes.Buffer
+	page.WriteString("<!DOCTYPE html>\n<html>\n<head><title>Template error</title></head>\n<body>\n")
+	page.WriteString("<h1>Template error</h1>\n<pre>" + html.EscapeString(err.Error()) + "</pre>\n")
+	page.WriteString("</body>\n</html>\n")
+
+	body := page.Bytes()
+	if server.templates.liveReload {
+		body = injectLiveReload(body)
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(HTTP_INTERNAL_SERVER_ERROR)
+	w.Write(body)
+}
+
+// injectLiveReload adds the live reload script before </body>, or at the
+// end of pages without one
+func injectLiveReload(page []byte) []byte {
+	at := bytes.LastIndex(bytes.ToLower(page), []byte("</body>"))
+	if at < 0 {
+		at = len(page)
+	}
+	out := make([]byte, 0, len(page)+len(liveReloadScript))
+	out = append(out, page[:at]...)
+	out = append(out, liveReloadScript...)
+	return append(out, page[at:]...)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// editTemplate rewrites a template with a modification time that is
+// guaranteed to differ from the previous one
+func editTemplate(t *testing.T, templatesPath string, name string, content string, age int) {
+	path := filepath.Join("."+templatesPath, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf(`Failed to write template %s`, err)
+	}
+	modified := time.Now().Add(time.Duration(age) * time.Second)
+	os.Chtimes(path, modified, modified)
+}
+
+// waitForPage polls url until the body contains want
+func waitForPage(t *testing.T, addr string, url string, want string) (int, string) {
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		res, content := sendRequestTo(t, addr, fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", url, addr))
+		if strings.Contains(content, want) {
+			return res.StatusCode, content
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf(`Page never contained %q, last got: %d %q`, want, res.StatusCode, content)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTemplateHotReload(t *testing.T) {
+	templatesPath := writeTemplates(t, map[string]string{"page.html": `<p>version 1</p>`})
+	server, cleanup := CreateServer("127.0.0.1", "0", templatesPath, []Path{{"/", "GET", "page.html"}}, true)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	server.SetTemplatePollInterval(10 * time.Millisecond)
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	waitForPage(t, addr, "/", "version 1")
+	editTemplate(t, templatesPath, "page.html", `<p>version 2</p>`, 1)
+	waitForPage(t, addr, "/", "version 2")
+
+	// A broken edit is shown in the browser instead of stopping the server
+	editTemplate(t, templatesPath, "page.html", `<p>{{if .Method}}unclosed</p>`, 2)
+	status, content := waitForPage(t, addr, "/", "Template error")
+	if status != HTTP_INTERNAL_SERVER_ERROR || !strings.Contains(content, "page.html") || strings.Contains(content, "<p>{{") {
+		t.Fatalf(`Wrong error page got: %d %q`, status, content)
+	}
+
+	editTemplate(t, templatesPath, "page.html", `<p>version 3 for {{.Method}}</p>`, 3)
+	if status, _ := waitForPage(t, addr, "/", "version 3 for GET"); status != HTTP_OK {
+		t.Fatalf(`Expected the fixed page to be served got: %d`, status)
+	}
+}
+
+func TestTemplateLiveReload(t *testing.T) {
+	templatesPath := writeTemplates(t, map[string]string{"page.html": `<html><body><p>live</p></body></html>`})
+	server, cleanup := CreateServer("127.0.0.1", "0", templatesPath, []Path{{"/", "GET", "page.html"}}, true)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	server.SetTemplatePollInterval(10 * time.Millisecond)
+	if err := server.SetLiveReload(true); err != nil {
+		t.Fatalf(`Failed to enable live reload %s`, err)
+	}
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	_, content := sendRequestTo(t, addr, fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\n\r\n", addr))
+	if !strings.HasSuffix(content, string(liveReloadScript)+"</body></html>") {
+		t.Fatalf(`Live reload script was not injected got: %q`, content)
+	}
+
+	conn, _, reader := openEventStream(t, addr, liveReloadPath, "")
+	defer conn.Close()
+	editTemplate(t, templatesPath, "page.html", `<p>edited</p>`, 1)
+	if got := readEvent(t, reader); len(got) == 0 || got[0] != "event: reload" {
+		t.Fatalf(`Expected a reload event got: %q`, got)
+	}
+}
+
+func TestLiveReloadNeedsDebug(t *testing.T) {
+	templatesPath := writeTemplates(t, map[string]string{"page.html": `<body>page</body>`})
+	server, cleanup := CreateServer("127.0.0.1", "0", templatesPath, []Path{{"/", "GET", "page.html"}}, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	server.SetLiveReload(true)
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	if _, content := sendRequestTo(t, addr, fmt.Sprintf("GET / HTTP/1.1\r\nHost: %s\r\n\r\n", addr)); content != `<body>page</body>` {
+		t.Fatalf(`Expected the page untouched got: %q`, content)
+	}
+	res, _ := sendRequestTo(t, addr, fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", liveReloadPath, addr))
+	if res.StatusCode != HTTP_NOT_FOUND {
+		t.Fatalf(`Expected no live reload route got: %d`, res.StatusCode)
+	}
+}
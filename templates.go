@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Templates in these directories of templatesPath are shared by all pages
+var templateSharedDirs = []string{"layouts", "partials"}
+
+// templateSet holds the parsed templates of templatesPath. Every page is
+// parsed into its own copy of the layouts and partials, so pages can
+// define the same blocks without clashing.
+type templateSet struct {
+	fsys fs.FS
+	// etags keeps the tags of files FileHandler sends from fsys
+	etags *etagCache
+	// dir names fsys in messages
+	dir   string
+	funcs template.FuncMap
+	// interval is how often debug servers look for changed files
+	interval time.Duration
+	// liveReload injects a script reloading pages when templates change
+	liveReload bool
+
+	mu     sync.RWMutex
+	pages  map[string]*template.Template
+	loaded bool
+	// stamp identifies the files the last load saw, err is what it failed with
+	stamp string
+	err   error
+	// changed is closed and replaced after every reload
+	changed chan struct{}
+}
+
+func newTemplateSet(fsys fs.FS, dir string) *templateSet {
+	return &templateSet{
+		fsys:     fsys,
+		etags:    newETagCache(),
+		dir:      dir,
+		funcs:    make(template.FuncMap),
+		interval: 500 * time.Millisecond,
+		changed:  make(chan struct{}),
+	}
+}
+
+// SetTemplateFS reads templates and the files of paths from fsys instead
+// of templatesPath in the working directory, for example from an embed.FS.
+// fs.Sub picks the templates directory of a larger file system. It has to
+// be set before paths are added.
+func (server *Server) SetTemplateFS(fsys fs.FS) {
+	server.templates.fsys = fsys
+	server.templates.etags = newETagCache()
+	server.templates.dir = "the template fs"
+}
+
+// SetTemplateFuncs adds functions the templates can call. They have to be
+// set before the templates are parsed when the server starts.
+func (server *Server) SetTemplateFuncs(funcs template.FuncMap) {
+	for name, fn := range funcs {
+		server.templates.funcs[name] = fn
+	}
+}
+
+// LoadTemplates parses the templates under templatesPath. Listen calls
+// it, so a broken template keeps the server from starting.
+func (server *Server) LoadTemplates() error {
+	return server.templates.load()
+}
+
+// load parses every .html file below dir, a missing dir holds no templates
+func (set *templateSet) load() error {
+	shared, pages, stamp, err := set.scan()
+	if err == nil {
+		var parsed map[string]*template.Template
+		if parsed, err = set.parseAll(shared, pages); err == nil {
+			set.mu.Lock()
+			set.pages = parsed
+			set.loaded = true
+			set.mu.Unlock()
+		}
+	}
+
+	set.mu.Lock()
+	set.stamp = stamp
+	set.err = err
+	set.mu.Unlock()
+	return err
+}
+
+// scan lists the shared templates and pages, stamp changes whenever a
+// file is added, removed or modified
+func (set *templateSet) scan() (shared []string, pages []string, stamp string, err error) {
+	var files strings.Builder
+	err = fs.WalkDir(set.fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if name == "." && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(name, ".html") {
+			return nil
+		}
+		if isSharedTemplate(name) {
+			shared = append(shared, name)
+		} else {
+			pages = append(pages, name)
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&files, "%s %d %d\n", name, info.ModTime().UnixNano(), info.Size())
+		return nil
+	})
+	return shared, pages, files.String(), err
+}
+
+func (set *templateSet) parseAll(shared []string, pages []string) (map[string]*template.Template, error) {
+	base := template.New("").Funcs(set.funcs)
+	for _, name := range shared {
+		if err := set.parse(base, name); err != nil {
+			return nil, err
+		}
+	}
+	parsed := make(map[string]*template.Template, len(pages))
+	for _, name := range pages {
+		page, err := base.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if err := set.parse(page, name); err != nil {
+			return nil, err
+		}
+		parsed[name] = page.Lookup(name)
+	}
+	return parsed, nil
+}
+
+func isSharedTemplate(name string) bool {
+	for _, dir := range templateSharedDirs {
+		if strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// parse adds the file name to t as a template of the same name
+func (set *templateSet) parse(t *template.Template, name string) error {
+	content, err := fs.ReadFile(set.fsys, name)
+	if err != nil {
+		return err
+	}
+	_, err = t.New(name).Parse(string(content))
+	return err
+}
+
+// lookup returns the page called name, parsing the set first if needed
+func (set *templateSet) lookup(name string) (*template.Template, error) {
+	set.mu.RLock()
+	loaded, loadErr := set.loaded, set.err
+	page := set.pages[name]
+	set.mu.RUnlock()
+	if !loaded {
+		if err := set.load(); err != nil {
+			return nil, err
+		}
+		return set.lookup(name)
+	}
+	// A broken edit hides the pages until it is fixed
+	if loadErr != nil {
+		return nil, loadErr
+	}
+	if page == nil {
+		return nil, fmt.Errorf("no template %s in %s", name, set.dir)
+	}
+	return page, nil
+}
+
+// Render executes the page template name with data and sends it as
+// text/html. Nothing is sent before the template ran without errors,
+// failures are answered with 500 and returned.
+func (server *Server) Render(w ResponseWriter, name string, data any) error {
+	return server.render(w, nil, name, data)
+}
+
+// render is Render answering the conditional requests of req, when given,
+// by a weak ETag of the rendered page
+func (server *Server) render(w ResponseWriter, req *Request, name string, data any) error {
+	page, err := server.templates.lookup(name)
+	var buf bytes.Buffer
+	if err == nil {
+		err = page.Execute(&buf, data)
+	}
+	if err != nil {
+		if server.debug {
+			fmt.Println("Failed to render template:", err)
+			server.renderTemplateError(w, err)
+			return err
+		}
+		sendStatus(w, HTTP_INTERNAL_SERVER_ERROR)
+		return err
+	}
+
+	body := buf.Bytes()
+	if server.debug && server.templates.liveReload {
+		body = injectLiveReload(body)
+	}
+	etag := contentETag(body, true)
+	w.Header().Set("ETag", etag)
+	if req != nil {
+		switch code := checkPreconditions(req, etag, time.Time{}); code {
+		case HTTP_NOT_MODIFIED:
+			w.WriteHeader(code)
+			return nil
+		case HTTP_PRECONDITION_FAILED:
+			sendStatus(w, code)
+			return nil
+		}
+	}
+	if !w.Header().Has("Content-Type") {
+		w.Header().Set("Content-Type", "text/html")
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(HTTP_OK)
+	_, err = w.Write(body)
+	return err
+}
+
+// TemplateHandler renders the page template name with the request as data.
+// Unchanged pages are answered with 304 to clients sending their ETag.
+func (server *Server) TemplateHandler(name string) Handler {
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		server.render(w, req, name, req)
+	})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// writeTemplates creates files below a fresh directory in the working
+// directory, as templatesPath is relative to it, and returns that path
+func writeTemplates(t *testing.T, files map[string]string) string {
+	dir, err := os.MkdirTemp(".", "templates-test-")
+	if err != nil {
+		t.Fatalf(`Failed to create templates directory %s`, err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf(`Failed to write template %s`, err)
+		}
+	}
+	return "/" + filepath.Base(dir)
+}
+
+var layoutTemplates = map[string]string{
+	"layouts/base.html":  `<title>{{block "title" .}}Site{{end}}</title>{{template "partials/nav.html" .}}<main>{{template "content" .}}</main>`,
+	"partials/nav.html":  `<nav>{{shout "menu"}}</nav>`,
+	"home.html":          `{{template "layouts/base.html" .}}{{define "title"}}Home{{end}}{{define "content"}}Hello {{.Name}}, 100% done{{end}}`,
+	"blog/post.html":     `{{template "layouts/base.html" .}}{{define "content"}}Post at {{.Path}}{{end}}`,
+	"raw/unrelated.html": `{{define "content"}}never used{{end}}`,
+}
+
+func TestRenderLayoutsAndPartials(t *testing.T) {
+	templatesPath := writeTemplates(t, layoutTemplates)
+	server, cleanup := CreateServer("127.0.0.1", "0", templatesPath, nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	server.SetTemplateFuncs(template.FuncMap{"shout": strings.ToUpper})
+	server.HandleFunc("GET", "/home", func(w ResponseWriter, req *Request) {
+		server.Render(w, "home.html", map[string]string{"Name": "<b>bob</b>"})
+	})
+	if err := server.AddPath("/post", "GET", "blog/post.html"); err != nil {
+		t.Fatalf(`Failed to add path %s`, err)
+	}
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	res, content := sendRequestTo(t, addr, fmt.Sprintf("GET /home HTTP/1.1\r\nHost: %s\r\n\r\n", addr))
+	expected := `<title>Home</title><nav>MENU</nav><main>Hello &lt;b&gt;bob&lt;/b&gt;, 100% done</main>`
+	if res.StatusCode != HTTP_OK || content != expected || res.Header.Get("Content-Type") != "text/html" {
+		t.Fatalf(`Wrong rendered page got: %d %q`, res.StatusCode, content)
+	}
+
+	// Pages added as paths get the request as data and the default title
+	res, content = sendRequestTo(t, addr, fmt.Sprintf("GET /post HTTP/1.1\r\nHost: %s\r\n\r\n", addr))
+	if res.StatusCode != HTTP_OK || content != `<title>Site</title><nav>MENU</nav><main>Post at /post</main>` {
+		t.Fatalf(`Wrong rendered path got: %d %q`, res.StatusCode, content)
+	}
+}
+
+func TestRenderMissingTemplate(t *testing.T) {
+	templatesPath := writeTemplates(t, layoutTemplates)
+	server, cleanup := CreateServer("127.0.0.1", "0", templatesPath, nil, false)
+	defer cleanup()
+	server.SetTemplateFuncs(template.FuncMap{"shout": strings.ToUpper})
+	server.SetListenAddrs("127.0.0.1:0")
+	server.HandleFunc("GET", "/missing", func(w ResponseWriter, req *Request) {
+		if err := server.Render(w, "missing.html", nil); err == nil {
+			t.Errorf(`Expected rendering a missing template to fail`)
+		}
+	})
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	res, _ := sendRequestTo(t, addr, fmt.Sprintf("GET /missing HTTP/1.1\r\nHost: %s\r\n\r\n", addr))
+	if res.StatusCode != HTTP_INTERNAL_SERVER_ERROR {
+		t.Fatalf(`Expected 500 got: %d`, res.StatusCode)
+	}
+}
+
+func TestTemplateErrorsStopStartup(t *testing.T) {
+	broken := map[string]string{
+		"syntax":        `{{if .Name}}unclosed`,
+		"unknown func":  `{{shout .Name}}`,
+		"broken layout": `{{template "layouts/base.html" .}}`,
+	}
+	for name, content := range broken {
+		files := map[string]string{"page.html": content}
+		if name == "broken layout" {
+			files["layouts/base.html"] = `{{end}}`
+		}
+		templatesPath := writeTemplates(t, files)
+		server, cleanup := CreateServer("127.0.0.1", "0", templatesPath, nil, false)
+		server.SetListenAddrs("127.0.0.1:0")
+		if err := server.Listen(); err == nil || !strings.Contains(err.Error(), ".html") {
+			t.Fatalf(`Expected %s to fail at startup got: %v`, name, err)
+		}
+		cleanup()
+	}
+}
+
+func TestTemplateFS(t *testing.T) {
+	// The template fs replaces templatesPath, which doesn't exist here
+	server, cleanup := CreateServer("127.0.0.1", "0", "/missing-templates", nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	server.SetTemplateFS(fstest.MapFS{
+		"layouts/base.html": {Data: []byte(`<title>{{block "title" .}}Site{{end}}</title>{{template "content" .}}`)},
+		"page.html":         {Data: []byte(`{{template "layouts/base.html" .}}{{define "content"}}Page {{.Path}}{{end}}`)},
+		"robots.txt":        {Data: []byte("User-agent: *\n")},
+	})
+	if err := server.AddPath("/page", "GET", "page.html"); err != nil {
+		t.Fatalf(`Failed to add path %s`, err)
+	}
+	if err := server.AddPath("/robots.txt", "GET", "robots.txt"); err != nil {
+		t.Fatalf(`Failed to add path %s`, err)
+	}
+	if err := server.AddPath("/gone", "GET", "gone.html"); err == nil {
+		t.Fatalf(`Added a path to a file missing from the template fs`)
+	}
+	runServer(t, &server)
+	addr := server.Addrs()[0].String()
+
+	res, content := sendRequestTo(t, addr, fmt.Sprintf("GET /page HTTP/1.1\r\nHost: %s\r\n\r\n", addr))
+	if res.StatusCode != HTTP_OK || content != `<title>Site</title>Page /page` {
+		t.Fatalf(`Wrong page from the template fs got: %d %q`, res.StatusCode, content)
+	}
+	res, content = sendRequestTo(t, addr, fmt.Sprintf("GET /robots.txt HTTP/1.1\r\nHost: %s\r\n\r\n", addr))
+	if res.StatusCode != HTTP_OK || content != "User-agent: *\n" || res.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Fatalf(`Wrong file from the template fs got: %d %q %q`, res.StatusCode, res.Header.Get("Content-Type"), content)
+	}
+}
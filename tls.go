@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SetTLSConfig makes Listen serve HTTPS with a copy of config.
+// It replaces earlier TLS settings, so call it before AddCertificate,
+// SetTLSMinVersion or SetTLSCipherSuites.
+func (server *Server) SetTLSConfig(config *tls.Config) {
+	server.tlsConfig = config.Clone()
+}
+
+// AddCertificate loads a PEM encoded certificate and key and enables TLS.
+// With several certificates the one matching the SNI name sent by the
+// client is picked, the first one is used when none matches.
+func (server *Server) AddCertificate(certFile string, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	config := server.ensureTLSConfig()
+	config.Certificates = append(config.Certificates, cert)
+	return nil
+}
+
+// SetTLSMinVersion sets the lowest accepted TLS version, the default is TLS 1.2
+func (server *Server) SetTLSMinVersion(version uint16) {
+	server.ensureTLSConfig().MinVersion = version
+}
+
+// SetTLSCipherSuites limits the TLS 1.2 cipher suites, TLS 1.3 ones are not configurable
+func (server *Server) SetTLSCipherSuites(suites ...uint16) {
+	server.ensureTLSConfig().CipherSuites = suites
+}
+
+// SetHTTPRedirect listens for plain HTTP on addr next to the TLS listeners
+// and redirects every request there to the same target over HTTPS
+func (server *Server) SetHTTPRedirect(addr string) {
+	server.redirectAddr = addr
+}
+
+// ListenTLS serves HTTPS with the given certificate until Shutdown.
+// Empty file names use the certificates configured beforehand.
+func (server *Server) ListenTLS(certFile string, keyFile string) error {
+	if certFile != "" || keyFile != "" {
+		if err := server.AddCertificate(certFile, keyFile); err != nil {
+			return err
+		}
+	}
+	server.ensureTLSConfig()
+	return server.Listen()
+}
+
+func (server *Server) ensureTLSConfig() *tls.Config {
+	if server.tlsConfig == nil {
+		server.tlsConfig = &tls.Config{}
+	}
+	return server.tlsConfig
+}
+
+// listenTLSConfig returns the config the listeners are wrapped with,
+// nil when the server speaks plain HTTP
+func (server *Server) listenTLSConfig() (*tls.Config, error) {
+	if server.tlsConfig == nil {
+		return nil, nil
+	}
+	config := server.tlsConfig.Clone()
+	if !server.certs.isEmpty() {
+		config.GetCertificate = server.certs.getCertificate(len(config.Certificates) == 0, config.GetCertificate)
+	}
+	if server.acme != nil {
+		config.GetCertificate = server.acme.getCertificate(config.GetCertificate)
+	}
+	if len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return nil, errors.New("TLS is enabled but no certificate is configured")
+	}
+	// Without a pool crypto/tls would verify client certificates against
+	// the system roots and accept any publicly issued one
+	verify := config.ClientAuth == tls.VerifyClientCertIfGiven || config.ClientAuth == tls.RequireAndVerifyClientCert
+	if verify && config.ClientCAs == nil && config.GetConfigForClient == nil {
+		return nil, errors.New("client certificates are verified but no client CA pool is configured")
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{"http/1.1"}
+		if server.http2 {
+			config.NextProtos = []string{"h2", "http/1.1"}
+		}
+	}
+	// The CA validates http-01 over plain HTTP, which only the redirect listener speaks
+	if server.acme != nil && server.acme.config.Challenge == acmeHTTPChallenge && server.redirectAddr == "" {
+		return nil, errors.New("acme: the http-01 challenge needs a plain HTTP listener, set one with SetHTTPRedirect")
+	}
+	if server.acme != nil && server.acme.config.Challenge == acmeTLSALPNChallenge {
+		config.NextProtos = append(config.NextProtos, acmeTLSALPNProto)
+	}
+	return config, nil
+}
+
+// certificateCovers reports whether name is one the server has a certificate
+// for, so HTTPS requests may name it in Host whatever address the listener
+// is bound to. Certificates picked by a GetCertificate or GetConfigForClient
+// of SetTLSConfig can't be listed, so there the SNI name of the connection,
+// which the handshake accepted, is trusted instead.
+func (server *Server) certificateCovers(conn *tls.Conn, name string) bool {
+	config := server.tlsConfig
+	if config == nil {
+		return false
+	}
+	certs := server.certs.current()
+	for i := range config.Certificates {
+		certs = append(certs, &config.Certificates[i])
+	}
+	for _, cert := range certs {
+		if cert == nil {
+			continue
+		}
+		leaf := cert.Leaf
+		if leaf == nil && len(cert.Certificate) > 0 {
+			leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if leaf != nil && leaf.VerifyHostname(name) == nil {
+			return true
+		}
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if server.acme != nil && slices.Contains(server.acme.config.Domains, name) {
+		return true
+	}
+	if config.GetCertificate != nil || config.GetConfigForClient != nil {
+		return strings.EqualFold(name, conn.ConnectionState().ServerName)
+	}
+	return false
+}
+
+// redirectHandler answers with a permanent redirect to the same target on
+// the HTTPS port, 308 keeps the method and body of the request
+func redirectHandler(tlsPort int) Handler {
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		if req.Host == "" {
+			sendStatus(w, HTTP_BAD_REQUEST)
+			return
+		}
+		host := req.Host
+		if name, _, err := net.SplitHostPort(req.Host); err == nil {
+			host = name
+		}
+		if tlsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(tlsPort))
+		} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			host = "[" + host + "]"
+		}
+
+		target := req.RawPath
+		if req.RawQuery != "" {
+			target += "?" + req.RawQuery
+		}
+		w.Header().Set("Location", "https://"+host+target)
+		sendStatus(w, HTTP_PERMANENT_REDIRECT)
+	})
+}
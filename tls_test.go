@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for names and
+// its key to dir and returns both file paths
+func writeTestCertificate(t *testing.T, dir string, names ...string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf(`Failed to generate key %s`, err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf(`Failed to create certificate %s`, err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf(`Failed to marshal key %s`, err)
+	}
+
+	certFile := filepath.Join(dir, names[0]+".crt")
+	keyFile := filepath.Join(dir, names[0]+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf(`Failed to write certificate %s`, err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf(`Failed to write key %s`, err)
+	}
+	return certFile, keyFile
+}
+
+// runTLSServer starts a server with the certificates on a free port and returns its address
+func runTLSServer(t *testing.T, server *Server, certs ...[2]string) string {
+	server.SetListenAddrs("127.0.0.1:0")
+	for _, cert := range certs {
+		if err := server.AddCertificate(cert[0], cert[1]); err != nil {
+			t.Fatalf(`Failed to add certificate %s`, err)
+		}
+	}
+	runServer(t, server)
+	return server.Addrs()[0].String()
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "a.test")
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	var sawTLS bool
+	server.HandleFunc("GET", "/secure", func(w ResponseWriter, req *Request) {
+		sawTLS = req.TLS != nil && req.TLS.ServerName == "a.test"
+		w.Write([]byte("secure"))
+	})
+	addr := runTLSServer(t, &server, [2]string{certFile, keyFile})
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "a.test", InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		t.Fatalf(`Failed TLS handshake %s`, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The server is bound to 127.0.0.1 but the name of its certificate is
+	// accepted. Without a port the HTTPS default port is assumed, so use the real one.
+	_, port, _ := net.SplitHostPort(addr)
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", "/secure")
+	rt += fmt.Sprintf("Host: %v\r\n", net.JoinHostPort("a.test", port))
+	rt += fmt.Sprintf("\r\n")
+	conn.Write([]byte(rt))
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf(`Failed to read response %s`, err)
+	}
+	content, _ := io.ReadAll(res.Body)
+	if res.StatusCode != HTTP_OK || string(content) != "secure" || !sawTLS {
+		t.Fatalf(`Wrong HTTPS response got: %d %q tls: %v`, res.StatusCode, content, sawTLS)
+	}
+	if state := conn.ConnectionState(); state.Version < tls.VersionTLS12 || state.NegotiatedProtocol != "http/1.1" {
+		t.Fatalf(`Wrong connection state got: %x %q`, state.Version, state.NegotiatedProtocol)
+	}
+
+	// Names without a certificate are still refused
+	rt = fmt.Sprintf("GET %v HTTP/1.1\r\n", "/secure")
+	rt += fmt.Sprintf("Host: %v\r\n", net.JoinHostPort("other.test", port))
+	rt += fmt.Sprintf("\r\n")
+	conn.Write([]byte(rt))
+	res, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || res.StatusCode != HTTP_BAD_REQUEST {
+		t.Fatalf(`Expected 400 for a name without a certificate got: %v %v`, res, err)
+	}
+}
+
+func TestTLSPicksCertificateBySNI(t *testing.T) {
+	dir := t.TempDir()
+	certA, keyA := writeTestCertificate(t, dir, "a.test")
+	certB, keyB := writeTestCertificate(t, dir, "b.test", "www.b.test")
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	addr := runTLSServer(t, &server, [2]string{certA, keyA}, [2]string{certB, keyB})
+
+	for serverName, expected := range map[string]string{"a.test": "a.test", "www.b.test": "b.test", "other.test": "a.test"} {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf(`Failed TLS handshake for %s %s`, serverName, err)
+		}
+		got := conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		conn.Close()
+		if got != expected {
+			t.Fatalf(`Wrong certificate for %s got: %s`, serverName, got)
+		}
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "a.test")
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	server.SetTLSMinVersion(tls.VersionTLS13)
+	addr := runTLSServer(t, &server, [2]string{certFile, keyFile})
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	if err == nil {
+		conn.Close()
+		t.Fatalf(`Expected TLS 1.2 handshake to be refused`)
+	}
+	conn, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf(`Failed TLS 1.3 handshake %s`, err)
+	}
+	conn.Close()
+}
+
+func TestTLSWithoutCertificate(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	if err := server.ListenTLS("", ""); err == nil {
+		t.Fatalf(`Expected TLS without certificates to fail`)
+	}
+}
+
+func TestHTTPRedirectsToHTTPS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCertificate(t, dir, "a.test")
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", []Path{{"/", "GET", "index.html"}}, false)
+	defer cleanup()
+	server.SetHTTPRedirect("127.0.0.1:0")
+	addr := runTLSServer(t, &server, [2]string{certFile, keyFile})
+	_, tlsPort, _ := net.SplitHostPort(addr)
+	redirectAddr := server.Addrs()[1].String()
+
+	rt := fmt.Sprintf("POST %v HTTP/1.1\r\n", "/form?name=a%20b")
+	rt += fmt.Sprintf("Host: %v\r\n", "a.test")
+	rt += fmt.Sprintf("Content-Length: 0\r\n")
+	rt += fmt.Sprintf("\r\n")
+	res, _ := sendRequestTo(t, redirectAddr, rt)
+	if res.StatusCode != HTTP_PERMANENT_REDIRECT {
+		t.Fatalf(`Wrong redirect status got: %d`, res.StatusCode)
+	}
+	if location := res.Header.Get("Location"); location != "https://a.test:"+tlsPort+"/form?name=a%20b" {
+		t.Fatalf(`Wrong redirect location got: %s`, location)
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// websocketGUID is appended to the client key for Sec-WebSocket-Accept, RFC 6455 section 1.3
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocketCloseTimeout is how long the client gets to answer a close frame
+const websocketCloseTimeout = 5 * time.Second
+
+// WebSocket message types, the values are the frame opcodes
+const (
+	WebSocketText   = 0x1
+	WebSocketBinary = 0x2
+
+	websocketContinuation = 0x0
+	websocketClose        = 0x8
+	websocketPing         = 0x9
+	websocketPong         = 0xa
+)
+
+// WebSocket close codes, RFC 6455 section 7.4.1
+const (
+	WebSocketCloseNormal          = 1000
+	WebSocketCloseGoingAway       = 1001
+	WebSocketCloseProtocolError   = 1002
+	WebSocketCloseUnsupportedData = 1003
+	WebSocketCloseNoStatus        = 1005
+	WebSocketCloseInvalidPayload  = 1007
+	WebSocketClosePolicyViolation = 1008
+	WebSocketCloseMessageTooBig   = 1009
+	WebSocketCloseInternalError   = 1011
+)
+
+var errWebSocketClosed = errors.New("websocket: close frame already sent")
+
+// WebSocketCloseError is returned by ReadMessage once the connection is
+// closed with a close frame, Code and Reason are what it carried
+type WebSocketCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (err *WebSocketCloseError) Error() string {
+	return fmt.Sprintf("websocket: closed with %d %s", err.Code, err.Reason)
+}
+
+// WebSocketConn is a server side WebSocket connection. One goroutine may
+// read while others write, writes are serialized.
+type WebSocketConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	req  *Request
+	// readLimit is the largest message ReadMessage accepts
+	readLimit int64
+	// readDone is set once the client closed or broke the protocol
+	readDone bool
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+// SetWebSocketReadLimit sets the largest message WebSocket clients may
+// send, bigger ones close the connection with 1009. The default is 1 MiB.
+func (server *Server) SetWebSocketReadLimit(n int64) {
+	server.webSocketReadLimit = n
+}
+
+// HandleWebSocket registers handler for WebSocket connections to url.
+// It runs once the handshake succeeded, the connection is closed when
+// it returns.
+func (server *Server) HandleWebSocket(url string, handler func(ws *WebSocketConn), middlewares ...Middleware) error {
+	return server.HandleFunc("GET", url, func(w ResponseWriter, req *Request) {
+		ws, err := server.UpgradeWebSocket(w, req)
+		if err != nil {
+			if server.debug {
+				fmt.Println("WebSocket handshake failed:", err)
+			}
+			return
+		}
+		defer ws.closeAndWait()
+		handler(ws)
+	}, middlewares...)
+}
+
+// UpgradeWebSocket checks the opening handshake of req and switches the
+// connection to WebSocket. When it fails the error response was already sent.
+func (server *Server) UpgradeWebSocket(w ResponseWriter, req *Request) (*WebSocketConn, error) {
+	if req.Method != "GET" || req.ProtoMajor != 1 || req.ProtoMinor < 1 {
+		sendStatus(w, HTTP_BAD_REQUEST)
+		return nil, errors.New("websocket handshake needs an HTTP/1.1 GET request")
+	}
+	if !hasToken(req.Header.Values("Upgrade"), "websocket") || !hasToken(req.Header.Values("Connection"), "upgrade") {
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Connection", "Upgrade")
+		sendStatus(w, HTTP_UPGRADE_REQUIRED)
+		return nil, errors.New("request does not ask for a websocket upgrade")
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		sendStatus(w, HTTP_UPGRADE_REQUIRED)
+		return nil, errors.New("unsupported websocket version")
+	}
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		sendStatus(w, HTTP_BAD_REQUEST)
+		return nil, errors.New("invalid Sec-WebSocket-Key")
+	}
+	if req.ContentLength != 0 {
+		sendStatus(w, HTTP_BAD_REQUEST)
+		return nil, errors.New("websocket handshake with a body")
+	}
+
+	hijacker, ok := w.(Hijacker)
+	if !ok {
+		sendStatus(w, HTTP_INTERNAL_SERVER_ERROR)
+		return nil, errNoHijack
+	}
+	conn, br, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := fmt.Sprintf("HTTP/1.1 %d %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		HTTP_SWITCHING_PROTOCOLS, statusText(HTTP_SWITCHING_PROTOCOLS), websocketAccept(key))
+	if _, err := io.WriteString(conn, response); err != nil {
+		return nil, err
+	}
+
+	ws := &WebSocketConn{conn: conn, br: br, req: req, readLimit: server.webSocketReadLimit}
+	goingAway := func() { go ws.Close(WebSocketCloseGoingAway, "server shutting down") }
+	if !server.tracker.setShutdownHook(conn, goingAway) {
+		goingAway()
+	}
+	return ws, nil
+}
+
+// websocketAccept computes the Sec-WebSocket-Accept value for key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Request returns the handshake request
+func (ws *WebSocketConn) Request() *Request {
+	return ws.req
+}
+
+func (ws *WebSocketConn) RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
+
+// SetReadLimit overrides the server's message size limit for this connection
+func (ws *WebSocketConn) SetReadLimit(n int64) {
+	ws.readLimit = n
+}
+
+func (ws *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return ws.conn.SetReadDeadline(t)
+}
+
+func (ws *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return ws.conn.SetWriteDeadline(t)
+}
+
+// websocketError makes ReadMessage fail the connection with code
+type websocketError struct {
+	code   int
+	reason string
+}
+
+func (err *websocketError) Error() string {
+	return fmt.Sprintf("websocket: %s", err.reason)
+}
+
+// ReadMessage returns the next text or binary message, fragmented ones
+// are joined. Pings are answered while waiting. Once the client closes
+// the connection a *WebSocketCloseError is returned.
+func (ws *WebSocketConn) ReadMessage() (int, []byte, error) {
+	messageType := 0
+	var message []byte
+	for {
+		fin, opcode, payload, err := ws.readFrame(ws.readLimit - int64(len(message)))
+		if err != nil {
+			return 0, nil, ws.fail(err)
+		}
+
+		switch opcode {
+		case websocketPing:
+			if err := ws.writeFrame(websocketPong, payload); err != nil && err != errWebSocketClosed {
+				return 0, nil, err
+			}
+			continue
+		case websocketPong:
+			continue
+		case websocketClose:
+			return 0, nil, ws.closeReceived(payload)
+		case websocketContinuation:
+			if messageType == 0 {
+				return 0, nil, ws.fail(&websocketError{WebSocketCloseProtocolError, "continuation without a message"})
+			}
+		case WebSocketText, WebSocketBinary:
+			if messageType != 0 {
+				return 0, nil, ws.fail(&websocketError{WebSocketCloseProtocolError, "new message before the last one ended"})
+			}
+			messageType = int(opcode)
+		default:
+			return 0, nil, ws.fail(&websocketError{WebSocketCloseProtocolError, "unknown opcode"})
+		}
+
+		message = append(message, payload...)
+		if fin {
+			if messageType == WebSocketText && !utf8.Valid(message) {
+				return 0, nil, ws.fail(&websocketError{WebSocketCloseInvalidPayload, "text message is not UTF-8"})
+			}
+			return messageType, message, nil
+		}
+	}
+}
+
+// readFrame reads one client frame, its payload may not exceed limit
+// unless it is a control frame
+func (ws *WebSocketConn) readFrame(limit int64) (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(ws.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := head[0]&0x80 != 0
+	opcode := head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, &websocketError{WebSocketCloseProtocolError, "reserved bits set"}
+	}
+	// Clients have to mask everything they send, RFC 6455 section 5.1
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, &websocketError{WebSocketCloseProtocolError, "unmasked client frame"}
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+		if length>>63 != 0 {
+			return false, 0, nil, &websocketError{WebSocketCloseProtocolError, "invalid length"}
+		}
+	}
+
+	if opcode >= websocketClose {
+		if !fin || length > 125 {
+			return false, 0, nil, &websocketError{WebSocketCloseProtocolError, "invalid control frame"}
+		}
+	} else if length > uint64(max(limit, 0)) {
+		return false, 0, nil, &websocketError{WebSocketCloseMessageTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// fail closes the connection with the code of a protocol violation
+func (ws *WebSocketConn) fail(err error) error {
+	var wsErr *websocketError
+	if errors.As(err, &wsErr) {
+		ws.Close(wsErr.code, wsErr.reason)
+	}
+	ws.readDone = true
+	return err
+}
+
+// closeReceived answers the client's close frame with the same code
+func (ws *WebSocketConn) closeReceived(payload []byte) error {
+	closeErr := &WebSocketCloseError{Code: WebSocketCloseNoStatus}
+	if len(payload) == 1 {
+		return ws.fail(&websocketError{WebSocketCloseProtocolError, "invalid close frame"})
+	}
+	if len(payload) >= 2 {
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+		if !isValidCloseCode(closeErr.Code) || !utf8.ValidString(closeErr.Reason) {
+			return ws.fail(&websocketError{WebSocketCloseProtocolError, "invalid close frame"})
+		}
+	}
+
+	ws.readDone = true
+	if closeErr.Code == WebSocketCloseNoStatus {
+		ws.writeFrame(websocketClose, nil)
+	} else {
+		ws.writeFrame(websocketClose, binary.BigEndian.AppendUint16(nil, uint16(closeErr.Code)))
+	}
+	return closeErr
+}
+
+// isValidCloseCode reports if code may be sent in a close frame
+func isValidCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// WriteMessage sends data as a single text or binary frame
+func (ws *WebSocketConn) WriteMessage(messageType int, data []byte) error {
+	if messageType != WebSocketText && messageType != WebSocketBinary {
+		return fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+	return ws.writeFrame(byte(messageType), data)
+}
+
+// Ping sends a ping, the pong is consumed by ReadMessage
+func (ws *WebSocketConn) Ping(data []byte) error {
+	if len(data) > 125 {
+		return errors.New("websocket: ping payload over 125 bytes")
+	}
+	return ws.writeFrame(websocketPing, data)
+}
+
+// Close sends a close frame, ReadMessage returns once the client answered
+// it or after websocketCloseTimeout. Nothing can be written afterwards.
+// Codes reserved for local use such as 1005 and 1006 are refused.
+func (ws *WebSocketConn) Close(code int, reason string) error {
+	if !isValidCloseCode(code) {
+		return fmt.Errorf("websocket: invalid close code %d", code)
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	// The payload of control frames is limited to 125 bytes, cut the
+	// reason before a rune so it stays valid UTF-8
+	if len(reason) > 123 {
+		cut := 123
+		for cut > 0 && !utf8.RuneStart(reason[cut]) {
+			cut--
+		}
+		reason = reason[:cut]
+	}
+	err := ws.writeFrame(websocketClose, append(payload, reason...))
+	ws.conn.SetReadDeadline(time.Now().Add(websocketCloseTimeout))
+	return err
+}
+
+// closeAndWait ends the connection after the handler returned, waiting
+// for the client's close frame so the client sees a clean close
+func (ws *WebSocketConn) closeAndWait() {
+	if ws.readDone {
+		return
+	}
+	ws.Close(WebSocketCloseNormal, "")
+	for {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func (ws *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closeSent {
+		return errWebSocketClosed
+	}
+	if opcode == websocketClose {
+		ws.closeSent = true
+	}
+
+	head := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		head = append(head, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		head = append(head, 126)
+		head = binary.BigEndian.AppendUint16(head, uint16(len(payload)))
+	default:
+		head = append(head, 127)
+		head = binary.BigEndian.AppendUint64(head, uint64(len(payload)))
+	}
+	buffers := net.Buffers{head, payload}
+	_, err := buffers.WriteTo(ws.conn)
+	return err
+}
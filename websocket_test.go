@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+const testWebSocketKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// dialWebSocket completes the opening handshake for path
+func dialWebSocket(t *testing.T, addr string, path string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf(`Failed to connect to server %s`, err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	rt := fmt.Sprintf("GET %v HTTP/1.1\r\n", path)
+	rt += fmt.Sprintf("Host: %v\r\n", addr)
+	rt += fmt.Sprintf("Upgrade: websocket\r\n")
+	rt += fmt.Sprintf("Connection: keep-alive, Upgrade\r\n")
+	rt += fmt.Sprintf("Sec-WebSocket-Key: %v\r\n", testWebSocketKey)
+	rt += fmt.Sprintf("Sec-WebSocket-Version: 13\r\n")
+	rt += fmt.Sprintf("\r\n")
+	conn.Write([]byte(rt))
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf(`Failed to read handshake response %s`, err)
+	}
+	// The accept value of the sample handshake in RFC 6455 section 1.3
+	if res.StatusCode != HTTP_SWITCHING_PROTOCOLS || res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf(`Wrong handshake response got: %d %v`, res.StatusCode, res.Header)
+	}
+	return conn, reader
+}
+
+// writeClientFrame sends a frame the way browsers do, masked
+func writeClientFrame(conn net.Conn, fin bool, opcode byte, payload []byte) {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	conn.Write(frame)
+}
+
+// readServerFrame reads an unmasked frame sent by the server
+func readServerFrame(t *testing.T, reader *bufio.Reader) (byte, []byte) {
+	var head [2]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		t.Fatalf(`Failed to read frame %s`, err)
+	}
+	if head[1]&0x80 != 0 {
+		t.Fatalf(`Server frames must not be masked`)
+	}
+	length := int(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(reader, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(reader, ext[:])
+		length = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatalf(`Failed to read frame payload %s`, err)
+	}
+	return head[0] & 0x0f, payload
+}
+
+func expectClose(t *testing.T, reader *bufio.Reader, code int) {
+	opcode, payload := readServerFrame(t, reader)
+	if opcode != websocketClose || len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) != code {
+		t.Fatalf(`Expected close %d got: %x %q`, code, opcode, payload)
+	}
+}
+
+// runEchoServer serves a WebSocket echo on /echo and returns the address
+func runEchoServer(t *testing.T, server *Server) (string, chan error) {
+	server.SetListenAddrs("127.0.0.1:0")
+	closed := make(chan error, 1)
+	server.HandleWebSocket("/echo", func(ws *WebSocketConn) {
+		for {
+			messageType, message, err := ws.ReadMessage()
+			if err == nil {
+				err = ws.WriteMessage(messageType, message)
+			}
+			if err != nil {
+				// Only the first connection to end is reported
+				select {
+				case closed <- err:
+				default:
+				}
+				return
+			}
+		}
+	})
+	runServer(t, server)
+	return server.Addrs()[0].String(), closed
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	addr, closed := runEchoServer(t, &server)
+	conn, reader := dialWebSocket(t, addr, "/echo")
+	defer conn.Close()
+
+	writeClientFrame(conn, true, WebSocketText, []byte("hello"))
+	if opcode, payload := readServerFrame(t, reader); opcode != WebSocketText || string(payload) != "hello" {
+		t.Fatalf(`Wrong echo got: %x %q`, opcode, payload)
+	}
+
+	// A fragmented message with a ping in between
+	writeClientFrame(conn, false, WebSocketBinary, []byte("frag"))
+	writeClientFrame(conn, true, websocketPing, []byte("are you there"))
+	writeClientFrame(conn, false, websocketContinuation, []byte("men"))
+	writeClientFrame(conn, true, websocketContinuation, []byte("ted"))
+	if opcode, payload := readServerFrame(t, reader); opcode != websocketPong || string(payload) != "are you there" {
+		t.Fatalf(`Expected pong got: %x %q`, opcode, payload)
+	}
+	if opcode, payload := readServerFrame(t, reader); opcode != WebSocketBinary || string(payload) != "fragmented" {
+		t.Fatalf(`Wrong fragmented echo got: %x %q`, opcode, payload)
+	}
+
+	large := strings.Repeat("x", 70000)
+	writeClientFrame(conn, true, WebSocketText, []byte(large))
+	if _, payload := readServerFrame(t, reader); string(payload) != large {
+		t.Fatalf(`Wrong large echo got %d bytes`, len(payload))
+	}
+
+	writeClientFrame(conn, true, websocketClose, binary.BigEndian.AppendUint16(nil, WebSocketCloseNormal))
+	expectClose(t, reader, WebSocketCloseNormal)
+	var closeErr *WebSocketCloseError
+	if err := <-closed; !errors.As(err, &closeErr) || closeErr.Code != WebSocketCloseNormal {
+		t.Fatalf(`Expected close error got: %v`, err)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf(`Expected the connection to be closed got: %v`, err)
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetWebSocketReadLimit(16)
+	addr, _ := runEchoServer(t, &server)
+
+	cases := []struct {
+		name string
+		send func(conn net.Conn)
+		code int
+	}{
+		{"unmasked frame", func(conn net.Conn) { conn.Write([]byte{0x81, 0x02, 'h', 'i'}) }, WebSocketCloseProtocolError},
+		{"message too big", func(conn net.Conn) { writeClientFrame(conn, true, WebSocketText, []byte(strings.Repeat("x", 17))) }, WebSocketCloseMessageTooBig},
+		{"fragments too big", func(conn net.Conn) {
+			writeClientFrame(conn, false, WebSocketText, []byte(strings.Repeat("x", 10)))
+			writeClientFrame(conn, true, websocketContinuation, []byte(strings.Repeat("x", 10)))
+		}, WebSocketCloseMessageTooBig},
+		{"invalid utf-8", func(conn net.Conn) { writeClientFrame(conn, true, WebSocketText, []byte{0xff, 0xfe}) }, WebSocketCloseInvalidPayload},
+		{"stray continuation", func(conn net.Conn) { writeClientFrame(conn, true, websocketContinuation, []byte("x")) }, WebSocketCloseProtocolError},
+		{"fragmented ping", func(conn net.Conn) { writeClientFrame(conn, false, websocketPing, nil) }, WebSocketCloseProtocolError},
+	}
+	for _, c := range cases {
+		conn, reader := dialWebSocket(t, addr, "/echo")
+		c.send(conn)
+		opcode, payload := readServerFrame(t, reader)
+		if opcode != websocketClose || int(binary.BigEndian.Uint16(payload)) != c.code {
+			t.Fatalf(`Expected close %d for %s got: %x %q`, c.code, c.name, opcode, payload)
+		}
+		conn.Close()
+	}
+}
+
+func TestWebSocketHandshakeValidation(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	addr, _ := runEchoServer(t, &server)
+
+	plain := fmt.Sprintf("GET /echo HTTP/1.1\r\nHost: %s\r\n\r\n", addr)
+	res, _ := sendRequestTo(t, addr, plain)
+	if res.StatusCode != HTTP_UPGRADE_REQUIRED || res.Header.Get("Upgrade") != "websocket" {
+		t.Fatalf(`Expected 426 without upgrade got: %d`, res.StatusCode)
+	}
+
+	upgrade := fmt.Sprintf("GET /echo HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n", addr)
+	res, _ = sendRequestTo(t, addr, upgrade+"Sec-WebSocket-Key: "+testWebSocketKey+"\r\nSec-WebSocket-Version: 8\r\n\r\n")
+	if res.StatusCode != HTTP_UPGRADE_REQUIRED || res.Header.Get("Sec-WebSocket-Version") != "13" {
+		t.Fatalf(`Expected 426 for an old version got: %d %v`, res.StatusCode, res.Header)
+	}
+	res, _ = sendRequestTo(t, addr, upgrade+"Sec-WebSocket-Key: c2hvcnQ=\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	if res.StatusCode != HTTP_BAD_REQUEST {
+		t.Fatalf(`Expected 400 for a bad key got: %d`, res.StatusCode)
+	}
+	res, _ = sendRequestTo(t, addr, fmt.Sprintf("POST /echo HTTP/1.1\r\nHost: %s\r\nContent-Length: 0\r\n\r\n", addr))
+	if res.StatusCode != HTTP_METHOD_NOT_ALLOWED {
+		t.Fatalf(`Expected 405 for POST got: %d`, res.StatusCode)
+	}
+}
+
+func TestWebSocketShutdownSendsClose(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	addr, closed := runEchoServer(t, &server)
+	conn, reader := dialWebSocket(t, addr, "/echo")
+	defer conn.Close()
+
+	shutdownDone := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		_, err := server.Shutdown(ctx)
+		shutdownDone <- err
+	}()
+
+	expectClose(t, reader, WebSocketCloseGoingAway)
+	writeClientFrame(conn, true, websocketClose, binary.BigEndian.AppendUint16(nil, WebSocketCloseGoingAway))
+	var closeErr *WebSocketCloseError
+	if err := <-closed; !errors.As(err, &closeErr) || closeErr.Code != WebSocketCloseGoingAway {
+		t.Fatalf(`Expected close error got: %v`, err)
+	}
+	if err := <-shutdownDone; err != nil {
+		t.Fatalf(`Shutdown did not drain got: %s`, err)
+	}
+}
+
+func TestWebSocketCloseFrame(t *testing.T) {
+	server, cleanup := CreateServer("127.0.0.1", "0", "/templates", nil, false)
+	defer cleanup()
+	server.SetListenAddrs("127.0.0.1:0")
+	refused := make(chan error, 1)
+	server.HandleWebSocket("/close", func(ws *WebSocketConn) {
+		refused <- ws.Close(WebSocketCloseNoStatus, "")
+		// Two byte runes, the 62nd would straddle the 125 byte limit
+		ws.Close(WebSocketCloseNormal, strings.Repeat("é", 100))
+		ws.ReadMessage()
+	})
+	runServer(t, &server)
+	conn, reader := dialWebSocket(t, server.Addrs()[0].String(), "/close")
+	defer conn.Close()
+
+	if err := <-refused; err == nil {
+		t.Fatalf(`Expected close code 1005 to be refused`)
+	}
+	opcode, payload := readServerFrame(t, reader)
+	if opcode != websocketClose || int(binary.BigEndian.Uint16(payload)) != WebSocketCloseNormal {
+		t.Fatalf(`Expected close frame got: %x %q`, opcode, payload)
+	}
+	if reason := payload[2:]; len(payload) > 125 || !utf8.Valid(reason) || string(reason) != strings.Repeat("é", 61) {
+		t.Fatalf(`Wrong close reason got %d bytes: %q`, len(payload), reason)
+	}
+	writeClientFrame(conn, true, websocketClose, binary.BigEndian.AppendUint16(nil, WebSocketCloseNormal))
+}
+
+func TestWebSocketCloseCodes(t *testing.T) {
+	cases := []struct {
+		code  int
+		valid bool
+	}{
+		{999, false},
+		{WebSocketCloseNormal, true},
+		{WebSocketCloseUnsupportedData, true},
+		{1004, false},
+		{WebSocketCloseNoStatus, false},
+		{1006, false},
+		{WebSocketCloseInvalidPayload, true},
+		{WebSocketCloseInternalError, true},
+		// Service Restart, Try Again Later and Bad Gateway
+		{1012, true},
+		{1013, true},
+		{1014, true},
+		{1015, false},
+		{2999, false},
+		{3000, true},
+		{4999, true},
+		{5000, false},
+	}
+	for _, c := range cases {
+		if isValidCloseCode(c.code) != c.valid {
+			t.Fatalf(`Wrong validity for close code %d expected: %v`, c.code, c.valid)
+		}
+	}
+}